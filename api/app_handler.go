@@ -24,7 +24,6 @@ package api
 
 import (
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -80,7 +79,7 @@ func (a *Application) PostAppHandler(c echo.Context) error {
 	})
 
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: app})
 		}
 		log.E(l, "Failed to create app.", func(cm log.CM) {
@@ -110,7 +109,7 @@ func (a *Application) GetAppHandler(c echo.Context) error {
 		return a.DB.Select(&app)
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, map[string]string{})
 		}
 		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
@@ -151,7 +150,7 @@ func (a *Application) PutAppHandler(c echo.Context) error {
 		return err
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: app})
 		}
 		log.E(l, "Failed to update app.", func(cm log.CM) {
@@ -181,7 +180,7 @@ func (a *Application) DeleteAppHandler(c echo.Context) error {
 		return a.DB.Delete(&app)
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, map[string]string{})
 		}
 		log.E(l, "Failed to delete app.", func(cm log.CM) {
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/labstack/echo/v4"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/log"
+	"github.com/topfreegames/marathon/model"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+// AudienceRequest is the payload of an audience estimation, with the service and filters of a job
+type AudienceRequest struct {
+	Service string                 `json:"service"`
+	Filters map[string]interface{} `json:"filters"`
+}
+
+// Validate implementation of the InputValidation interface
+func (r *AudienceRequest) Validate(c echo.Context) error {
+	if !govalidator.StringMatches(r.Service, "^(apns|gcm)$") {
+		return model.InvalidField("service")
+	}
+	if err := model.ValidateFilters(r.Filters); err != nil {
+		return model.InvalidField(fmt.Sprintf("filters: %s", err.Error()))
+	}
+	return nil
+}
+
+// EstimateAudienceHandler is the method called when a post to /apps/:aid/audience is called,
+// it returns how many tokens a job with the service and filters would reach
+func (a *Application) EstimateAudienceHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "audienceHandler"),
+		zap.String("operation", "estimateAudience"),
+		zap.String("appId", c.Param("aid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	request := &AudienceRequest{}
+	err = WithSegment("decodeAndValidate", c, func() error {
+		return decodeAndValidate(c, request)
+	})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: request})
+	}
+	app := &model.App{ID: aid}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Select(&app)
+	})
+	if err != nil {
+		if IsRecordNotFound(err) {
+			return c.JSON(http.StatusNotFound, &Error{Reason: err.Error()})
+		}
+		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	tableName := worker.GetPushDBTableName(app.Name, request.Service)
+	exists, err := a.Worker.PushTableExists(tableName)
+	if err == nil && !exists {
+		reason := fmt.Sprintf("unknown app %s: there is no push table %s", app.Name, tableName)
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: reason, Value: request})
+	}
+	if err == nil && len(request.Filters) > 0 {
+		var columns []string
+		columns, err = a.Worker.GetPushTableColumns(tableName)
+		if err == nil {
+			if filterErr := worker.ValidateFilterColumns(request.Filters, columns); filterErr != nil {
+				reason := model.InvalidField(fmt.Sprintf("filters: %s", filterErr.Error())).Error()
+				return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: reason, Value: request})
+			}
+		}
+	}
+	var tokens int
+	if err == nil {
+		err = WithSegment("db-count", c, func() error {
+			tokens, err = worker.EstimateAudience(a.Worker.PushReadDB, app.Name, request.Service, request.Filters)
+			return err
+		})
+	}
+	if err != nil {
+		log.E(l, "Failed to estimate audience.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]int{"tokens": tokens})
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Audience Handler", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+	var existingApp *model.App
+	var baseRoute string
+
+	w := worker.NewWorker(logger, GetConfPath())
+
+	BeforeEach(func() {
+		app.DB.Exec("DELETE FROM apps;")
+		app.DB.Exec("DELETE FROM users;")
+		CreateTestUser(app.DB, map[string]interface{}{"email": "test@test.com", "isAdmin": true})
+
+		existingApp = CreateTestApp(app.DB)
+		baseRoute = fmt.Sprintf("/apps/%s/audience", existingApp.ID)
+	})
+
+	Describe("Post /apps/:id/audience", func() {
+		It("should return 200 and the number of tokens matching the filters", func() {
+			var expected int
+			_, err := w.PushDB.QueryOne(&expected, "SELECT count(*) FROM testapp_apns WHERE region = 'BR'")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expected).To(BeNumerically(">", 0))
+
+			payload := `{"service": "apns", "filters": {"region": "BR"}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response map[string]interface{}
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["tokens"]).To(BeEquivalentTo(expected))
+		})
+
+		It("should count the tokens matching IN and BETWEEN filters", func() {
+			var expected int
+			_, err := w.PushDB.QueryOne(
+				&expected,
+				"SELECT count(*) FROM testapp_apns WHERE region IN ('BR','US') AND tz::numeric BETWEEN -400 AND 0",
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expected).To(BeNumerically(">", 0))
+
+			payload := `{"service": "apns", "filters": {"region": ["BR", "US"], "tz": {"between": ["-0400", "+0000"]}}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response map[string]interface{}
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["tokens"]).To(BeEquivalentTo(expected))
+		})
+
+		It("should count every token of the service if there are no filters", func() {
+			var expected int
+			_, err := w.PushDB.QueryOne(&expected, "SELECT count(*) FROM testapp_gcm")
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := Post(app, baseRoute, `{"service": "gcm"}`, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response map[string]interface{}
+			err = json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["tokens"]).To(BeEquivalentTo(expected))
+		})
+
+		It("should return 422 if the service is invalid", func() {
+			status, body := Post(app, baseRoute, `{"service": "sms"}`, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["reason"]).To(Equal("invalid service"))
+		})
+
+		It("should return 422 if a filter is not a string", func() {
+			payload := `{"service": "apns", "filters": {"region": 1}}`
+			status, _ := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should return 422 if a filter key is not a column", func() {
+			payload := `{"service": "apns", "filters": {"region\" = 'BR' OR \"1": "1"}}`
+			status, _ := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should match a filter value with quotes as a literal", func() {
+			payload := `{"service": "apns", "filters": {"region": "BR' OR '1'='1"}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusOK))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["tokens"]).To(BeEquivalentTo(0))
+		})
+
+		It("should return 422 if an IN filter has no values", func() {
+			payload := `{"service": "apns", "filters": {"region": []}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["reason"]).To(Equal("invalid filters: filter 'region' must have at least one value"))
+		})
+
+		It("should return 422 if the range is not of numbers", func() {
+			payload := `{"service": "apns", "filters": {"locale": {"between": ["en", "pt"]}}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["reason"]).To(Equal("invalid filters: range of filter 'locale' must be numbers, got en"))
+		})
+
+		It("should return 422 if a filter is on a column the push table doesn't have", func() {
+			payload := `{"service": "apns", "filters": {"NOTapp_version": "1.0"}}`
+			status, body := Post(app, baseRoute, payload, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["reason"]).To(Equal("invalid filters: unsupported filter 'NOTapp_version', the push table has no column app_version"))
+		})
+
+		It("should return 422 if the app has no push table", func() {
+			otherApp := CreateTestApp(app.DB, map[string]interface{}{"name": "unknownapp"})
+			route := fmt.Sprintf("/apps/%s/audience", otherApp.ID)
+			status, body := Post(app, route, `{"service": "apns"}`, "test@test.com")
+			Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+			var response map[string]interface{}
+			err := json.Unmarshal([]byte(body), &response)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response["reason"]).To(Equal("unknown app unknownapp: there is no push table unknownapp_apns"))
+		})
+
+		It("should return 404 if the app does not exist", func() {
+			route := fmt.Sprintf("/apps/%s/audience", uuid.NewV4().String())
+			status, _ := Post(app, route, `{"service": "apns"}`, "test@test.com")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
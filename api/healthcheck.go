@@ -24,8 +24,10 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/topfreegames/marathon/extensions"
 	"github.com/topfreegames/marathon/log"
 	"github.com/uber-go/zap"
 )
@@ -35,9 +37,10 @@ type Health struct {
 	Healthy bool `json:"healthy"`
 }
 
+const postgresHealthcheckTimeout = 5 * time.Second
+
 func (a *Application) checkPostgres() error {
-	_, err := a.DB.Exec("SELECT 1")
-	return err
+	return extensions.PingPG(a.DB, postgresHealthcheckTimeout)
 }
 
 // HealthcheckHandler is the method called when a get to /healthcheck is called
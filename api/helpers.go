@@ -23,13 +23,42 @@
 package api
 
 import (
+	"errors"
+
 	"github.com/labstack/echo/v4"
 	newrelic "github.com/newrelic/go-agent"
+	pg "gopkg.in/pg.v5"
 )
 
 // RecordNotFoundString is the string returned when a record is not found
 var RecordNotFoundString = "pg: no rows in result set"
 
+// postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+// IsRecordNotFound returns whether the error is a query that returned no rows
+func IsRecordNotFound(err error) bool {
+	return errors.Is(err, pg.ErrNoRows)
+}
+
+// IsUniqueViolation returns whether the error is a duplicate key of a unique constraint
+func IsUniqueViolation(err error) bool {
+	return hasErrorCode(err, uniqueViolation)
+}
+
+// IsForeignKeyViolation returns whether the error references a row that doesn't exist
+func IsForeignKeyViolation(err error) bool {
+	return hasErrorCode(err, foreignKeyViolation)
+}
+
+func hasErrorCode(err error, code string) bool {
+	var pgErr pg.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == code
+}
+
 // Error is a struct to help return errors
 type Error struct {
 	Reason string          `json:"reason"`
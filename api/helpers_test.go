@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package api_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/api"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+	"gopkg.in/pg.v5"
+)
+
+var _ = Describe("Helpers", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()),
+		zap.FatalLevel,
+	)
+	app := GetDefaultTestApp(logger)
+
+	It("should tell a record that was not found", func() {
+		Expect(api.IsRecordNotFound(pg.ErrNoRows)).To(BeTrue())
+		Expect(api.IsRecordNotFound(fmt.Errorf("failed to get job: %w", pg.ErrNoRows))).To(BeTrue())
+		Expect(api.IsRecordNotFound(fmt.Errorf("pg: no rows"))).To(BeFalse())
+		Expect(api.IsRecordNotFound(nil)).To(BeFalse())
+	})
+
+	It("should tell a unique violation from a foreign key violation", func() {
+		existing := CreateTestApp(app.DB)
+		err := app.DB.Insert(&model.App{ID: existing.ID, Name: "other", BundleID: "com.other.app", CreatedBy: "test@test.com"})
+		Expect(err).To(HaveOccurred())
+		Expect(api.IsUniqueViolation(err)).To(BeTrue())
+		Expect(api.IsForeignKeyViolation(err)).To(BeFalse())
+
+		template := CreateTestTemplate(app.DB, existing.ID)
+		template.ID = uuid.NewV4()
+		template.AppID = uuid.NewV4()
+		err = app.DB.Insert(template)
+		Expect(err).To(HaveOccurred())
+		Expect(api.IsForeignKeyViolation(err)).To(BeTrue())
+		Expect(api.IsUniqueViolation(err)).To(BeFalse())
+	})
+})
@@ -23,7 +23,9 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -52,14 +54,27 @@ func (a *Application) ListJobsHandler(c echo.Context) error {
 		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
 	}
 	templateName := c.QueryParam("template")
+	var metadata map[string]interface{}
+	if metadataParam := c.QueryParam("metadata"); metadataParam != "" {
+		if err := json.Unmarshal([]byte(metadataParam), &metadata); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "invalid metadata"})
+		}
+	}
 	jobs := []model.Job{}
-	query := a.DB.Model(&jobs).Column("job.*", "App").Where("job.app_id = ?", aid)
-	if templateName != "" {
-		query.Where("job.template_name = ?", templateName)
+	if metadata != nil {
+		err = WithSegment("db-select", c, func() error {
+			jobs, err = model.ListJobsByMetadata(a.DB, aid, templateName, metadata)
+			return err
+		})
+	} else {
+		query := a.DB.Model(&jobs).Column("job.*", "App").Where("job.app_id = ?", aid)
+		if templateName != "" {
+			query.Where("job.template_name = ?", templateName)
+		}
+		err = WithSegment("db-select", c, func() error {
+			return query.Select()
+		})
 	}
-	err = WithSegment("db-select", c, func() error {
-		return query.Select()
-	})
 	if err != nil {
 		log.E(l, "Failed to list jobs.", func(cm log.CM) {
 			cm.Write(zap.Error(err))
@@ -90,7 +105,7 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 		return a.DB.Select(&app)
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: "App not found with given id."})
 		}
 		log.E(l, "Failed to retrieve app.", func(cm log.CM) {
@@ -131,6 +146,13 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 		return err
 	}
 
+	for _, vt := range job.VersionTemplates {
+		skip, err = a.checkTemplateName(vt.TemplateName, job, c)
+		if err != nil || skip {
+			return err
+		}
+	}
+
 	if job.StartsAt == 0 && job.Localized {
 		localeErr := "Job can not be localized and don't have an start time"
 		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: localeErr, Value: job})
@@ -216,8 +238,18 @@ func (a *Application) PostJobHandler(c echo.Context) error {
 }
 
 func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error) {
+	if len(job.Filters) > 0 {
+		columns, err := a.Worker.GetPushTableColumns(worker.GetPushDBTableName(job.App.Name, job.Service))
+		if err != nil {
+			return true, c.JSON(http.StatusInternalServerError, &Error{Reason: "Failed to check filters in Push DB"})
+		}
+		if err := worker.ValidateFilterColumns(job.Filters, columns); err != nil {
+			reason := model.InvalidField(fmt.Sprintf("filters: %s", err.Error())).Error()
+			return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: reason, Value: job})
+		}
+	}
 	if job.Filters["region"] != nil || job.Filters["NOTregion"] != nil || job.Filters["locale"] != nil || job.Filters["NOTlocale"] != nil {
-		var users []worker.User
+		var users []model.UserToken
 		query := fmt.Sprintf("SELECT locale, region FROM %s WHERE locale is not NULL AND region is not NULL LIMIT 1;", worker.GetPushDBTableName(job.App.Name, job.Service))
 		a.PushDB.Query(&users, query)
 		if len(users) != 1 {
@@ -238,9 +270,9 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 
 		if job.Filters["locale"] != nil {
 			if localeSettings["isUpperCase"] && !localeSettings["isLowerCase"] {
-				job.Filters["locale"] = strings.ToUpper(job.Filters["locale"].(string))
+				job.Filters["locale"] = model.MapFilterValue(job.Filters["locale"], strings.ToUpper)
 			} else if localeSettings["isLowerCase"] && !localeSettings["isUpperCase"] {
-				job.Filters["locale"] = strings.ToLower(job.Filters["locale"].(string))
+				job.Filters["locale"] = model.MapFilterValue(job.Filters["locale"], strings.ToLower)
 			} else {
 				return true, c.JSON(http.StatusInternalServerError, &Error{Reason: "Locale case check failed in Push DB"})
 			}
@@ -248,9 +280,9 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 
 		if job.Filters["NOTlocale"] != nil {
 			if localeSettings["isUpperCase"] && !localeSettings["isLowerCase"] {
-				job.Filters["NOTlocale"] = strings.ToUpper(job.Filters["NOTlocale"].(string))
+				job.Filters["NOTlocale"] = model.MapFilterValue(job.Filters["NOTlocale"], strings.ToUpper)
 			} else if localeSettings["isLowerCase"] && !localeSettings["isUpperCase"] {
-				job.Filters["NOTlocale"] = strings.ToLower(job.Filters["NOTlocale"].(string))
+				job.Filters["NOTlocale"] = model.MapFilterValue(job.Filters["NOTlocale"], strings.ToLower)
 			} else {
 				return true, c.JSON(http.StatusInternalServerError, &Error{Reason: "Locale case check failed in Push DB"})
 			}
@@ -258,9 +290,9 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 
 		if job.Filters["region"] != nil {
 			if regionSettings["isUpperCase"] && !regionSettings["isLowerCase"] {
-				job.Filters["region"] = strings.ToUpper(job.Filters["region"].(string))
+				job.Filters["region"] = model.MapFilterValue(job.Filters["region"], strings.ToUpper)
 			} else if regionSettings["isLowerCase"] && !regionSettings["isUpperCase"] {
-				job.Filters["region"] = strings.ToLower(job.Filters["region"].(string))
+				job.Filters["region"] = model.MapFilterValue(job.Filters["region"], strings.ToLower)
 			} else {
 				return true, c.JSON(http.StatusInternalServerError, &Error{Reason: "Region case check failed in Push DB"})
 			}
@@ -268,9 +300,9 @@ func (a *Application) checkFilters(job *model.Job, c echo.Context) (bool, error)
 
 		if job.Filters["NOTregion"] != nil {
 			if regionSettings["isUpperCase"] && !regionSettings["isLowerCase"] {
-				job.Filters["NOTregion"] = strings.ToUpper(job.Filters["NOTregion"].(string))
+				job.Filters["NOTregion"] = model.MapFilterValue(job.Filters["NOTregion"], strings.ToUpper)
 			} else if regionSettings["isLowerCase"] && !regionSettings["isUpperCase"] {
-				job.Filters["NOTregion"] = strings.ToLower(job.Filters["NOTregion"].(string))
+				job.Filters["NOTregion"] = model.MapFilterValue(job.Filters["NOTregion"], strings.ToLower)
 			} else {
 				return true, c.JSON(http.StatusInternalServerError, &Error{Reason: "Region case check failed in Push DB"})
 			}
@@ -286,17 +318,18 @@ func (a *Application) checkTemplateName(templateName string, job *model.Job, c e
 			return a.DB.Model(&template).Column("template.*").Where("template.app_id = ?", job.AppID).Where("template.name = ?", tpl).First()
 		})
 		if err != nil {
-			if err.Error() == RecordNotFoundString {
+			if IsRecordNotFound(err) {
 				return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
 			}
 			return true, c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
 		}
 
 		err = WithSegment("db-select", c, func() error {
-			return a.DB.Model(&template).Column("template.*").Where("template.app_id = ?", job.AppID).Where("template.name = ? AND template.locale='en'", tpl).First()
+			_, err := model.GetTemplate(a.DB, job.AppID, tpl, "en")
+			return err
 		})
 		if err != nil {
-			if err.Error() == RecordNotFoundString {
+			if IsRecordNotFound(err) {
 				localeErr := "Cannot create job if there is no template for locale 'en'."
 				return true, c.JSON(http.StatusUnprocessableEntity, &Error{Reason: localeErr, Value: job})
 			}
@@ -337,10 +370,10 @@ func (a *Application) createJob(job *model.Job, c echo.Context) error {
 
 	if err != nil {
 		l.Error("Failed to create job.", zap.Error(err))
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, job)
 		}
-		if strings.Contains(err.Error(), "violates foreign key constraint") {
+		if IsForeignKeyViolation(err) {
 			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: job})
 		}
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: job})
@@ -380,7 +413,7 @@ func (a *Application) GetJobHandler(c echo.Context) error {
 	})
 	a.DB.Model(&job.StatusEvents).Where("job_id = ?", job.ID).Column("status.*", "Events").Select()
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, job)
 		}
 		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
@@ -423,7 +456,7 @@ func (a *Application) PauseJobHandler(c echo.Context) error {
 		return a.DB.Model(&prevJob).Column("job.*", "App").Where("job.id = ?", job.ID).Select()
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, job)
 		}
 		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
@@ -506,6 +539,15 @@ func (a *Application) StopJobHandler(c echo.Context) error {
 	log.D(l, "Updated job successfully.", func(cm log.CM) {
 		cm.Write(zap.Object("job", job))
 	})
+	// the workers only read the status before each page, so the pages being sent are stopped too
+	err = WithSegment("cancel-job", c, func() error {
+		return a.Worker.CancelJob(jid)
+	})
+	if err != nil {
+		log.E(l, "Failed to signal the workers to stop the job.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
 
 	if a.SendgridClient != nil {
 		log.D(l, "sending email with stopped job info")
@@ -545,7 +587,7 @@ func (a *Application) ResumeJobHandler(c echo.Context) error {
 		return a.DB.Model(&prevJob).Column("job.*", "App").Where("job.id = ?", jid).Select()
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, prevJob)
 		}
 		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
@@ -554,7 +596,21 @@ func (a *Application) ResumeJobHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: prevJob})
 	}
 	if prevJob.Status != "paused" && prevJob.Status != "circuitbreak" {
-		return c.JSON(http.StatusForbidden, &Error{Reason: "cannot resume job with status other than paused/circuitbreak"})
+		// only the direct jobs are sent again when they were interrupted by a worker shutdown
+		interrupted, err := a.Worker.IsJobInterrupted(prevJob)
+		if err != nil {
+			log.E(l, "Failed to retrieve job status.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: prevJob})
+		}
+		if !interrupted || len(prevJob.CSVPath) > 0 {
+			return c.JSON(http.StatusForbidden, &Error{Reason: "cannot resume job with status other than paused/circuitbreak/interrupted"})
+		}
+		// the pages already sent are only skipped if the workers track them
+		if !a.Worker.CanResumeInterruptedJobs() {
+			return c.JSON(http.StatusForbidden, &Error{Reason: "cannot resume interrupted job without workers.direct.resume"})
+		}
 	}
 
 	var wJobID string
@@ -596,3 +652,215 @@ func (a *Application) ResumeJobHandler(c echo.Context) error {
 	})
 	return c.JSON(http.StatusOK, job)
 }
+
+// JobStatus is the progress of a job sent by the status stream
+type JobStatus struct {
+	ID               uuid.UUID `json:"id"`
+	Status           string    `json:"status"`
+	TotalBatches     int       `json:"totalBatches"`
+	CompletedBatches int       `json:"completedBatches"`
+	TotalTokens      int       `json:"totalTokens"`
+	CompletedTokens  int       `json:"completedTokens"`
+	CompletedAt      int64     `json:"completedAt"`
+	PercentComplete  float64   `json:"percentComplete"`
+	TokensPerSecond  float64   `json:"tokensPerSecond"`
+	// ETASeconds is null while it can't be estimated
+	ETASeconds *int64 `json:"etaSeconds"`
+
+	sampledAt time.Time
+}
+
+// Done returns whether the job won't change anymore and the stream can be finished
+func (s *JobStatus) Done() bool {
+	return s.CompletedAt > 0 || s.Status == "stopped"
+}
+
+// SetProgress fills the percentage of the tokens that were sent, the rate at which they were sent
+// since the sample and the estimated time to send the remaining ones, the rate is the average since
+// the job started if there is no earlier sample
+func (s *JobStatus) SetProgress(startedAt int64, now time.Time, sample *JobStatus) {
+	s.PercentComplete, s.TokensPerSecond, s.ETASeconds = 0, 0, nil
+	s.sampledAt = now
+	if s.CompletedAt > 0 {
+		eta := int64(0)
+		s.PercentComplete = 100
+		s.ETASeconds = &eta
+		now = time.Unix(0, s.CompletedAt)
+	} else if s.TotalTokens > 0 {
+		s.PercentComplete = math.Min(100, 100*float64(s.CompletedTokens)/float64(s.TotalTokens))
+	}
+
+	sentTokens := s.CompletedTokens
+	since := time.Unix(0, startedAt)
+	if sample != nil && !sample.sampledAt.IsZero() && sample.sampledAt.Before(now) &&
+		sample.CompletedTokens <= s.CompletedTokens {
+		sentTokens -= sample.CompletedTokens
+		since = sample.sampledAt
+	} else if startedAt <= 0 {
+		return
+	}
+	elapsed := now.Sub(since).Seconds()
+	if elapsed <= 0 || sentTokens <= 0 {
+		return
+	}
+	s.TokensPerSecond = float64(sentTokens) / elapsed
+	if s.ETASeconds == nil && s.TotalTokens > 0 {
+		remaining := math.Max(0, float64(s.TotalTokens-s.CompletedTokens))
+		eta := int64(math.Ceil(remaining / s.TokensPerSecond))
+		s.ETASeconds = &eta
+	}
+}
+
+func (a *Application) getJobStatus(aid, jid uuid.UUID, sample *JobStatus) (*JobStatus, error) {
+	job := &model.Job{}
+	err := a.DB.Model(job).Where("job.id = ? AND job.app_id = ?", jid, aid).Select()
+	if err != nil {
+		return nil, err
+	}
+	status := &JobStatus{
+		ID:               job.ID,
+		Status:           job.Status,
+		TotalBatches:     job.TotalBatches,
+		CompletedBatches: job.CompletedBatches,
+		TotalTokens:      job.TotalTokens,
+		CompletedTokens:  job.CompletedTokens,
+		CompletedAt:      job.CompletedAt,
+	}
+	// jobs are started when they are created unless they are scheduled
+	startedAt := job.CreatedAt
+	if job.StartsAt > startedAt && job.StartsAt < time.Now().UnixNano() {
+		startedAt = job.StartsAt
+	}
+	status.SetProgress(startedAt, time.Now(), sample)
+	// a worker that was interrupted while running the job reports it to redis
+	workerStatus, err := a.Worker.GetJobStatus(jid)
+	if err == nil && workerStatus["status"] != "" && status.Status == "" && status.CompletedAt == 0 {
+		status.Status = workerStatus["status"]
+	}
+	return status, nil
+}
+
+// StreamJobStatusHandler is the method called when a get to apps/:id/jobs/:jid/status/stream is called,
+// it sends the job status as server-sent events until the job is done or the client disconnects
+func (a *Application) StreamJobStatusHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "jobHandler"),
+		zap.String("operation", "streamJobStatus"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("jobId", c.Param("jid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	status, err := a.getJobStatus(aid, jid, nil)
+	if err != nil {
+		if IsRecordNotFound(err) {
+			return c.JSON(http.StatusNotFound, &Error{Reason: err.Error()})
+		}
+		log.E(l, "Failed to retrieve job status.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+
+	interval := a.Config.GetDuration("api.statusStream.interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+	rateWindow := a.Config.GetDuration("api.statusStream.rateWindow")
+	if rateWindow <= 0 {
+		rateWindow = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// the rate is measured from the oldest status sent within the rate window
+	samples := []*JobStatus{}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	for {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "event: status\ndata: %s\n\n", data); err != nil {
+			log.D(l, "Client disconnected from job status stream.")
+			return nil
+		}
+		res.Flush()
+		if status.Done() {
+			log.D(l, "Job is done, finishing job status stream.")
+			return nil
+		}
+
+		select {
+		case <-c.Request().Context().Done():
+			log.D(l, "Client disconnected from job status stream.")
+			return nil
+		case <-ticker.C:
+		}
+
+		samples = append(samples, status)
+		for len(samples) > 1 && time.Since(samples[1].sampledAt) >= rateWindow {
+			samples = samples[1:]
+		}
+		status, err = a.getJobStatus(aid, jid, samples[0])
+		if err != nil {
+			log.E(l, "Failed to retrieve job status.", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+			fmt.Fprintf(res, "event: error\ndata: %s\n\n", err.Error())
+			res.Flush()
+			return nil
+		}
+	}
+}
+
+// GetJobSamplesHandler is the method called when a get to apps/:id/jobs/:jid/samples is called,
+// it returns the pushes of the job rendered by the workers in dry run mode
+func (a *Application) GetJobSamplesHandler(c echo.Context) error {
+	l := a.Logger.With(
+		zap.String("source", "jobHandler"),
+		zap.String("operation", "getJobSamples"),
+		zap.String("appId", c.Param("aid")),
+		zap.String("jobId", c.Param("jid")),
+	)
+	aid, err := uuid.FromString(c.Param("aid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	jid, err := uuid.FromString(c.Param("jid"))
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
+	}
+	job := &model.Job{}
+	err = WithSegment("db-select", c, func() error {
+		return a.DB.Model(job).Where("job.id = ? AND job.app_id = ?", jid, aid).Select()
+	})
+	if err != nil {
+		if IsRecordNotFound(err) {
+			return c.JSON(http.StatusNotFound, &Error{Reason: err.Error()})
+		}
+		log.E(l, "Failed to retrieve job.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	samples, err := a.Worker.GetDryRunSamples(jid)
+	if err != nil {
+		log.E(l, "Failed to retrieve dry run samples.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"samples": samples})
+}
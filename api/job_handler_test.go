@@ -24,11 +24,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/api"
+	"github.com/topfreegames/marathon/extensions"
 	"github.com/topfreegames/marathon/model"
 	. "github.com/topfreegames/marathon/testing"
 	"github.com/topfreegames/marathon/worker"
@@ -149,9 +153,64 @@ var _ = Describe("Job Handler", func() {
 					Expect(job["appId"]).To(Equal(existingApp.ID.String()))
 				}
 			})
+
+			It("should return 200 and the jobs whose metadata contains the given tags", func() {
+				blackFriday := map[string]interface{}{"campaign": "black-friday", "dryRun": false}
+				taggedJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+					"metadata": blackFriday,
+				})
+				anotherTaggedJob := CreateTestJob(app.DB, existingApp.ID, anotherTemplate.Name, map[string]interface{}{
+					"metadata": blackFriday,
+				})
+				CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+					"metadata": map[string]interface{}{"campaign": "christmas"},
+				})
+				CreateTestJobs(app.DB, existingApp.ID, existingTemplate.Name, 5)
+
+				status, body := Get(app, fmt.Sprintf("%s?metadata=%s", baseRouteWithoutTemplate, url.QueryEscape(`{"campaign":"black-friday"}`)), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var response []map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response).To(HaveLen(2))
+				ids := []interface{}{response[0]["id"], response[1]["id"]}
+				Expect(ids).To(ConsistOf(taggedJob.ID.String(), anotherTaggedJob.ID.String()))
+
+				status, body = Get(app, fmt.Sprintf("%s&metadata=%s", baseRoute, url.QueryEscape(`{"campaign":"black-friday"}`)), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+				err = json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response).To(HaveLen(1))
+				Expect(response[0]["id"]).To(Equal(taggedJob.ID.String()))
+			})
 		})
 
 		Describe("Unsucesfully", func() {
+			It("should return 422 if metadata is not a json object", func() {
+				status, body := Get(app, fmt.Sprintf("%s?metadata=black-friday", baseRouteWithoutTemplate), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid metadata"))
+			})
+
+			It("should return 403 if the direct job was interrupted and the pages sent aren't tracked", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				err := app.Worker.SetJobStatus(existingJob.ID, map[string]string{"status": "interrupted"})
+				Expect(err).NotTo(HaveOccurred())
+
+				status, body := Put(app, fmt.Sprintf("%s/%s/resume", baseRouteWithoutTemplate, existingJob.ID), "", "success@test.com")
+				Expect(status).To(Equal(http.StatusForbidden))
+
+				var response map[string]interface{}
+				err = json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("cannot resume interrupted job without workers.direct.resume"))
+			})
+
 			It("should return 401 if no authenticated user", func() {
 				status, _ := Get(app, baseRoute, "")
 
@@ -867,6 +926,58 @@ var _ = Describe("Job Handler", func() {
 				Expect(response["reason"]).To(Equal("invalid filters or csvPath must exist, not both"))
 			})
 
+			It("should return 422 if the lastActiveDays filter is not a positive integer", func() {
+				payload := GetJobPayload()
+				payload["filters"] = map[string]interface{}{"lastActiveDays": "30 days'; --"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid filters: lastActiveDays must be an integer, got '30 days'; --'"))
+			})
+
+			It("should return 422 if a filter is not an allowed column", func() {
+				payload := GetJobPayload()
+				payload["filters"] = map[string]interface{}{"region\"='US' OR 1=1; --": "US"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("invalid filters: unsupported filter 'region\"='US' OR 1=1; --'"))
+			})
+
+			It("should return 422 if a filter has an unsupported operator", func() {
+				payload := GetJobPayload()
+				payload["filters"] = map[string]interface{}{"region>=": "US"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(ContainSubstring("invalid filters: unsupported filter 'region>='"))
+			})
+
+			It("should return 422 if a filter is on a column the push table doesn't have", func() {
+				payload := GetJobPayload()
+				payload["filters"] = map[string]interface{}{"app_version": "1.0"}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid filters: unsupported filter 'app_version', the push table has no column app_version"))
+			})
+
 			It("should return 422 if controlGroup is < 0", func() {
 				payload := GetJobPayload()
 				payload["controlGroup"] = -0.10
@@ -958,6 +1069,34 @@ var _ = Describe("Job Handler", func() {
 				Expect(response["reason"]).To(ContainSubstring("cannot unmarshal string into Go struct"))
 			})
 
+			It("should return 422 if negative pushExpiry", func() {
+				payload := GetJobPayload()
+				payload["pushExpiry"] = -1
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid pushExpiry"))
+			})
+
+			It("should return 422 if invalid versionTemplates", func() {
+				payload := GetJobPayload()
+				payload["versionTemplates"] = []map[string]interface{}{
+					{"minVersion": "not-a-version", "templateName": "template"},
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(Equal("invalid versionTemplates"))
+			})
+
 			It("should return 422 if invalid startsAt", func() {
 				payload := GetJobPayload()
 				payload["startsAt"] = "not-json"
@@ -1197,6 +1336,20 @@ var _ = Describe("Job Handler", func() {
 				Expect(dbJob.ID).To(Equal(existingJob.ID))
 				Expect(dbJob.Status).To(Equal("stopped"))
 			})
+
+			It("should signal the workers sending the job pages to stop", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				cancelled, err := app.Worker.IsJobCancelled(existingJob.ID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cancelled).To(BeFalse())
+
+				status, _ := Put(app, fmt.Sprintf("%s/%s/stop", baseRouteWithoutTemplate, existingJob.ID), "", "success@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				cancelled, err = app.Worker.IsJobCancelled(existingJob.ID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cancelled).To(BeTrue())
+			})
 		})
 
 		Describe("Unsucesfully", func() {
@@ -1264,9 +1417,35 @@ var _ = Describe("Job Handler", func() {
 				Expect(j1["queue"].(string)).To(Equal("resume_job_worker"))
 				Expect(j1["args"].([]interface{})[0]).To(Equal(job["id"]))
 			})
+
+			It("should start the resume_job_worker if the direct job was interrupted", func() {
+				app.Worker.Config.Set("workers.direct.resume", true)
+				defer app.Worker.Config.Set("workers.direct.resume", false)
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				err := app.Worker.SetJobStatus(existingJob.ID, map[string]string{"status": "interrupted"})
+				Expect(err).NotTo(HaveOccurred())
+
+				status, _ := Put(app, fmt.Sprintf("%s/%s/resume", baseRouteWithoutTemplate, existingJob.ID), "", "success@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				res, err := w.RedisClient.LLen("queue:resume_job_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res).To(BeEquivalentTo(1))
+			})
 		})
 
 		Describe("Unsucesfully", func() {
+			It("should return 403 if the interrupted job has a csv", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name, map[string]interface{}{
+					"csvPath": "s3://somebucket/somefile.csv",
+				})
+				err := app.Worker.SetJobStatus(existingJob.ID, map[string]string{"status": "interrupted"})
+				Expect(err).NotTo(HaveOccurred())
+
+				status, _ := Put(app, fmt.Sprintf("%s/%s/resume", baseRouteWithoutTemplate, existingJob.ID), "", "success@test.com")
+				Expect(status).To(Equal(http.StatusForbidden))
+			})
+
 			It("should return 401 if no authenticated user", func() {
 				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
 				status, _ := Put(app, fmt.Sprintf("%s/%s/resume", baseRouteWithoutTemplate, existingJob.ID), "", "")
@@ -1289,7 +1468,7 @@ var _ = Describe("Job Handler", func() {
 				Expect(status).To(Equal(http.StatusNotFound))
 			})
 
-			It("should return 403 if job status is not paused/circuitbreak", func() {
+			It("should return 403 if job status is not paused/circuitbreak/interrupted", func() {
 				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
 				_, err := app.DB.Model(&model.Job{}).Set("status = 'stopped'").Where("id = ?", existingJob.ID).Update()
 				Expect(err).NotTo(HaveOccurred())
@@ -1299,8 +1478,210 @@ var _ = Describe("Job Handler", func() {
 				var response map[string]interface{}
 				err = json.Unmarshal([]byte(body), &response)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(response["reason"]).To(Equal("cannot resume job with status other than paused/circuitbreak"))
+				Expect(response["reason"]).To(Equal("cannot resume job with status other than paused/circuitbreak/interrupted"))
+			})
+		})
+	})
+
+	Describe("Get /apps/:id/jobs/:jid/status/stream", func() {
+		parseEvents := func(body string) []map[string]interface{} {
+			events := []map[string]interface{}{}
+			for _, event := range strings.Split(strings.TrimSpace(body), "\n\n") {
+				lines := strings.Split(event, "\n")
+				Expect(lines).To(HaveLen(2))
+				Expect(lines[0]).To(Equal("event: status"))
+				var data map[string]interface{}
+				err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &data)
+				Expect(err).NotTo(HaveOccurred())
+				events = append(events, data)
+			}
+			return events
+		}
+
+		Describe("Sucesfully", func() {
+			It("should send a single event and close the stream if the job is completed", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				_, err := app.DB.Model(&model.Job{}).Set("completed_at = 1, total_tokens = 10, completed_tokens = 10").Where("id = ?", existingJob.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+
+				status, body := Get(app, fmt.Sprintf("%s/%s/status/stream", baseRouteWithoutTemplate, existingJob.ID), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				events := parseEvents(body)
+				Expect(events).To(HaveLen(1))
+				Expect(events[0]["id"]).To(Equal(existingJob.ID.String()))
+				Expect(events[0]["totalTokens"]).To(BeEquivalentTo(10))
+				Expect(events[0]["completedTokens"]).To(BeEquivalentTo(10))
+				Expect(events[0]["completedAt"]).To(BeEquivalentTo(1))
+			})
+
+			It("should send the status updates until the job is completed", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				_, err := app.DB.Model(&model.Job{}).Set("total_tokens = 100, completed_tokens = 0").Where("id = ?", existingJob.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(50 * time.Millisecond)
+					_, err := app.DB.Model(&model.Job{}).Set("completed_tokens = 50").Where("id = ?", existingJob.ID).Update()
+					Expect(err).NotTo(HaveOccurred())
+					time.Sleep(50 * time.Millisecond)
+					_, err = app.DB.Model(&model.Job{}).Set("completed_tokens = 100, completed_at = 1").Where("id = ?", existingJob.ID).Update()
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				status, body := Get(app, fmt.Sprintf("%s/%s/status/stream", baseRouteWithoutTemplate, existingJob.ID), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				events := parseEvents(body)
+				Expect(len(events)).To(BeNumerically(">=", 3))
+				Expect(events[0]["completedTokens"]).To(BeEquivalentTo(0))
+				completedTokens := []interface{}{}
+				for _, event := range events {
+					completedTokens = append(completedTokens, event["completedTokens"])
+				}
+				Expect(completedTokens).To(ContainElement(BeEquivalentTo(50)))
+				last := events[len(events)-1]
+				Expect(last["completedTokens"]).To(BeEquivalentTo(100))
+				Expect(last["completedAt"]).To(BeEquivalentTo(1))
+			})
+
+			It("should close the stream if the job is stopped", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				_, err := app.DB.Model(&model.Job{}).Set("status = 'stopped'").Where("id = ?", existingJob.ID).Update()
+				Expect(err).NotTo(HaveOccurred())
+
+				status, body := Get(app, fmt.Sprintf("%s/%s/status/stream", baseRouteWithoutTemplate, existingJob.ID), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				events := parseEvents(body)
+				Expect(events).To(HaveLen(1))
+				Expect(events[0]["status"]).To(Equal("stopped"))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 401 if no authenticated user", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				status, _ := Get(app, fmt.Sprintf("%s/%s/status/stream", baseRouteWithoutTemplate, existingJob.ID), "")
+
+				Expect(status).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should return 404 if the job does not exist", func() {
+				status, _ := Get(app, fmt.Sprintf("%s/%s/status/stream", baseRouteWithoutTemplate, uuid.NewV4().String()), "test@test.com")
+				Expect(status).To(Equal(http.StatusNotFound))
+			})
+
+			It("should return 422 if the job id is invalid", func() {
+				status, _ := Get(app, fmt.Sprintf("%s/not-an-uuid/status/stream", baseRouteWithoutTemplate), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+	})
+
+	Describe("Get /apps/:id/jobs/:jid/samples", func() {
+		Describe("Sucesfully", func() {
+			It("should return 200 and the dry run samples of the job", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				app.Worker.AddDryRunSample(existingJob.ID.String(), &extensions.DryRunSample{
+					Token:   "device-token",
+					UserID:  "user-id",
+					Topic:   "topic",
+					Message: `{"aps":{"alert":"hello"}}`,
+				})
+
+				status, body := Get(app, fmt.Sprintf("%s/%s/samples", baseRouteWithoutTemplate, existingJob.ID), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+
+				var response map[string][]extensions.DryRunSample
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["samples"]).To(HaveLen(1))
+				Expect(response["samples"][0].Token).To(Equal("device-token"))
+				Expect(response["samples"][0].UserID).To(Equal("user-id"))
+			})
+
+			It("should return 200 and no samples if the job didn't run in dry run mode", func() {
+				existingJob := CreateTestJob(app.DB, existingApp.ID, existingTemplate.Name)
+				status, body := Get(app, fmt.Sprintf("%s/%s/samples", baseRouteWithoutTemplate, existingJob.ID), "test@test.com")
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`{"samples":[]}`))
+			})
+		})
+
+		Describe("Unsucesfully", func() {
+			It("should return 404 if the job does not exist", func() {
+				status, _ := Get(app, fmt.Sprintf("%s/%s/samples", baseRouteWithoutTemplate, uuid.NewV4().String()), "test@test.com")
+				Expect(status).To(Equal(http.StatusNotFound))
+			})
+
+			It("should return 422 if the job id is invalid", func() {
+				status, _ := Get(app, fmt.Sprintf("%s/not-an-uuid/samples", baseRouteWithoutTemplate), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
 			})
 		})
 	})
 })
+
+var _ = Describe("Job Status", func() {
+	now := time.Unix(1000, 0)
+	startedAt := time.Unix(900, 0).UnixNano()
+
+	It("should compute the progress, rate and eta", func() {
+		status := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 250}
+		status.SetProgress(startedAt, now, nil)
+
+		Expect(status.PercentComplete).To(BeNumerically("~", 25, 0.001))
+		Expect(status.TokensPerSecond).To(BeNumerically("~", 2.5, 0.001))
+		Expect(status.ETASeconds).NotTo(BeNil())
+		Expect(*status.ETASeconds).To(BeEquivalentTo(300))
+	})
+
+	It("should not estimate the eta before any token is sent", func() {
+		status := &api.JobStatus{TotalTokens: 1000}
+		status.SetProgress(startedAt, now, nil)
+
+		Expect(status.PercentComplete).To(BeZero())
+		Expect(status.TokensPerSecond).To(BeZero())
+		Expect(status.ETASeconds).To(BeNil())
+	})
+
+	It("should not divide by zero if the total tokens are unknown", func() {
+		status := &api.JobStatus{CompletedTokens: 100}
+		status.SetProgress(startedAt, now, nil)
+
+		Expect(status.PercentComplete).To(BeZero())
+		Expect(status.TokensPerSecond).To(BeNumerically("~", 1, 0.001))
+		Expect(status.ETASeconds).To(BeNil())
+	})
+
+	It("should be complete once the job is completed", func() {
+		status := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 990, CompletedAt: time.Unix(1100, 0).UnixNano()}
+		status.SetProgress(startedAt, now, nil)
+
+		Expect(status.PercentComplete).To(BeEquivalentTo(100))
+		Expect(status.TokensPerSecond).To(BeNumerically("~", 4.95, 0.001))
+		Expect(*status.ETASeconds).To(BeZero())
+	})
+
+	It("should compute the rate and eta since the earlier sample", func() {
+		sample := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 100}
+		sample.SetProgress(startedAt, time.Unix(990, 0), nil)
+		status := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 250}
+		status.SetProgress(startedAt, now, sample)
+
+		Expect(status.TokensPerSecond).To(BeNumerically("~", 15, 0.001))
+		Expect(*status.ETASeconds).To(BeEquivalentTo(50))
+	})
+
+	It("should report no rate if nothing was sent since the earlier sample", func() {
+		sample := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 250}
+		sample.SetProgress(startedAt, time.Unix(990, 0), nil)
+		status := &api.JobStatus{TotalTokens: 1000, CompletedTokens: 250}
+		status.SetProgress(startedAt, now, sample)
+
+		Expect(status.TokensPerSecond).To(BeZero())
+		Expect(status.ETASeconds).To(BeNil())
+	})
+})
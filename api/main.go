@@ -79,7 +79,9 @@ func GetApplication(host string, port int, debug bool, l zap.Logger, configPath
 }
 
 func (a *Application) loadConfiguration() error {
-	a.Config.SetConfigFile(a.ConfigPath)
+	if err := extensions.SetConfigFile(a.Config, a.ConfigPath); err != nil {
+		return err
+	}
 	a.Config.SetEnvPrefix("marathon")
 	a.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	a.Config.AutomaticEnv()
@@ -101,6 +103,11 @@ func (a *Application) configure() error {
 		return err
 	}
 
+	err = worker.ValidateConfig(a.Config)
+	if err != nil {
+		return err
+	}
+
 	err = a.configureDatabase()
 	if err != nil {
 		return err
@@ -173,6 +180,8 @@ func (a *Application) configureApplication() {
 	p := prometheus.NewPrometheus("echo", nil)
 	p.SetMetricsPath(prometheusExporter)
 	e.Use(p.HandlerFunc)
+	// the loggers derived from a.Logger share its level, so changing it changes every one of them
+	prometheusExporter.Any("/log/level", echo.WrapHandler(zap.NewHTTPHandler(a.Logger)))
 
 	// Base Routes
 	e.GET("/healthcheck", a.HealthcheckHandler)
@@ -204,6 +213,7 @@ func (a *Application) configureApplication() {
 	appGroup.GET("/:aid", a.GetAppHandler)
 	appGroup.PUT("/:aid", a.PutAppHandler)
 	appGroup.DELETE("/:aid", a.DeleteAppHandler)
+	appGroup.POST("/:aid/audience", a.EstimateAudienceHandler)
 
 	// Templates Routes
 	appGroup.POST("/:aid/templates", a.PostTemplateHandler)
@@ -219,6 +229,8 @@ func (a *Application) configureApplication() {
 	appGroup.PUT("/:aid/jobs/:jid/pause", a.PauseJobHandler)
 	appGroup.PUT("/:aid/jobs/:jid/stop", a.StopJobHandler)
 	appGroup.PUT("/:aid/jobs/:jid/resume", a.ResumeJobHandler)
+	appGroup.GET("/:aid/jobs/:jid/status/stream", a.StreamJobStatusHandler)
+	appGroup.GET("/:aid/jobs/:jid/samples", a.GetJobSamplesHandler)
 
 	userGroup := e.Group("/users")
 	// AuthMiddleware MUST be the first middleware
@@ -26,6 +26,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -54,6 +56,25 @@ var _ = Describe("API Application", func() {
 		})
 	})
 
+	Describe("Log level", func() {
+		It("should change the level of the loggers at runtime", func() {
+			app := api.GetApplication("127.0.0.1", 9999, false, logger, GetConfPath())
+			child := app.Logger.With(zap.String("source", "test"))
+
+			req := httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(`{"level":"debug"}`))
+			rec := httptest.NewRecorder()
+			app.PrometheusExporter.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(child.Level()).To(Equal(zap.DebugLevel))
+
+			req = httptest.NewRequest(http.MethodGet, "/log/level", nil)
+			rec = httptest.NewRecorder()
+			app.PrometheusExporter.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(MatchJSON(`{"level":"debug"}`))
+		})
+	})
+
 	Describe("App authentication", func() {
 		var app *api.Application
 
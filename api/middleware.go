@@ -275,7 +275,7 @@ func (a AppAuthMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 			return a.App.DB.Model(&user).Column("*").Where("email = ?", userEmail).Select()
 		})
 		if err != nil {
-			if err.Error() == RecordNotFoundString {
+			if IsRecordNotFound(err) {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"status": "Unauthorized."})
 			}
 			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
@@ -325,7 +325,7 @@ func (a UserAuthMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 			return a.App.DB.Model(&user).Column("*").Where("email = ?", userEmail).Select()
 		})
 		if err != nil {
-			if err.Error() == RecordNotFoundString {
+			if IsRecordNotFound(err) {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"status": "Unauthorized."})
 			}
 			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
@@ -366,7 +366,7 @@ func (a UploadAuthMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 			return a.App.DB.Model(&user).Column("*").Where("email = ?", userEmail).Select()
 		})
 		if err != nil {
-			if err.Error() == RecordNotFoundString {
+			if IsRecordNotFound(err) {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"status": "Unauthorized."})
 			}
 			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
@@ -24,7 +24,6 @@ package api
 
 import (
 	"net/http"
-	"strings"
 	"time"
 
 	"gopkg.in/pg.v5/types"
@@ -47,9 +46,10 @@ func (a *Application) ListTemplatesHandler(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
 	}
-	templates := []model.Template{}
+	var templates []model.Template
 	err = WithSegment("db-select", c, func() error {
-		return a.DB.Model(&templates).Column("template.*", "App").Where("template.app_id = ?", aid).Select()
+		templates, err = model.ListTemplates(a.DB, aid, c.QueryParam("name"))
+		return err
 	})
 	if err != nil {
 		log.E(l, "Failed to list templates.", func(cm log.CM) {
@@ -94,10 +94,10 @@ func (a *Application) PostTemplateHandler(c echo.Context) error {
 			return a.DB.Insert(&templates)
 		})
 		if err != nil {
-			if strings.Contains(err.Error(), "duplicate key") {
+			if IsUniqueViolation(err) {
 				return c.JSON(http.StatusConflict, &Error{Reason: err.Error()})
 			}
-			if strings.Contains(err.Error(), "violates foreign key constraint") {
+			if IsForeignKeyViolation(err) {
 				return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error()})
 			}
 			log.E(l, "Failed to create template.", func(cm log.CM) {
@@ -105,6 +105,9 @@ func (a *Application) PostTemplateHandler(c echo.Context) error {
 			})
 			return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error()})
 		}
+		for _, t := range templates {
+			a.clearMissingTemplate(l, aid, t.Name)
+		}
 		return c.JSON(http.StatusCreated, templates)
 	}
 	template := &model.Template{
@@ -124,10 +127,10 @@ func (a *Application) PostTemplateHandler(c echo.Context) error {
 		return a.DB.Insert(&template)
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: template})
 		}
-		if strings.Contains(err.Error(), "violates foreign key constraint") {
+		if IsForeignKeyViolation(err) {
 			return c.JSON(http.StatusUnprocessableEntity, &Error{Reason: err.Error(), Value: template})
 		}
 		log.E(l, "Failed to create template.", func(cm log.CM) {
@@ -135,9 +138,19 @@ func (a *Application) PostTemplateHandler(c echo.Context) error {
 		})
 		return c.JSON(http.StatusInternalServerError, &Error{Reason: err.Error(), Value: template})
 	}
+	a.clearMissingTemplate(l, aid, template.Name)
 	return c.JSON(http.StatusCreated, template)
 }
 
+// clearMissingTemplate makes the workers look the template up again if a job missed it before
+func (a *Application) clearMissingTemplate(l zap.Logger, appID uuid.UUID, name string) {
+	if err := a.Worker.ClearMissingTemplate(appID, name); err != nil {
+		log.W(l, "Failed to clear missing template.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
+}
+
 // GetTemplateHandler is the method called when a get to /apps/:aid/templates/:tid is called
 func (a *Application) GetTemplateHandler(c echo.Context) error {
 	l := a.Logger.With(
@@ -159,7 +172,7 @@ func (a *Application) GetTemplateHandler(c echo.Context) error {
 		return a.DB.Model(&template).Column("template.*", "App").Where("template.id = ?", template.ID).Select()
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, template)
 		}
 		log.E(l, "Failed to retrieve template.", func(cm log.CM) {
@@ -211,7 +224,7 @@ func (a *Application) PutTemplateHandler(c echo.Context) error {
 		return err
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: template})
 		}
 		log.E(l, "Failed to update template.", func(cm log.CM) {
@@ -222,6 +235,7 @@ func (a *Application) PutTemplateHandler(c echo.Context) error {
 	if values.RowsAffected() == 0 {
 		return c.JSON(http.StatusNotFound, map[string]string{})
 	}
+	a.clearMissingTemplate(l, aid, template.Name)
 	log.D(l, "Updated template successfully.", func(cm log.CM) {
 		cm.Write(zap.Object("template", template))
 	})
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -71,6 +72,27 @@ var _ = Describe("Template Handler", func() {
 				Expect(response).To(HaveLen(0))
 			})
 
+			It("should return 200 and the locales of the template with the name", func() {
+				name := uuid.NewV4().String()
+				CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"name": name, "locale": "en"})
+				CreateTestTemplate(app.DB, existingApp.ID, map[string]interface{}{"name": name, "locale": "pt"})
+				CreateTestTemplates(app.DB, existingApp.ID, 3)
+				status, body := Get(app, fmt.Sprintf("%s?name=%s", baseRoute, name), "test@test.com")
+
+				Expect(status).To(Equal(http.StatusOK))
+
+				var response []map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response).To(HaveLen(2))
+				locales := []interface{}{}
+				for _, template := range response {
+					Expect(template["name"]).To(Equal(name))
+					locales = append(locales, template["locale"])
+				}
+				Expect(locales).To(ConsistOf("en", "pt"))
+			})
+
 			It("should return 200 and a list of templates", func() {
 				testTemplates := CreateTestTemplates(app.DB, existingApp.ID, 10)
 				status, body := Get(app, baseRoute, "test@test.com")
@@ -194,6 +216,20 @@ var _ = Describe("Template Handler", func() {
 				}
 			})
 
+			It("should clear a cached miss of the template", func() {
+				payload := GetTemplatePayload()
+				key := fmt.Sprintf("%s-missingtemplate-%s", existingApp.ID.String(), payload["name"])
+				app.Worker.RedisClient.Set(key, 1, time.Minute)
+
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "success@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+
+				exists, err := app.Worker.RedisClient.Exists(key).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+
 			It("should return 201 and the created templates when with flag multiple", func() {
 				payload := GetTemplatePayloads(3)
 				pl, _ := json.Marshal(payload)
@@ -365,6 +401,46 @@ var _ = Describe("Template Handler", func() {
 				Expect(response["reason"]).To(Equal("invalid body"))
 			})
 
+			It("should return 422 if body has an invalid text/template", func() {
+				payload := GetTemplatePayload()
+				payload["body"] = map[string]interface{}{
+					"alert": "{{if .premium}}premium",
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(HavePrefix("invalid body.alert: "))
+			})
+
+			It("should return 422 if body has an unclosed tag", func() {
+				payload := GetTemplatePayload()
+				payload["body"] = map[string]interface{}{
+					"alert": "{{user_name just liked your village!",
+				}
+				pl, _ := json.Marshal(payload)
+				status, body := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+
+				var response map[string]interface{}
+				err := json.Unmarshal([]byte(body), &response)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response["reason"]).To(HavePrefix("invalid body: "))
+			})
+
+			It("should create template with a text/template body", func() {
+				payload := GetTemplatePayload()
+				payload["body"] = map[string]interface{}{
+					"alert": "{{if .premium}}{{.user_name | upper}}{{end}}",
+				}
+				pl, _ := json.Marshal(payload)
+				status, _ := Post(app, baseRoute, string(pl), "test@test.com")
+				Expect(status).To(Equal(http.StatusCreated))
+			})
+
 			It("should return 422 if invalid name", func() {
 				payload := GetTemplatePayload()
 				payload["name"] = strings.Repeat("a", 256)
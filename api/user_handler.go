@@ -24,7 +24,6 @@ package api
 
 import (
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -81,7 +80,7 @@ func (a *Application) CreateUserHandler(c echo.Context) error {
 	})
 
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: user})
 		}
 		log.E(l, "Failed to create user.", func(cm log.CM) {
@@ -111,7 +110,7 @@ func (a *Application) GetUserHandler(c echo.Context) error {
 		return a.DB.Select(&user)
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, map[string]string{})
 		}
 		log.E(l, "Failed to retrieve user.", func(cm log.CM) {
@@ -154,7 +153,7 @@ func (a *Application) UpdateUserHandler(c echo.Context) error {
 	// FIXME: Ugly fix to remove duplicate elements returned by update
 	user.AllowedApps = user.AllowedApps[0 : len(user.AllowedApps)/2]
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
+		if IsUniqueViolation(err) {
 			return c.JSON(http.StatusConflict, &Error{Reason: err.Error(), Value: user})
 		}
 		log.E(l, "Failed to update user.", func(cm log.CM) {
@@ -184,7 +183,7 @@ func (a *Application) DeleteUserHandler(c echo.Context) error {
 		return a.DB.Delete(&user)
 	})
 	if err != nil {
-		if err.Error() == RecordNotFoundString {
+		if IsRecordNotFound(err) {
 			return c.JSON(http.StatusNotFound, map[string]string{})
 		}
 		log.E(l, "Failed to delete user.", func(cm log.CM) {
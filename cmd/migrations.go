@@ -23,20 +23,28 @@
 package cmd
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	// pg driver
 	_ "github.com/lib/pq"
 	"github.com/pressly/goose"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/extensions"
+	migration "github.com/topfreegames/marathon/migrations"
 	"github.com/uber-go/zap"
 )
 
 var migrationsPath string
+var migrationType string
 
 func checkErr(err error) {
 	if err != nil {
@@ -51,7 +59,76 @@ var migrationsCmd = &cobra.Command{
 	Long:  "use this command to work with migrations",
 }
 
+// migrationsDir returns the directory goose reads the migrations from, the migrations embedded in
+// the binary are written to a temporary directory unless --migrationsPath is given
+func migrationsDir() (string, func(), error) {
+	if migrationsPath != "" {
+		return migrationsPath, func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "marathon-migrations")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	entries, err := fs.ReadDir(migration.FS, ".")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, entry := range entries {
+		data, err := migration.FS.ReadFile(entry.Name())
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, entry.Name()), data, 0644)
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return dir, cleanup, nil
+}
+
+// migrationLockKey is the key of the postgres advisory lock held while migrating
+const migrationLockKey = 20161203192932
+
+// lockMigrations waits until it holds the migration advisory lock so only one process migrates
+// the database at a time, the lock belongs to a dedicated connection and is released by unlock
+func lockMigrations(db *sql.DB, timeout time.Duration) (func() error, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var locked bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockKey).Scan(&locked)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if locked {
+			return func() error {
+				defer conn.Close()
+				_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+				return err
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("could not acquire the migration lock in %s, another process is migrating the database", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 func executeMigrationCmd(cmd string) {
+	executeMigration(cmd, func(db *sql.DB, dir string) error {
+		return goose.Run(cmd, db, dir)
+	})
+}
+
+func executeMigration(cmd string, migrate func(db *sql.DB, dir string) error) {
 	ll := zap.InfoLevel
 	if debug {
 		ll = zap.DebugLevel
@@ -62,7 +139,10 @@ func executeMigrationCmd(cmd string) {
 		ll,
 	)
 
-	viper.SetConfigFile(cfgFile)
+	if err := extensions.SetConfigFile(viper.GetViper(), cfgFile); err != nil {
+		l.Panic("error loading config file", zap.Error(err))
+	}
+	viper.SetDefault("db.migrationLockTimeout", "5m")
 	viper.SetEnvPrefix("marathon")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
@@ -78,7 +158,13 @@ func executeMigrationCmd(cmd string) {
 
 	dbURL := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", user, pass, host, port, database)
 
-	logger := l.With(zap.String("dbUrl", dbURL))
+	logger := l.With(zap.String("dbUrl", dbURL), zap.String("command", cmd))
+
+	dir, cleanup, err := migrationsDir()
+	if err != nil {
+		logger.Panic("error loading migrations", zap.Error(err))
+	}
+	defer cleanup()
 
 	if err := goose.SetDialect("postgres"); err != nil {
 		logger.Panic("error migrating database", zap.Error(err))
@@ -92,7 +178,18 @@ func executeMigrationCmd(cmd string) {
 	if err != nil {
 		panic("Could not create migration files...")
 	}
-	if err := goose.Run(cmd, db, migrationsPath); err != nil {
+	logger.Info("waiting for the migration lock...")
+	unlock, err := lockMigrations(db, viper.GetDuration("db.migrationLockTimeout"))
+	if err != nil {
+		cleanup()
+		logger.Fatal("error migrating database", zap.Error(err))
+	}
+	err = migrate(db, dir)
+	if unlockErr := unlock(); unlockErr != nil {
+		logger.Error("error releasing the migration lock", zap.Error(unlockErr))
+	}
+	if err != nil {
+		cleanup()
 		logger.Fatal("error migrating database", zap.Error(err))
 	}
 
@@ -125,26 +222,136 @@ var redoCmd = &cobra.Command{
 	},
 }
 
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "use this command to list the applied and pending migrations",
+	Long:  "use this command to list the applied and pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		executeMigrationCmd("status")
+	},
+}
+
+// parseTargetVersion returns the version argument of up-to and down-to
+func parseTargetVersion(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("a single target version is required")
+	}
+	version, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("version should be a positive integer, got '%s'", args[0])
+	}
+	return version, nil
+}
+
+// checkMigrationVersion returns an error if none of the migrations in dir has the given version
+func checkMigrationVersion(dir string, version int64) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if v, err := goose.NumericComponent(file); err == nil && v == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("there is no migration with version %d", version)
+}
+
+func targetVersionRun(cmd string, migrate func(db *sql.DB, dir string, version int64) error) func(*cobra.Command, []string) {
+	return func(c *cobra.Command, args []string) {
+		version, err := parseTargetVersion(args)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.Usage()
+			os.Exit(1)
+		}
+		executeMigration(cmd, func(db *sql.DB, dir string) error {
+			if err := checkMigrationVersion(dir, version); err != nil {
+				return err
+			}
+			return migrate(db, dir, version)
+		})
+	}
+}
+
+// migrateUpTo applies the migrations one by one until the database is at the given version
+func migrateUpTo(db *sql.DB, dir string, version int64) error {
+	for {
+		current, err := goose.GetDBVersion(db)
+		if err != nil {
+			return err
+		}
+		if current >= version {
+			return nil
+		}
+		if err := goose.UpByOne(db, dir); err != nil {
+			return err
+		}
+	}
+}
+
+// migrateDownTo rolls back the migrations one by one until the database is at the given version
+func migrateDownTo(db *sql.DB, dir string, version int64) error {
+	for {
+		current, err := goose.GetDBVersion(db)
+		if err != nil {
+			return err
+		}
+		if current <= version {
+			return nil
+		}
+		if err := goose.Down(db, dir); err != nil {
+			return err
+		}
+	}
+}
+
+var upToCmd = &cobra.Command{
+	Use:   "up-to <version>",
+	Short: "use this command to run the migrations up to the given version",
+	Long:  "use this command to run the migrations up to the given version",
+	Run:   targetVersionRun("up-to", migrateUpTo),
+}
+
+var downToCmd = &cobra.Command{
+	Use:   "down-to <version>",
+	Short: "use this command to rollback the migrations down to the given version",
+	Long:  "use this command to rollback the migrations down to the given version",
+	Run:   targetVersionRun("down-to", migrateDownTo),
+}
+
 var createCmd = &cobra.Command{
 	Use:   "create <name>",
-	Short: "use this command to create a migration",
-	Long:  "use this command to create a migration",
+	Short: "use this command to create a timestamped sql or go migration",
+	Long:  "use this command to create a timestamped sql or go migration",
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 1 {
 			cmd.Usage()
 			os.Exit(1)
 		}
-		if err := goose.Create(nil, migrationsPath, args[0], "sql"); err != nil {
+		if migrationType != "sql" && migrationType != "go" {
+			fmt.Printf("migration type should be in ['sql', 'go'], got '%s'\n", migrationType)
+			os.Exit(1)
+		}
+		dir := migrationsPath
+		if dir == "" {
+			dir = "migrations"
+		}
+		if err := goose.Create(nil, dir, args[0], migrationType); err != nil {
 			panic(err)
 		}
 	},
 }
 
 func init() {
-	migrationsCmd.PersistentFlags().StringVarP(&migrationsPath, "migrationsPath", "m", "migrations", "the path containing the migrations")
+	migrationsCmd.PersistentFlags().StringVarP(&migrationsPath, "migrationsPath", "m", "", "the path containing the migrations, the ones embedded in the binary are used if empty")
+	createCmd.Flags().StringVarP(&migrationType, "type", "t", "sql", "the type of the migration, sql or go")
 	migrationsCmd.AddCommand(createCmd)
 	migrationsCmd.AddCommand(upCmd)
 	migrationsCmd.AddCommand(downCmd)
 	migrationsCmd.AddCommand(redoCmd)
+	migrationsCmd.AddCommand(statusCmd)
+	migrationsCmd.AddCommand(upToCmd)
+	migrationsCmd.AddCommand(downToCmd)
 	RootCmd.AddCommand(migrationsCmd)
 }
@@ -27,6 +27,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/topfreegames/marathon/extensions"
 )
 
 var cfgFile string
@@ -50,5 +51,6 @@ func Execute() {
 
 func init() {
 	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "./config/default.yaml", "the config file path")
+	RootCmd.PersistentFlags().StringVar(&extensions.ConfigType, "config-type", "", "the config file format (yaml, json or toml), detected from the file extension if empty")
 	RootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "debug mode")
 }
@@ -23,6 +23,10 @@
 package cmd
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/spf13/cobra"
 	"github.com/topfreegames/marathon/worker"
 	"github.com/uber-go/zap"
@@ -49,6 +53,11 @@ var workerCmd = &cobra.Command{
 		logger.Debug("configuring workers...")
 		w := worker.NewWorker(logger, cfgFile)
 
+		// the manager stops on these signals itself, this only bounds how long the drain can take
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go w.ExitAfterGracePeriod(signals, os.Exit)
+
 		logger.Debug("starting worker...")
 		w.Start()
 	},
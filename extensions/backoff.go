@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is an exponential backoff policy shared by the connect and retry paths
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+	// Jitter is the fraction of each delay that is randomized, between 0 and 1
+	Jitter float64
+	// Attempts is the maximum number of attempts made by Retry, values below 1 mean a single attempt
+	Attempts int
+}
+
+// NewBackoff returns a backoff policy
+func NewBackoff(base, max time.Duration, jitter float64, attempts int) *Backoff {
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return &Backoff{
+		Base:     base,
+		Max:      max,
+		Jitter:   jitter,
+		Attempts: attempts,
+	}
+}
+
+// Duration returns how long to wait before the given retry, starting at 0. The delay doubles for each
+// retry up to Max and jitter shortens it randomly so clients that failed together don't retry together
+func (b *Backoff) Duration(retry int) time.Duration {
+	backoff := ExponentialBackoff(b.Base, b.Max, retry)
+	if b.Jitter > 0 {
+		backoff -= time.Duration(rand.Float64() * b.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// Retry calls f until it succeeds or the attempts are exhausted, waiting between attempts,
+// and returns the last error
+func (b *Backoff) Retry(f func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt+1 >= b.Attempts {
+			return err
+		}
+		time.Sleep(b.Duration(attempt))
+	}
+}
+
+// ExponentialBackoff returns base doubled for each retry, capped at max
+func ExponentialBackoff(base, max time.Duration, retries int) time.Duration {
+	backoff := base
+	for i := 0; i < retries && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/extensions"
+)
+
+var _ = Describe("Backoff", func() {
+	Describe("Exponential backoff", func() {
+		It("should double the backoff for each retry", func() {
+			Expect(extensions.ExponentialBackoff(100*time.Millisecond, 5*time.Second, 0)).To(Equal(100 * time.Millisecond))
+			Expect(extensions.ExponentialBackoff(100*time.Millisecond, 5*time.Second, 1)).To(Equal(200 * time.Millisecond))
+			Expect(extensions.ExponentialBackoff(100*time.Millisecond, 5*time.Second, 3)).To(Equal(800 * time.Millisecond))
+		})
+
+		It("should cap the backoff", func() {
+			Expect(extensions.ExponentialBackoff(100*time.Millisecond, 5*time.Second, 10)).To(Equal(5 * time.Second))
+		})
+	})
+
+	Describe("Duration", func() {
+		It("should follow the exponential sequence without jitter", func() {
+			backoff := extensions.NewBackoff(10*time.Millisecond, 100*time.Millisecond, 0, 0)
+			durations := []time.Duration{}
+			for retry := 0; retry < 6; retry++ {
+				durations = append(durations, backoff.Duration(retry))
+			}
+			Expect(durations).To(Equal([]time.Duration{
+				10 * time.Millisecond,
+				20 * time.Millisecond,
+				40 * time.Millisecond,
+				80 * time.Millisecond,
+				100 * time.Millisecond,
+				100 * time.Millisecond,
+			}))
+		})
+
+		It("should keep the jittered delay within bounds", func() {
+			backoff := extensions.NewBackoff(100*time.Millisecond, time.Second, 0.5, 0)
+			for i := 0; i < 100; i++ {
+				Expect(backoff.Duration(0)).To(BeNumerically(">=", 50*time.Millisecond))
+				Expect(backoff.Duration(0)).To(BeNumerically("<=", 100*time.Millisecond))
+				Expect(backoff.Duration(10)).To(BeNumerically(">=", 500*time.Millisecond))
+				Expect(backoff.Duration(10)).To(BeNumerically("<=", time.Second))
+			}
+		})
+
+		It("should clamp the jitter", func() {
+			Expect(extensions.NewBackoff(time.Millisecond, time.Second, -1, 0).Jitter).To(Equal(0.0))
+			Expect(extensions.NewBackoff(time.Millisecond, time.Second, 2, 0).Jitter).To(Equal(1.0))
+		})
+	})
+
+	Describe("Retry", func() {
+		It("should stop retrying once it succeeds", func() {
+			calls := 0
+			backoff := extensions.NewBackoff(time.Millisecond, time.Millisecond, 0, 5)
+			err := backoff.Retry(func() error {
+				calls++
+				if calls < 3 {
+					return fmt.Errorf("failed")
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls).To(Equal(3))
+		})
+
+		It("should return the last error once the attempts are exhausted", func() {
+			calls := 0
+			backoff := extensions.NewBackoff(time.Millisecond, time.Millisecond, 0, 3)
+			err := backoff.Retry(func() error {
+				calls++
+				return fmt.Errorf("failed %d", calls)
+			})
+			Expect(err).To(MatchError("failed 3"))
+			Expect(calls).To(Equal(3))
+		})
+
+		It("should make a single attempt if attempts is not set", func() {
+			calls := 0
+			backoff := extensions.NewBackoff(time.Millisecond, time.Millisecond, 0, 0)
+			err := backoff.Retry(func() error {
+				calls++
+				return fmt.Errorf("failed")
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(calls).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ConfigType is the format of the config files, set by the --config-type flag. If it is empty the
+// format is detected from the extension of each file
+var ConfigType string
+
+// SupportedConfigTypes are the formats of the config files that can be loaded
+var SupportedConfigTypes = []string{"yaml", "yml", "json", "toml"}
+
+// UnsupportedConfigTypeError is returned when the format of a config file can't be loaded
+type UnsupportedConfigTypeError struct {
+	Path       string
+	ConfigType string
+}
+
+func (e *UnsupportedConfigTypeError) Error() string {
+	return fmt.Sprintf(
+		"unsupported config type %q of %s, it must be one of %s",
+		e.ConfigType, e.Path, strings.Join(SupportedConfigTypes, ", "),
+	)
+}
+
+// GetConfigType returns the format of the config file at path, ConfigType if it is set or else
+// the extension of the file
+func GetConfigType(path string) (string, error) {
+	configType := ConfigType
+	if configType == "" {
+		configType = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	configType = strings.ToLower(configType)
+	for _, supported := range SupportedConfigTypes {
+		if configType == supported {
+			return configType, nil
+		}
+	}
+	return "", &UnsupportedConfigTypeError{Path: path, ConfigType: configType}
+}
+
+// SetConfigFile points the config to the file at path, reading it with its format
+func SetConfigFile(config *viper.Viper, path string) error {
+	configType, err := GetConfigType(path)
+	if err != nil {
+		return err
+	}
+	config.SetConfigFile(path)
+	config.SetConfigType(configType)
+	return nil
+}
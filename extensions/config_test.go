@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/extensions"
+)
+
+var _ = Describe("Config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "marathon-config")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		extensions.ConfigType = ""
+		os.RemoveAll(dir)
+	})
+
+	Describe("Get config type", func() {
+		It("should detect the type from the extension", func() {
+			for path, configType := range map[string]string{
+				"default.yaml": "yaml",
+				"default.yml":  "yml",
+				"default.json": "json",
+				"default.TOML": "toml",
+			} {
+				detected, err := extensions.GetConfigType(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(detected).To(Equal(configType))
+			}
+		})
+
+		It("should prefer the config type flag to the extension", func() {
+			extensions.ConfigType = "json"
+			detected, err := extensions.GetConfigType("default.conf")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(detected).To(Equal("json"))
+		})
+
+		It("should fail if the type is not supported", func() {
+			_, err := extensions.GetConfigType("default.ini")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(`unsupported config type "ini" of default.ini, it must be one of yaml, yml, json, toml`))
+		})
+	})
+
+	Describe("Set config file", func() {
+		It("should read a json config file", func() {
+			path := filepath.Join(dir, "config.json")
+			Expect(ioutil.WriteFile(path, []byte(`{"workers": {"statsPort": 8082}}`), 0644)).To(Succeed())
+
+			config := viper.New()
+			Expect(extensions.SetConfigFile(config, path)).To(Succeed())
+			Expect(config.ReadInConfig()).To(Succeed())
+			Expect(config.GetInt("workers.statsPort")).To(Equal(8082))
+		})
+
+		It("should read a toml config file", func() {
+			path := filepath.Join(dir, "config.toml")
+			Expect(ioutil.WriteFile(path, []byte("[workers]\nstatsPort = 8083\n"), 0644)).To(Succeed())
+
+			config := viper.New()
+			Expect(extensions.SetConfigFile(config, path)).To(Succeed())
+			Expect(config.ReadInConfig()).To(Succeed())
+			Expect(config.GetInt("workers.statsPort")).To(Equal(8083))
+		})
+
+		It("should read a file without a known extension with the config type flag", func() {
+			path := filepath.Join(dir, "config")
+			Expect(ioutil.WriteFile(path, []byte("workers:\n  statsPort: 8084\n"), 0644)).To(Succeed())
+			extensions.ConfigType = "yaml"
+
+			config := viper.New()
+			Expect(extensions.SetConfigFile(config, path)).To(Succeed())
+			Expect(config.ReadInConfig()).To(Succeed())
+			Expect(config.GetInt("workers.statsPort")).To(Equal(8084))
+		})
+	})
+})
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DedupCache is a bounded in memory cache of the keys seen within a time window
+type DedupCache struct {
+	Window  time.Duration
+	MaxKeys int
+
+	lock  sync.Mutex
+	keys  map[string]*list.Element
+	order *list.List
+}
+
+type dedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// NewDedupCache creates a new DedupCache, when it has maxKeys keys the oldest one is evicted
+func NewDedupCache(window time.Duration, maxKeys int) *DedupCache {
+	return &DedupCache{
+		Window:  window,
+		MaxKeys: maxKeys,
+		keys:    map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Seen returns true if key was seen within the window before now, otherwise it records the key as seen at now
+func (d *DedupCache) Seen(key string, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.expire(now)
+	if _, ok := d.keys[key]; ok {
+		return true
+	}
+
+	d.keys[key] = d.order.PushBack(&dedupEntry{key: key, seenAt: now})
+	if d.MaxKeys > 0 && d.order.Len() > d.MaxKeys {
+		d.remove(d.order.Front())
+	}
+	return false
+}
+
+// Len returns the number of keys in the cache
+func (d *DedupCache) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.order.Len()
+}
+
+func (d *DedupCache) expire(now time.Time) {
+	// keys are kept in the order they were seen, so the expired ones are at the front
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		if now.Sub(el.Value.(*dedupEntry).seenAt) < d.Window {
+			return
+		}
+		d.remove(el)
+	}
+}
+
+func (d *DedupCache) remove(el *list.Element) {
+	delete(d.keys, el.Value.(*dedupEntry).key)
+	d.order.Remove(el)
+}
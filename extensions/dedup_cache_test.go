@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/extensions"
+)
+
+var _ = Describe("Dedup Cache", func() {
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Now()
+	})
+
+	Describe("Seen", func() {
+		It("should suppress duplicated keys within the window", func() {
+			cache := extensions.NewDedupCache(time.Minute, 10)
+			Expect(cache.Seen("key", now)).To(BeFalse())
+			Expect(cache.Seen("key", now.Add(30*time.Second))).To(BeTrue())
+			Expect(cache.Seen("other-key", now.Add(30*time.Second))).To(BeFalse())
+		})
+
+		It("should allow duplicated keys after the window", func() {
+			cache := extensions.NewDedupCache(time.Minute, 10)
+			Expect(cache.Seen("key", now)).To(BeFalse())
+			Expect(cache.Seen("key", now.Add(time.Minute))).To(BeFalse())
+			Expect(cache.Len()).To(Equal(1))
+		})
+
+		It("should evict the oldest key when it is full", func() {
+			cache := extensions.NewDedupCache(time.Minute, 2)
+			Expect(cache.Seen("key-1", now)).To(BeFalse())
+			Expect(cache.Seen("key-2", now)).To(BeFalse())
+			Expect(cache.Seen("key-3", now)).To(BeFalse())
+			Expect(cache.Len()).To(Equal(2))
+			Expect(cache.Seen("key-1", now)).To(BeFalse())
+			Expect(cache.Seen("key-3", now)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"sync"
+
+	"github.com/topfreegames/marathon/messages"
+	"github.com/uber-go/zap"
+)
+
+// DryRunSample is a push rendered in dry run mode, with the user it was rendered for
+type DryRunSample struct {
+	Token   string `json:"token"`
+	UserID  string `json:"userId"`
+	Topic   string `json:"topic"`
+	Message string `json:"message"`
+}
+
+// DiscardProducer is a push producer that renders the pushes but never sends them, so a job can be
+// previewed without pushing anything. The first SampleSize pushes of each job are logged and
+// passed to OnSample if it is set
+type DiscardProducer struct {
+	Logger     zap.Logger
+	SampleSize int
+	OnSample   func(jobID string, sample *DryRunSample)
+
+	lock      sync.Mutex
+	discarded int64
+	sampled   map[string]int
+}
+
+// maxSampledJobs bounds how many jobs the sample counts are kept for. When it is reached the counts
+// are reset, a job may log more than SampleSize pushes then but the workers only keep SampleSize of
+// them in redis
+const maxSampledJobs = 1000
+
+// NewDiscardProducer creates a new DiscardProducer
+func NewDiscardProducer(logger zap.Logger, sampleSize int) *DiscardProducer {
+	return &DiscardProducer{
+		Logger:     logger.With(zap.String("source", "DiscardProducer")),
+		SampleSize: sampleSize,
+		sampled:    map[string]int{},
+	}
+}
+
+// SendAPNSPush renders the APNS push and discards it
+func (d *DiscardProducer) SendAPNSPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	message, err := messages.NewAPNSMessage(
+		deviceToken,
+		pushExpiry,
+		payload,
+		messageMetadata,
+		pushMetadata,
+		templateName,
+	).ToJSON()
+	if err != nil {
+		return err
+	}
+	d.discard(topic, deviceToken, message, pushMetadata)
+	return nil
+}
+
+// SendGCMPush renders the GCM push and discards it
+func (d *DiscardProducer) SendGCMPush(topic, deviceToken string, payload, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, pushExpiry int64, templateName string) error {
+	message, err := messages.NewGCMMessage(
+		deviceToken,
+		payload,
+		messageMetadata,
+		pushMetadata,
+		pushExpiry,
+		templateName,
+	).ToJSON()
+	if err != nil {
+		return err
+	}
+	d.discard(topic, deviceToken, message, pushMetadata)
+	return nil
+}
+
+// Discarded returns how many pushes were discarded
+func (d *DiscardProducer) Discarded() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.discarded
+}
+
+// SampledJobs returns how many jobs the sample counts are kept for
+func (d *DiscardProducer) SampledJobs() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.sampled)
+}
+
+func (d *DiscardProducer) discard(topic, deviceToken, message string, pushMetadata map[string]interface{}) {
+	jobID, _ := pushMetadata["jobId"].(string)
+	d.lock.Lock()
+	d.discarded++
+	if _, ok := d.sampled[jobID]; !ok && len(d.sampled) >= maxSampledJobs {
+		d.sampled = map[string]int{}
+	}
+	sample := d.sampled[jobID] < d.SampleSize
+	if sample {
+		d.sampled[jobID]++
+	}
+	d.lock.Unlock()
+
+	if !sample {
+		return
+	}
+	d.Logger.Info(
+		"dry run push",
+		zap.String("jobId", jobID),
+		zap.String("topic", topic),
+		zap.String("message", message),
+	)
+	if d.OnSample != nil {
+		userID, _ := pushMetadata["userId"].(string)
+		d.OnSample(jobID, &DryRunSample{
+			Token:   deviceToken,
+			UserID:  userID,
+			Topic:   topic,
+			Message: message,
+		})
+	}
+}
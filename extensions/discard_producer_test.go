@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/extensions"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Discard Producer", func() {
+	var buf *bytes.Buffer
+	var producer *extensions.DiscardProducer
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		logger := zap.New(
+			zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+			zap.InfoLevel,
+			zap.Output(zap.AddSync(buf)),
+		)
+		producer = extensions.NewDiscardProducer(logger, 2)
+	})
+
+	It("should discard the pushes", func() {
+		pushMetadata := map[string]interface{}{"jobId": "job-id"}
+		Expect(producer.SendAPNSPush("topic", "token", map[string]interface{}{"x": 1}, nil, pushMetadata, 0, "template")).To(Succeed())
+		Expect(producer.SendGCMPush("topic", "token", map[string]interface{}{"x": 1}, nil, pushMetadata, 0, "template")).To(Succeed())
+		Expect(producer.Discarded()).To(BeEquivalentTo(2))
+	})
+
+	It("should log a sample of the rendered pushes of each job", func() {
+		for i := 0; i < 5; i++ {
+			producer.SendGCMPush("topic", "token", map[string]interface{}{"x": 1}, nil, map[string]interface{}{"jobId": "job-1"}, 0, "template")
+			producer.SendGCMPush("topic", "token", map[string]interface{}{"x": 1}, nil, map[string]interface{}{"jobId": "job-2"}, 0, "template")
+		}
+
+		Expect(producer.Discarded()).To(BeEquivalentTo(10))
+		Expect(strings.Count(buf.String(), "dry run push")).To(Equal(4))
+		Expect(strings.Count(buf.String(), `"jobId":"job-1"`)).To(Equal(2))
+		Expect(buf.String()).To(ContainSubstring(`\"x\":1`))
+	})
+
+	It("should keep the sample counts of a bounded number of jobs", func() {
+		for i := 0; i < 1500; i++ {
+			jobID := fmt.Sprintf("job-%d", i)
+			producer.SendGCMPush("topic", "token", map[string]interface{}{"x": 1}, nil, map[string]interface{}{"jobId": jobID}, 0, "template")
+		}
+
+		Expect(producer.SampledJobs()).To(BeNumerically("<=", 1000))
+		Expect(strings.Count(buf.String(), "dry run push")).To(Equal(1500))
+	})
+
+	It("should pass the sampled pushes to OnSample", func() {
+		samples := []*extensions.DryRunSample{}
+		producer.OnSample = func(jobID string, sample *extensions.DryRunSample) {
+			Expect(jobID).To(Equal("job-id"))
+			samples = append(samples, sample)
+		}
+		pushMetadata := map[string]interface{}{"jobId": "job-id", "userId": "user-id"}
+		for i := 0; i < 3; i++ {
+			producer.SendAPNSPush("topic", "token", map[string]interface{}{"x": 1}, nil, pushMetadata, 0, "template")
+		}
+
+		Expect(samples).To(HaveLen(2))
+		Expect(samples[0].Token).To(Equal("token"))
+		Expect(samples[0].UserID).To(Equal("user-id"))
+		Expect(samples[0].Topic).To(Equal("topic"))
+		Expect(samples[0].Message).To(ContainSubstring(`"x":1`))
+	})
+})
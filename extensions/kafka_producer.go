@@ -23,7 +23,17 @@
 package extensions
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -32,6 +42,7 @@ import (
 	"github.com/topfreegames/marathon/log"
 	"github.com/topfreegames/marathon/messages"
 	"github.com/uber-go/zap"
+	"golang.org/x/time/rate"
 )
 
 // KafkaProducer is the struct that connects to Kafka
@@ -46,24 +57,86 @@ type KafkaProducer struct {
 	Statsd           *statsd.Client
 	MaxMessageBytes  int
 	Retries          int
+	RetryBackoff     time.Duration
+	MaxRetryBackoff  time.Duration
+	Compression      string
+	RequiredAcks     string
+	KeyField         string
+	Headers          bool
+	SASLMechanism    string
+	DeadLetterTopic  string
+	MaxRate          float64 // messages per second, 0 is unlimited
+	ChannelBuffer    int
+	Dedup            *DedupCache
+	limiter          *rate.Limiter
+	serviceLimiters  map[string]*rate.Limiter
+	errChan          chan<- *messages.KafkaMessage
+	tlsConfig        *tls.Config
+	returns          sync.WaitGroup
+	inputLock        sync.RWMutex
+	closed           bool
+	ctx              context.Context
+	cancel           context.CancelFunc
 }
 
+// MessageTooLargeError is returned when a push is larger than the max message bytes of the producer,
+// it is rejected before being sent as the broker would refuse it
+type MessageTooLargeError struct {
+	Size        int
+	MaxBytes    int
+	DeviceToken string
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes to %s exceeds the max of %d bytes", e.Size, e.DeviceToken, e.MaxBytes)
+}
+
+// deadLetter is the metadata of the messages sent to the dead letter topic, so their own
+// failures aren't sent to it again
+type deadLetter struct{}
+
 // NewKafkaProducer creates a new kafka producer
 func NewKafkaProducer(config *viper.Viper, logger zap.Logger, statsd *statsd.Client) (*KafkaProducer, error) {
+	return NewKafkaProducerWithErrors(config, logger, statsd, nil)
+}
+
+// NewKafkaProducerWithErrors creates a new kafka producer that re-emits the messages it failed
+// to deliver on errChan, a nil errChan disables it. The send never blocks the delivery reports, so
+// errChan should be buffered and drained by the caller, the failures that don't fit are only counted
+// and still go to the dead letter topic
+func NewKafkaProducerWithErrors(config *viper.Viper, logger zap.Logger, statsd *statsd.Client, errChan chan<- *messages.KafkaMessage) (*KafkaProducer, error) {
 	l := logger.With(
 		zap.String("source", "KafkaExtension"),
 	)
 	client := &KafkaProducer{
-		Config: config,
-		Logger: l,
-		Statsd: statsd,
+		Config:  config,
+		Logger:  l,
+		Statsd:  statsd,
+		errChan: errChan,
 	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
 
 	client.loadConfigurationDefaults()
 	client.configure()
 
+	// a broken security setup must not fall back to plaintext
+	err := client.configureSecurity()
+	if err != nil {
+		return nil, err
+	}
+
 	client.connectToKafka()
-	l.Info("configured kafka producer")
+	l.Info(
+		"configured kafka producer",
+		zap.String("compression", client.Compression),
+		zap.String("requiredAcks", client.RequiredAcks),
+		zap.String("keyField", client.KeyField),
+		zap.Bool("headers", client.Headers),
+		zap.Bool("tls", client.tlsConfig != nil),
+		zap.String("saslMechanism", client.SASLMechanism),
+		zap.String("deadLetterTopic", client.DeadLetterTopic),
+		zap.Float64("maxRate", client.MaxRate),
+	)
 	return client, nil
 }
 
@@ -73,6 +146,23 @@ func (c *KafkaProducer) loadConfigurationDefaults() {
 	c.Config.SetDefault("kafka.flushFrequency", 10)
 	c.Config.SetDefault("kafka.maxMessageBytes", 1000000)
 	c.Config.SetDefault("kafka.retries", 10)
+	c.Config.SetDefault("kafka.retryBackoffMs", 100)
+	c.Config.SetDefault("kafka.maxRetryBackoffMs", 5000)
+	c.Config.SetDefault("kafka.compression", "none")
+	c.Config.SetDefault("kafka.requiredAcks", "local")
+	c.Config.SetDefault("kafka.deadLetterTopic", "")
+	c.Config.SetDefault("kafka.maxRate", 0)
+	c.Config.SetDefault("kafka.serviceMaxRate.apns", 0)
+	c.Config.SetDefault("kafka.serviceMaxRate.gcm", 0)
+	c.Config.SetDefault("kafka.channelBufferSize", 256)
+	c.Config.SetDefault("workers.producer.keyField", "token")
+	c.Config.SetDefault("kafka.headers.enabled", false)
+	c.Config.SetDefault("kafka.dedup.enabled", false)
+	c.Config.SetDefault("kafka.dedup.windowMs", 60000)
+	c.Config.SetDefault("kafka.dedup.maxKeys", 100000)
+	c.Config.SetDefault("kafka.tls.enabled", false)
+	c.Config.SetDefault("kafka.sasl.enabled", false)
+	c.Config.SetDefault("kafka.sasl.mechanism", sarama.SASLTypePlaintext)
 }
 
 func (c *KafkaProducer) configure() {
@@ -81,6 +171,234 @@ func (c *KafkaProducer) configure() {
 	c.FlushFrequency = c.Config.GetInt("kafka.flushFrequency")
 	c.MaxMessageBytes = c.Config.GetInt("kafka.maxMessageBytes")
 	c.Retries = c.Config.GetInt("kafka.retries")
+	c.RetryBackoff = time.Duration(c.Config.GetInt("kafka.retryBackoffMs")) * time.Millisecond
+	c.MaxRetryBackoff = time.Duration(c.Config.GetInt("kafka.maxRetryBackoffMs")) * time.Millisecond
+	c.Compression = c.Config.GetString("kafka.compression")
+	c.RequiredAcks = c.Config.GetString("kafka.requiredAcks")
+	c.DeadLetterTopic = c.Config.GetString("kafka.deadLetterTopic")
+	c.ChannelBuffer = c.Config.GetInt("kafka.channelBufferSize")
+	c.limiter = rate.NewLimiter(rate.Inf, 1)
+	c.SetMaxRate(c.Config.GetFloat64("kafka.maxRate"))
+	c.serviceLimiters = map[string]*rate.Limiter{}
+	for _, service := range kafkaServices {
+		c.serviceLimiters[service] = rate.NewLimiter(rate.Inf, 1)
+		c.SetServiceMaxRate(service, c.Config.GetFloat64(fmt.Sprintf("kafka.serviceMaxRate.%s", service)))
+	}
+	if c.Config.GetBool("kafka.dedup.enabled") {
+		c.Dedup = NewDedupCache(
+			time.Duration(c.Config.GetInt("kafka.dedup.windowMs"))*time.Millisecond,
+			c.Config.GetInt("kafka.dedup.maxKeys"),
+		)
+	}
+	c.KeyField = c.Config.GetString("workers.producer.keyField")
+	if !IsValidKafkaKeyField(c.KeyField) {
+		c.Logger.Error(
+			"invalid kafka key field, falling back to token",
+			zap.String("keyField", c.KeyField),
+		)
+		c.KeyField = "token"
+	}
+	c.Headers = c.Config.GetBool("kafka.headers.enabled")
+}
+
+func (c *KafkaProducer) configureSecurity() error {
+	if c.Config.GetBool("kafka.tls.enabled") {
+		c.tlsConfig = &tls.Config{}
+		caFile := c.Config.GetString("kafka.tls.caFile")
+		if caFile != "" {
+			caCert, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("failed to read kafka tls ca file %s: %s", caFile, err.Error())
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				return fmt.Errorf("kafka tls ca file %s has no valid certificates", caFile)
+			}
+			c.tlsConfig.RootCAs = pool
+		}
+	}
+
+	if c.Config.GetBool("kafka.sasl.enabled") {
+		c.SASLMechanism = c.Config.GetString("kafka.sasl.mechanism")
+		switch c.SASLMechanism {
+		case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		default:
+			return fmt.Errorf("invalid kafka sasl mechanism %s", c.SASLMechanism)
+		}
+	}
+	return nil
+}
+
+func (c *KafkaProducer) setSecurityConfig(config *sarama.Config) {
+	if c.tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = c.tlsConfig
+	}
+	if c.SASLMechanism == "" {
+		return
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(c.SASLMechanism)
+	config.Net.SASL.User = c.Config.GetString("kafka.sasl.user")
+	config.Net.SASL.Password = c.Config.GetString("kafka.sasl.password")
+	switch c.SASLMechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha512.New}
+		}
+	}
+	if c.SASLMechanism != sarama.SASLTypePlaintext && !config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		// scram is only supported by brokers from 1.0.0 on
+		config.Version = sarama.V1_0_0_0
+	}
+}
+
+// SetMaxRate changes the maximum messages per second sent to kafka, it can be called while
+// messages are being sent and a non-positive rate removes the limit
+func (c *KafkaProducer) SetMaxRate(maxRate float64) {
+	if maxRate <= 0 {
+		maxRate = 0
+	}
+	c.MaxRate = maxRate
+	setLimiterRate(c.limiter, maxRate)
+}
+
+// kafkaServices are the services that can have their own max rate
+var kafkaServices = []string{"apns", "gcm"}
+
+// SetServiceMaxRate changes the maximum messages per second of a service sent to kafka, it applies
+// on top of the max rate of the producer and a non-positive rate removes the limit
+func (c *KafkaProducer) SetServiceMaxRate(service string, maxRate float64) {
+	if limiter, ok := c.serviceLimiters[service]; ok {
+		setLimiterRate(limiter, maxRate)
+	}
+}
+
+// ServiceMaxRate returns the maximum messages per second of a service, 0 is unlimited
+func (c *KafkaProducer) ServiceMaxRate(service string) float64 {
+	limiter, ok := c.serviceLimiters[service]
+	if !ok || limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return float64(limiter.Limit())
+}
+
+func setLimiterRate(limiter *rate.Limiter, maxRate float64) {
+	if maxRate <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetBurst(int(math.Max(1, math.Ceil(maxRate))))
+	limiter.SetLimit(rate.Limit(maxRate))
+}
+
+// kafkaKeyFields are the push metadata fields that can be used as the message key besides the token
+var kafkaKeyFields = []string{"userId", "jobId", "templateName"}
+
+// IsValidKafkaKeyField returns whether the field can be used as the kafka message key
+func IsValidKafkaKeyField(field string) bool {
+	if field == "token" {
+		return true
+	}
+	for _, f := range kafkaKeyFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// GetKafkaMessageKey returns the key of the message according to keyField,
+// an empty key makes the message be round-robined among the partitions
+func GetKafkaMessageKey(keyField, deviceToken string, pushMetadata map[string]interface{}) string {
+	if keyField == "token" {
+		return deviceToken
+	}
+	if val, ok := pushMetadata[keyField].(string); ok {
+		return val
+	}
+	return ""
+}
+
+// GetDedupKey returns the key under which a push is deduplicated, a push is a duplicate if the same
+// job already sent to the same device token, no matter which key partitions the messages
+func GetDedupKey(deviceToken string, pushMetadata map[string]interface{}) string {
+	if deviceToken == "" {
+		return ""
+	}
+	jobID, _ := pushMetadata["jobId"].(string)
+	return fmt.Sprintf("%s:%s", jobID, deviceToken)
+}
+
+// GetKafkaMessageHeaders returns the headers of a push message, which identify the job, app and
+// service of the push, the id of the push to trace it downstream and its collapse key if it has one
+func GetKafkaMessageHeaders(service string, pushMetadata map[string]interface{}) map[string]string {
+	headers := map[string]string{"service": service}
+	fields := map[string]string{"jobId": "jobID", "appName": "app", "muid": "traceID", "collapseKey": "collapseKey"}
+	for field, header := range fields {
+		if val, ok := pushMetadata[field].(string); ok && val != "" {
+			headers[header] = val
+		}
+	}
+	return headers
+}
+
+func toRecordHeaders(headers map[string]string) []sarama.RecordHeader {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	recordHeaders := make([]sarama.RecordHeader, len(keys))
+	for i, key := range keys {
+		recordHeaders[i] = sarama.RecordHeader{Key: []byte(key), Value: []byte(headers[key])}
+	}
+	return recordHeaders
+}
+
+var compressionCodecs = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+var requiredAcks = map[string]sarama.RequiredAcks{
+	"none":  sarama.NoResponse,
+	"local": sarama.WaitForLocal,
+	"all":   sarama.WaitForAll,
+}
+
+func (c *KafkaProducer) getRequiredAcks() sarama.RequiredAcks {
+	acks, ok := requiredAcks[c.RequiredAcks]
+	if !ok {
+		c.Logger.Error(
+			"invalid kafka required acks, falling back to local",
+			zap.String("requiredAcks", c.RequiredAcks),
+		)
+		c.RequiredAcks = "local"
+		return sarama.WaitForLocal
+	}
+	return acks
+}
+
+func (c *KafkaProducer) getCompressionCodec() sarama.CompressionCodec {
+	codec, ok := compressionCodecs[c.Compression]
+	if !ok {
+		c.Logger.Error(
+			"invalid kafka compression, falling back to none",
+			zap.String("compression", c.Compression),
+		)
+		c.Compression = "none"
+		return sarama.CompressionNone
+	}
+	return codec
 }
 
 //ConnectToKafka connects with the Kafka from the broker
@@ -89,12 +407,31 @@ func (c *KafkaProducer) connectToKafka() error {
 	config.Producer.Flush.Messages = c.FlushMaxMessages
 	config.Producer.Flush.MaxMessages = c.FlushMaxMessages
 	config.Producer.Flush.Frequency = time.Duration(c.FlushFrequency) * time.Millisecond
+	if c.ChannelBuffer > 0 {
+		config.ChannelBufferSize = c.ChannelBuffer
+	}
 
-	config.Producer.RequiredAcks = sarama.WaitForLocal
+	config.Producer.RequiredAcks = c.getRequiredAcks()
 	config.Producer.Retry.Max = c.Retries
+	// retries are bounded, once they are exhausted the message is reported as an error
+	backoff := NewBackoff(c.RetryBackoff, c.MaxRetryBackoff, 0, c.Retries)
+	config.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
+		return backoff.Duration(retries)
+	}
 	config.Producer.Return.Errors = true
 	config.Producer.Return.Successes = true
 	config.Producer.MaxMessageBytes = c.MaxMessageBytes
+	config.Producer.Compression = c.getCompressionCodec()
+	if config.Producer.Compression == sarama.CompressionZSTD {
+		// zstd is only supported by brokers from 2.1.0 on
+		config.Version = sarama.V2_1_0_0
+	}
+	if c.Headers && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		// headers are only supported by brokers from 0.11.0 on
+		config.Version = sarama.V0_11_0_0
+	}
+
+	c.setSecurityConfig(config)
 
 	hosts := strings.Split(c.BootstrapBrokers, ",")
 	producer, err := sarama.NewAsyncProducer(hosts, config)
@@ -103,24 +440,140 @@ func (c *KafkaProducer) connectToKafka() error {
 	}
 	c.Producer = producer
 
+	c.returns.Add(2)
 	go func() {
-		for range producer.Successes() {
+		defer c.returns.Done()
+		for msg := range producer.Successes() {
 			c.Statsd.Incr("send_message_return", []string{"error:false"}, 1)
+			log.D(c.Logger, "Delivered message", func(cm log.CM) {
+				cm.Write(zap.String("topic", msg.Topic))
+			})
 		}
 	}()
 
 	go func() {
-		for range producer.Errors() {
+		defer c.returns.Done()
+		for err := range producer.Errors() {
 			c.Statsd.Incr("send_message_return", []string{"error:true"}, 1)
+			log.E(c.Logger, "Failed to deliver message", func(cm log.CM) {
+				cm.Write(
+					zap.String("topic", err.Msg.Topic),
+					zap.Error(err.Err),
+				)
+			})
+			if _, ok := err.Msg.Metadata.(deadLetter); ok {
+				c.logUndeliverable(err.Msg, err.Err)
+				continue
+			}
+			if c.errChan != nil {
+				select {
+				case c.errChan <- failedKafkaMessage(err.Msg):
+				default:
+					c.Statsd.Incr("send_message_error_dropped", []string{}, 1)
+					log.W(c.Logger, "Error channel is full, failed message not re-emitted", func(cm log.CM) {
+						cm.Write(zap.String("topic", err.Msg.Topic))
+					})
+				}
+			}
+			c.sendToDeadLetterTopic(err.Msg, err.Err)
 		}
 	}()
 
 	return nil
 }
 
-//Close the connections to kafka
+func failedKafkaMessage(msg *sarama.ProducerMessage) *messages.KafkaMessage {
+	var value, key []byte
+	if msg.Value != nil {
+		value, _ = msg.Value.Encode()
+	}
+	if msg.Key != nil {
+		key, _ = msg.Key.Encode()
+	}
+	failed := messages.NewKafkaMessageWithKey(msg.Topic, string(value), string(key))
+	if len(msg.Headers) > 0 {
+		failed.Headers = make(map[string]string, len(msg.Headers))
+		for _, header := range msg.Headers {
+			failed.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return failed
+}
+
+// sendToDeadLetterTopic writes a message that failed after all the retries to the dead letter
+// topic if there is one, the message is logged if it can't be sent to it
+func (c *KafkaProducer) sendToDeadLetterTopic(msg *sarama.ProducerMessage, sendErr error) {
+	if c.DeadLetterTopic == "" {
+		return
+	}
+	deadLetterMessage, err := messages.NewDeadLetterMessage(failedKafkaMessage(msg), sendErr, time.Now().UnixNano()).ToJSON()
+	if err != nil {
+		c.logUndeliverable(msg, sendErr)
+		return
+	}
+
+	c.inputLock.RLock()
+	defer c.inputLock.RUnlock()
+	if c.closed {
+		c.logUndeliverable(msg, sendErr)
+		return
+	}
+	// this runs in the goroutine that drains the errors, so blocking on the input could deadlock
+	select {
+	case c.Producer.Input() <- &sarama.ProducerMessage{
+		Topic:    c.DeadLetterTopic,
+		Key:      msg.Key,
+		Value:    sarama.StringEncoder(deadLetterMessage),
+		Metadata: deadLetter{},
+	}:
+		c.Statsd.Incr("send_message_dead_letter", []string{}, 1)
+	default:
+		c.logUndeliverable(msg, sendErr)
+	}
+}
+
+// logUndeliverable logs the full payload of a message that was lost, so it can still be replayed
+func (c *KafkaProducer) logUndeliverable(msg *sarama.ProducerMessage, sendErr error) {
+	failed := failedKafkaMessage(msg)
+	c.Statsd.Incr("send_message_lost", []string{}, 1)
+	c.Logger.Error(
+		"Failed to deliver message, it was lost",
+		zap.String("topic", failed.Topic),
+		zap.String("key", failed.Key),
+		zap.String("message", failed.Message),
+		zap.Error(sendErr),
+	)
+}
+
+// ChannelDepth is how many messages are buffered in a channel and how many it can hold
+type ChannelDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// ChannelDepths samples the buffers between the workers and the brokers, a full input means the
+// brokers can't keep up while full successes or errors mean their readers are the bottleneck
+func (c *KafkaProducer) ChannelDepths() map[string]ChannelDepth {
+	return map[string]ChannelDepth{
+		"input":     {Len: len(c.Producer.Input()), Cap: cap(c.Producer.Input())},
+		"successes": {Len: len(c.Producer.Successes()), Cap: cap(c.Producer.Successes())},
+		"errors":    {Len: len(c.Producer.Errors()), Cap: cap(c.Producer.Errors())},
+	}
+}
+
+//Close the connections to kafka, waiting for pending messages to be flushed
 func (c *KafkaProducer) Close() {
+	// unblocks the sends waiting for the rate limiter or the input, so they don't hold the lock
+	c.cancel()
+	c.inputLock.Lock()
+	if c.closed {
+		c.inputLock.Unlock()
+		return
+	}
+	c.closed = true
+	c.inputLock.Unlock()
 	c.Producer.AsyncClose()
+	c.returns.Wait()
 }
 
 //SendAPNSPush notification to Kafka
@@ -144,8 +597,15 @@ func (c *KafkaProducer) SendAPNSPush(topic, deviceToken string, payload, message
 	if err != nil {
 		return err
 	}
-	c.sendPush(messages.NewKafkaMessage(topic, message))
-	return nil
+	key := GetKafkaMessageKey(c.KeyField, deviceToken, pushMetadata)
+	kafkaMessage := messages.NewKafkaMessageWithKey(topic, message, key)
+	if c.Headers {
+		kafkaMessage.Headers = GetKafkaMessageHeaders("apns", pushMetadata)
+	}
+	if err := c.checkMessageSize(kafkaMessage, deviceToken); err != nil {
+		return err
+	}
+	return c.sendPush(kafkaMessage, GetDedupKey(deviceToken, pushMetadata), "apns")
 }
 
 //SendGCMPush notification to Kafka
@@ -170,21 +630,76 @@ func (c *KafkaProducer) SendGCMPush(topic, deviceToken string, payload, messageM
 	if err != nil {
 		return err
 	}
-	c.sendPush(messages.NewKafkaMessage(topic, message))
-	return nil
+	key := GetKafkaMessageKey(c.KeyField, deviceToken, pushMetadata)
+	kafkaMessage := messages.NewKafkaMessageWithKey(topic, message, key)
+	if c.Headers {
+		kafkaMessage.Headers = GetKafkaMessageHeaders("gcm", pushMetadata)
+	}
+	if err := c.checkMessageSize(kafkaMessage, deviceToken); err != nil {
+		return err
+	}
+	return c.sendPush(kafkaMessage, GetDedupKey(deviceToken, pushMetadata), "gcm")
+}
+
+func (c *KafkaProducer) checkMessageSize(msg *messages.KafkaMessage, deviceToken string) error {
+	size := len(msg.Message) + len(msg.Key)
+	for key, value := range msg.Headers {
+		size += len(key) + len(value)
+	}
+	if c.MaxMessageBytes <= 0 || size <= c.MaxMessageBytes {
+		return nil
+	}
+	c.Statsd.Incr("send_message_too_large", []string{}, 1)
+	return &MessageTooLargeError{Size: size, MaxBytes: c.MaxMessageBytes, DeviceToken: deviceToken}
 }
 
-//SendPush notification to Kafka
-func (c *KafkaProducer) sendPush(msg *messages.KafkaMessage) {
+//SendPush notification to Kafka, unless a push with the same dedupKey was sent within the dedup window.
+//It waits for both the max rate of the service and the max rate of the producer
+func (c *KafkaProducer) sendPush(msg *messages.KafkaMessage, dedupKey, service string) error {
+	if c.Dedup != nil && dedupKey != "" && c.Dedup.Seen(dedupKey, time.Now()) {
+		c.Statsd.Incr("send_message_deduplicated", []string{}, 1)
+		log.D(c.Logger, "Suppressed duplicated message", func(cm log.CM) {
+			cm.Write(
+				zap.String("dedupKey", dedupKey),
+				zap.String("topic", msg.Topic),
+			)
+		})
+		return nil
+	}
 	message := &sarama.ProducerMessage{
 		Topic: msg.Topic,
 		Value: sarama.StringEncoder(msg.Message),
 	}
-	c.Producer.Input() <- message
+	if msg.Key != "" {
+		message.Key = sarama.StringEncoder(msg.Key)
+	}
+	if len(msg.Headers) > 0 {
+		message.Headers = toRecordHeaders(msg.Headers)
+	}
+	c.inputLock.RLock()
+	defer c.inputLock.RUnlock()
+	if c.closed {
+		return fmt.Errorf("kafka producer is closed")
+	}
+	// blocks instead of dropping when the rate is exceeded, slowing down the worker
+	if limiter, ok := c.serviceLimiters[service]; ok {
+		if err := limiter.Wait(c.ctx); err != nil {
+			return fmt.Errorf("kafka producer is closed")
+		}
+	}
+	if err := c.limiter.Wait(c.ctx); err != nil {
+		return fmt.Errorf("kafka producer is closed")
+	}
+	select {
+	case c.Producer.Input() <- message:
+	case <-c.ctx.Done():
+		return fmt.Errorf("kafka producer is closed")
+	}
 	log.D(c.Logger, "Sent message", func(cm log.CM) {
 		cm.Write(
 			zap.Object("KafkaMessage", message),
 			zap.String("topic", msg.Topic),
 		)
 	})
+	return nil
 }
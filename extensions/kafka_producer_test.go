@@ -24,6 +24,7 @@ package extensions_test
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -117,6 +118,42 @@ var _ = Describe("Kafka Extension", func() {
 		})
 	})
 
+	Describe("Channel depths", func() {
+		It("should report the configured capacity of the producer channels", func() {
+			config.Set("kafka.channelBufferSize", 16)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			depths := kafka.ChannelDepths()
+			Expect(depths).To(HaveLen(3))
+			for _, name := range []string{"input", "successes", "errors"} {
+				Expect(depths[name].Cap).To(Equal(16))
+				Expect(depths[name].Len).To(BeNumerically("<=", 16))
+			}
+		})
+	})
+
+	Describe("Compression", func() {
+		It("should use the configured compression", func() {
+			config.Set("kafka.compression", "gzip")
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			Expect(kafka.Compression).To(Equal("gzip"))
+		})
+
+		It("should fall back to none if the compression is invalid", func() {
+			config.Set("kafka.compression", "invalid")
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			Expect(kafka.Compression).To(Equal("none"))
+		})
+	})
+
 	Describe("Send GCM Message", func() {
 		It("should send GCM message", func() {
 			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
@@ -135,6 +172,7 @@ var _ = Describe("Kafka Extension", func() {
 			err = json.Unmarshal(msg.Value, &gcmMessage)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(gcmMessage.To).To(Equal("device-token"))
+			Expect(string(msg.Key)).To(Equal("device-token"))
 			Expect(gcmMessage.TimeToLive).To(BeEquivalentTo(expiry))
 			Expect(gcmMessage.Data["x"]).To(BeEquivalentTo(1))
 			Expect(gcmMessage.Data["m"].(map[string]interface{})["a"]).To(BeEquivalentTo(1))
@@ -165,4 +203,373 @@ var _ = Describe("Kafka Extension", func() {
 			Expect(apnsMessage.Payload.M["a"]).To(BeEquivalentTo(1))
 		})
 	})
+
+	Describe("Headers", func() {
+		It("should send the headers of the push when enabled", func() {
+			config.Set("kafka.headers.enabled", true)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			pushMetadata := map[string]interface{}{"jobId": "job-id", "appName": "app-name", "muid": "message-id"}
+			kafka.SendAPNSPush("consumer", "device-token", nil, nil, pushMetadata, 0, "template")
+			msg, err := getNextMessageFrom(testConsumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).NotTo(BeNil())
+
+			headers := map[string]string{}
+			for _, header := range msg.Headers {
+				headers[header.Key] = string(header.Value)
+			}
+			Expect(headers).To(Equal(map[string]string{
+				"app":     "app-name",
+				"jobID":   "job-id",
+				"service": "apns",
+				"traceID": "message-id",
+			}))
+		})
+
+		It("should not send headers when disabled", func() {
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			kafka.SendGCMPush("consumer", "device-token", nil, nil, map[string]interface{}{"jobId": "job-id"}, 0, "template")
+			msg, err := getNextMessageFrom(testConsumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).NotTo(BeNil())
+			Expect(msg.Headers).To(BeEmpty())
+		})
+	})
+
+	Describe("Max message bytes", func() {
+		It("should reject the messages larger than the max message bytes", func() {
+			config.Set("kafka.maxMessageBytes", 1000)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": strings.Repeat("x", 1000)}
+			err = kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, 0, "template")
+			Expect(err).To(BeAssignableToTypeOf(&extensions.MessageTooLargeError{}))
+			tooLarge := err.(*extensions.MessageTooLargeError)
+			Expect(tooLarge.Size).To(BeNumerically(">", 1000))
+			Expect(tooLarge.DeviceToken).To(Equal("device-token"))
+			Expect(err.Error()).To(ContainSubstring("device-token"))
+		})
+
+		It("should send the messages under the max message bytes", func() {
+			config.Set("kafka.maxMessageBytes", 1000)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": strings.Repeat("x", 500)}
+			err = kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, 0, "template")
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := getNextMessageFrom(testConsumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).NotTo(BeNil())
+		})
+	})
+
+	Describe("Required acks", func() {
+		It("should use the configured required acks", func() {
+			config.Set("kafka.requiredAcks", "all")
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			Expect(kafka.RequiredAcks).To(Equal("all"))
+		})
+
+		It("should fall back to local if the required acks are invalid", func() {
+			config.Set("kafka.requiredAcks", "invalid")
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			Expect(kafka.RequiredAcks).To(Equal("local"))
+		})
+	})
+
+	Describe("Errors", func() {
+		It("should re-emit the messages that failed to be delivered", func() {
+			config.Set("kafka.maxMessageBytes", 10)
+			errChan := make(chan *messages.KafkaMessage, 1)
+			kafka, err := extensions.NewKafkaProducerWithErrors(config, logger, statsdClient, errChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+
+			var failed *messages.KafkaMessage
+			Eventually(errChan).Should(Receive(&failed))
+			Expect(failed.Topic).To(Equal("consumer"))
+			Expect(failed.Message).To(ContainSubstring("device-token"))
+		})
+
+		It("should not block the delivery reports when nobody reads the errors", func() {
+			config.Set("kafka.maxMessageBytes", 10)
+			errChan := make(chan *messages.KafkaMessage)
+			kafka, err := extensions.NewKafkaProducerWithErrors(config, logger, statsdClient, errChan)
+			Expect(err).NotTo(HaveOccurred())
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			for i := 0; i < 3; i++ {
+				kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			}
+
+			closed := make(chan struct{})
+			go func() {
+				kafka.Close()
+				close(closed)
+			}()
+			Eventually(closed, 5*time.Second).Should(BeClosed())
+		})
+	})
+
+	Describe("Max rate", func() {
+		It("should block instead of dropping when the max rate is exceeded", func() {
+			config.Set("kafka.maxRate", 2)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			start := time.Now()
+			for i := 0; i < 4; i++ {
+				kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			}
+			Expect(time.Now().Sub(start)).To(BeNumerically(">=", 900*time.Millisecond))
+
+			for i := 0; i < 4; i++ {
+				msg, err := getNextMessageFrom(testConsumer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg).NotTo(BeNil())
+			}
+		})
+
+		It("should change the max rate while running", func() {
+			config.Set("kafka.maxRate", 2)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+			Expect(kafka.MaxRate).To(BeEquivalentTo(2))
+
+			kafka.SetMaxRate(0)
+			Expect(kafka.MaxRate).To(BeZero())
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			}
+			Expect(time.Now().Sub(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+	})
+
+	Describe("Service max rate", func() {
+		It("should only block the sends of the limited service", func() {
+			config.Set("kafka.serviceMaxRate.gcm", 2)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+			Expect(kafka.ServiceMaxRate("gcm")).To(BeEquivalentTo(2))
+			Expect(kafka.ServiceMaxRate("apns")).To(BeZero())
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				kafka.SendAPNSPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			}
+			Expect(time.Now().Sub(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+			start = time.Now()
+			for i := 0; i < 4; i++ {
+				kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			}
+			Expect(time.Now().Sub(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+
+	Describe("Dead letter topic", func() {
+		It("should write the messages that failed to be delivered to the dead letter topic", func() {
+			config.Set("kafka.retries", 0)
+			config.Set("kafka.deadLetterTopic", "consumer")
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			defer kafka.Close()
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			kafka.SendGCMPush("invalid/topic", "device-token", payload, nil, nil, expiry, "template")
+
+			msg, err := getNextMessageFrom(testConsumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).NotTo(BeNil())
+
+			var deadLetter messages.DeadLetterMessage
+			err = json.Unmarshal(msg.Value, &deadLetter)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deadLetter.Topic).To(Equal("invalid/topic"))
+			Expect(deadLetter.Key).To(Equal("device-token"))
+			Expect(deadLetter.Message).To(ContainSubstring("device-token"))
+			Expect(deadLetter.Error).NotTo(BeEmpty())
+			Expect(deadLetter.FailedAt).To(BeNumerically(">", 0))
+		})
+	})
+
+	Describe("Close", func() {
+		It("should flush pending messages before returning", func() {
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+
+			payload := map[string]interface{}{"x": 1}
+			expiry := time.Now().Unix()
+			kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, expiry, "template")
+			kafka.Close()
+
+			msg, err := getNextMessageFrom(testConsumer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).NotTo(BeNil())
+		})
+
+		It("should fail the sends after it was closed", func() {
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+			kafka.Close()
+
+			payload := map[string]interface{}{"x": 1}
+			err = kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, time.Now().Unix(), "template")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should unblock the sends waiting for the max rate", func() {
+			config.Set("kafka.maxRate", 0.1)
+			kafka, err := extensions.NewKafkaProducer(config, logger, statsdClient)
+			Expect(err).NotTo(HaveOccurred())
+
+			payload := map[string]interface{}{"x": 1}
+			errs := make(chan error, 2)
+			go func() {
+				for i := 0; i < 2; i++ {
+					errs <- kafka.SendGCMPush("consumer", "device-token", payload, nil, nil, time.Now().Unix(), "template")
+				}
+			}()
+			Expect(<-errs).NotTo(HaveOccurred())
+			start := time.Now()
+			kafka.Close()
+			Eventually(errs).Should(Receive(HaveOccurred()))
+			Expect(time.Now().Sub(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+})
+
+var _ = Describe("Kafka message key", func() {
+	pushMetadata := map[string]interface{}{
+		"userId": "user-id",
+		"jobId":  "job-id",
+	}
+
+	It("should use the device token as key", func() {
+		key := extensions.GetKafkaMessageKey("token", "device-token", pushMetadata)
+		Expect(key).To(Equal("device-token"))
+	})
+
+	It("should use the user id as key", func() {
+		key := extensions.GetKafkaMessageKey("userId", "device-token", pushMetadata)
+		Expect(key).To(Equal("user-id"))
+	})
+
+	It("should use the job id as key", func() {
+		key := extensions.GetKafkaMessageKey("jobId", "device-token", pushMetadata)
+		Expect(key).To(Equal("job-id"))
+	})
+
+	It("should return an empty key if the field is not in the push metadata", func() {
+		key := extensions.GetKafkaMessageKey("templateName", "device-token", pushMetadata)
+		Expect(key).To(BeEmpty())
+	})
+
+	It("should validate the key field", func() {
+		Expect(extensions.IsValidKafkaKeyField("token")).To(BeTrue())
+		Expect(extensions.IsValidKafkaKeyField("userId")).To(BeTrue())
+		Expect(extensions.IsValidKafkaKeyField("locale")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Dedup key", func() {
+	It("should identify the push by its job and device token", func() {
+		key := extensions.GetDedupKey("device-token", map[string]interface{}{"jobId": "job-id", "userId": "user-id"})
+		Expect(key).To(Equal("job-id:device-token"))
+	})
+
+	It("should tell apart the pushes of different jobs to the same device token", func() {
+		key := extensions.GetDedupKey("device-token", map[string]interface{}{"jobId": "job-id"})
+		otherKey := extensions.GetDedupKey("device-token", map[string]interface{}{"jobId": "other-job-id"})
+		Expect(key).NotTo(Equal(otherKey))
+	})
+
+	It("should not deduplicate pushes without a device token", func() {
+		key := extensions.GetDedupKey("", map[string]interface{}{"jobId": "job-id"})
+		Expect(key).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Kafka message headers", func() {
+	It("should identify the job, app and service of the push", func() {
+		headers := extensions.GetKafkaMessageHeaders("gcm", map[string]interface{}{
+			"jobId":   "job-id",
+			"appName": "app-name",
+			"muid":    "message-id",
+			"userId":  "user-id",
+		})
+		Expect(headers).To(Equal(map[string]string{
+			"jobID":   "job-id",
+			"app":     "app-name",
+			"service": "gcm",
+			"traceID": "message-id",
+		}))
+	})
+
+	It("should skip the fields that are not in the push metadata", func() {
+		headers := extensions.GetKafkaMessageHeaders("apns", nil)
+		Expect(headers).To(Equal(map[string]string{"service": "apns"}))
+	})
+})
+
+var _ = Describe("Kafka security", func() {
+	var logger zap.Logger
+	var config *viper.Viper
+
+	BeforeEach(func() {
+		logger = zap.New(
+			zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+			zap.FatalLevel,
+		)
+		config = viper.New()
+	})
+
+	It("should fail if the tls ca file can't be read", func() {
+		config.Set("kafka.tls.enabled", true)
+		config.Set("kafka.tls.caFile", "/invalid/ca.pem")
+		_, err := extensions.NewKafkaProducer(config, logger, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to read kafka tls ca file /invalid/ca.pem"))
+	})
+
+	It("should fail if the sasl mechanism is invalid", func() {
+		config.Set("kafka.sasl.enabled", true)
+		config.Set("kafka.sasl.mechanism", "invalid")
+		_, err := extensions.NewKafkaProducer(config, logger, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("invalid kafka sasl mechanism invalid"))
+	})
 })
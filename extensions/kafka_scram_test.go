@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions
+
+import (
+	"crypto/sha256"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Kafka SCRAM client", func() {
+	// test vector from RFC 7677
+	rfcNonce := func() string { return "rOprNGfwEbeRWgbNEkqO" }
+
+	It("should authenticate with SCRAM-SHA-256", func() {
+		client := &scramClient{hashGenerator: sha256.New, nonceGenerator: rfcNonce}
+		err := client.Begin("user", "pencil", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		clientFirst, err := client.Step("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientFirst).To(Equal("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+
+		clientFinal, err := client.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientFinal).To(Equal("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+		Expect(client.Done()).To(BeFalse())
+
+		_, err = client.Step("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(client.Done()).To(BeTrue())
+	})
+
+	It("should fail if the server nonce doesn't match", func() {
+		client := &scramClient{hashGenerator: sha256.New}
+		err := client.Begin("user", "pencil", "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Step("")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.Step("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail if the server signature doesn't match", func() {
+		client := &scramClient{hashGenerator: sha256.New, nonceGenerator: rfcNonce}
+		err := client.Begin("user", "pencil", "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Step("")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = client.Step("v=aW52YWxpZA==")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -33,11 +33,24 @@ import (
 	"github.com/uber-go/zap"
 )
 
+// PGConnectionError with SourceError that originated the connection failure
+type PGConnectionError struct {
+	SourceError error
+}
+
+func (e *PGConnectionError) Error() string {
+	return fmt.Sprintf("Could not connect to postgres using supplied configuration: %s", e.SourceError.Error())
+}
+
 // PGClient is the struct that connects to PostgreSQL
 type PGClient struct {
-	Config *viper.Viper
-	DB     interfaces.DB
-	Logger zap.Logger
+	Config       *viper.Viper
+	DB           interfaces.DB
+	Logger       zap.Logger
+	PoolSize     int
+	IdleTimeout  time.Duration
+	MaxConnAge   time.Duration
+	QueryTimeout time.Duration
 }
 
 // NewPGClient creates a new client
@@ -68,18 +81,39 @@ func (c *PGClient) Connect(prefix string, PGOrNil ...interfaces.DB) error {
 	poolSize := c.Config.GetInt(fmt.Sprintf("%s.poolSize", prefix))
 	maxRetries := c.Config.GetInt(fmt.Sprintf("%s.maxRetries", prefix))
 
+	// without a limit connections are never recycled and survive a database failover
+	c.PoolSize = poolSize
+	if c.PoolSize <= 0 {
+		c.PoolSize = 10
+	}
+	c.IdleTimeout = 5 * time.Minute
+	if key := fmt.Sprintf("%s.idleTimeout", prefix); c.Config.IsSet(key) {
+		c.IdleTimeout = c.Config.GetDuration(key)
+	}
+	c.MaxConnAge = 5 * time.Minute
+	if key := fmt.Sprintf("%s.maxConnAge", prefix); c.Config.IsSet(key) {
+		c.MaxConnAge = c.Config.GetDuration(key)
+	}
+
+	// a query that doesn't answer in time fails instead of holding the worker forever, zero disables it
+	c.QueryTimeout = c.Config.GetDuration(fmt.Sprintf("%s.queryTimeout", prefix))
+
 	if len(PGOrNil) > 0 {
 		c.DB = PGOrNil[0]
 		return nil
 	}
 
 	conn := pg.Connect(&pg.Options{
-		Addr:       fmt.Sprintf("%s:%d", host, port),
-		User:       user,
-		Password:   pass,
-		Database:   db,
-		PoolSize:   poolSize,
-		MaxRetries: maxRetries,
+		Addr:         fmt.Sprintf("%s:%d", host, port),
+		User:         user,
+		Password:     pass,
+		Database:     db,
+		PoolSize:     c.PoolSize,
+		MaxRetries:   maxRetries,
+		IdleTimeout:  c.IdleTimeout,
+		MaxAge:       c.MaxConnAge,
+		ReadTimeout:  c.QueryTimeout,
+		WriteTimeout: c.QueryTimeout,
 	})
 	c.DB = conn
 
@@ -95,6 +129,35 @@ func (c *PGClient) IsConnected() bool {
 	return res.RowsReturned() == 1
 }
 
+//Ping checks that PG answers a query within timeout
+func (c *PGClient) Ping(timeout time.Duration) error {
+	return PingPG(c.DB, timeout)
+}
+
+//PingPG checks that db answers a query within timeout, failing with a *PGConnectionError. A pg
+//connection pool runs the query with timeout as its read and write deadlines, so the query is
+//abandoned with the ping instead of holding the goroutine and a connection until postgres answers
+func PingPG(db interfaces.DB, timeout time.Duration) error {
+	if conn, ok := db.(*pg.DB); ok {
+		db = conn.WithTimeout(timeout)
+	}
+	// buffered so the goroutine can always finish, even after the ping gave up on it
+	result := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("SELECT 1")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return &PGConnectionError{SourceError: err}
+		}
+		return nil
+	case <-time.After(timeout):
+		return &PGConnectionError{SourceError: fmt.Errorf("timed out after %s", timeout)}
+	}
+}
+
 //Close the connections to PG
 func (c *PGClient) Close() error {
 	c.DB.Close()
@@ -103,13 +166,13 @@ func (c *PGClient) Close() error {
 
 //WaitForConnection loops until postgres is connected
 func (c *PGClient) WaitForConnection(timeout int) error {
-	start := time.Now().Unix()
-	for !c.IsConnected() || time.Now().Unix()-start > int64(timeout) {
-		time.Sleep(10 * time.Millisecond)
-	}
-
-	if time.Now().Unix()-start > int64(timeout) {
-		return fmt.Errorf("Timed out waiting for Postgres to connect")
+	backoff := NewBackoff(10*time.Millisecond, time.Second, 0.2, 0)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for attempt := 0; !c.IsConnected(); attempt++ {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for Postgres to connect")
+		}
+		time.Sleep(backoff.Duration(attempt))
 	}
 	return nil
 }
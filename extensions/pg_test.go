@@ -23,10 +23,16 @@
 package extensions_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/marathon/extensions"
+	. "github.com/topfreegames/marathon/testing"
 	"github.com/uber-go/zap"
 )
 
@@ -54,4 +60,96 @@ var _ = Describe("PG Extension", func() {
 			Expect(client.IsConnected()).To(BeTrue())
 		})
 	})
+
+	Describe("Pool sizing", func() {
+		It("should use the configured pool settings", func() {
+			config.Set("db.poolSize", 15)
+			config.Set("db.idleTimeout", "1m")
+			config.Set("db.maxConnAge", "30m")
+			client, err := extensions.NewPGClient("db", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			Expect(client.PoolSize).To(Equal(15))
+			Expect(client.IdleTimeout).To(Equal(time.Minute))
+			Expect(client.MaxConnAge).To(Equal(30 * time.Minute))
+		})
+
+		It("should use the default pool settings if they are not set", func() {
+			config = viper.New()
+			client, err := extensions.NewPGClient("db", config, logger, NewPGMock(0, 1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.PoolSize).To(Equal(10))
+			Expect(client.IdleTimeout).To(Equal(5 * time.Minute))
+			Expect(client.MaxConnAge).To(Equal(5 * time.Minute))
+		})
+	})
+
+	Describe("Query timeout", func() {
+		It("should fail queries that take longer than the timeout", func() {
+			config.Set("db.queryTimeout", "100ms")
+			client, err := extensions.NewPGClient("db", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			Expect(client.QueryTimeout).To(Equal(100 * time.Millisecond))
+
+			_, err = client.DB.Exec("SELECT pg_sleep(1)")
+			Expect(err).To(HaveOccurred())
+			Expect(client.IsConnected()).To(BeTrue())
+		})
+	})
+
+	Describe("Ping", func() {
+		It("should succeed if postgres answers", func() {
+			client, err := extensions.NewPGClient("db", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			Expect(client.Ping(time.Second)).To(Succeed())
+		})
+
+		It("should return a connection error if the query fails", func() {
+			err := extensions.PingPG(NewPGMock(0, 0, fmt.Errorf("connection refused")), time.Second)
+			Expect(err).To(HaveOccurred())
+			_, ok := err.(*extensions.PGConnectionError)
+			Expect(ok).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("connection refused"))
+		})
+
+		It("should abandon the query of a ping that timed out", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+			// the server accepts the connection but never answers, the ping must close it
+			abandoned := make(chan struct{})
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				ioutil.ReadAll(conn)
+				close(abandoned)
+			}()
+
+			config.Set("db.host", "127.0.0.1")
+			config.Set("db.port", listener.Addr().(*net.TCPAddr).Port)
+			config.Set("db.maxRetries", 0)
+			client, err := extensions.NewPGClient("db", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+
+			err = client.Ping(100 * time.Millisecond)
+			Expect(err).To(HaveOccurred())
+			Eventually(abandoned, time.Second).Should(BeClosed())
+		})
+
+		It("should return a connection error if postgres is unreachable", func() {
+			config.Set("db.port", 1)
+			client, err := extensions.NewPGClient("db", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			err = client.Ping(time.Second)
+			Expect(err).To(HaveOccurred())
+			_, ok := err.(*extensions.PGConnectionError)
+			Expect(ok).To(BeTrue())
+		})
+	})
 })
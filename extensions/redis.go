@@ -25,8 +25,11 @@ package extensions
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/interfaces"
 	"github.com/topfreegames/marathon/log"
 	"github.com/uber-go/zap"
 	"gopkg.in/redis.v5"
@@ -41,38 +44,98 @@ func (e *RedisConnectionError) Error() string {
 	return fmt.Sprintf("Could not connect to redis using supplied configuration: %s", e.SourceError.Error())
 }
 
-// NewRedis connection with the specified configuration
-func NewRedis(prefix string, conf *viper.Viper, logger zap.Logger) (*redis.Client, error) {
+// Redis modes accepted by the redis.mode config
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+// RedisAddrs splits a comma separated list of redis addresses
+func RedisAddrs(addrs string) []string {
+	result := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// NewRedis connection with the specified configuration, the redis.mode config picks a single
+// node client, a sentinel failover client or a cluster client
+func NewRedis(prefix string, conf *viper.Viper, logger zap.Logger) (interfaces.Redis, error) {
+	redisMode := conf.GetString(fmt.Sprintf("%s.redis.mode", prefix))
 	redisHost := conf.GetString(fmt.Sprintf("%s.redis.host", prefix))
 	redisPort := conf.GetInt(fmt.Sprintf("%s.redis.port", prefix))
 	redisPass := conf.GetString(fmt.Sprintf("%s.redis.pass", prefix))
 	redisDB := conf.GetInt(fmt.Sprintf("%s.redis.db", prefix))
 	tlsEnabled := conf.GetBool(fmt.Sprintf("%s.redis.tlsEnabled", prefix))
+	connectAttempts := conf.GetInt(fmt.Sprintf("%s.redis.connectAttempts", prefix))
 
 	l := logger.With(
 		zap.String("source", "redisExtension"),
 		zap.String("operation", "NewRedis"),
+		zap.String("redisMode", redisMode),
 		zap.String("redisHost", redisHost),
 		zap.Int("redisPort", redisPort),
 		zap.Int("redisDB", redisDB),
 	)
 	log.D(l, "Connecting to redis...")
-	opt := &redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", redisHost, redisPort),
-		Password: redisPass,
-		DB:       redisDB,
-	}
-	if tlsEnabled {
-		opt.TLSConfig = &tls.Config{
-			InsecureSkipVerify: true,
+	var client interfaces.Redis
+	switch redisMode {
+	case "", RedisModeSingle:
+		opt := &redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", redisHost, redisPort),
+			Password: redisPass,
+			DB:       redisDB,
 		}
+		if tlsEnabled {
+			opt.TLSConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
+		}
+		client = redis.NewClient(opt)
+	case RedisModeSentinel:
+		master := conf.GetString(fmt.Sprintf("%s.redis.sentinel.master", prefix))
+		addrs := RedisAddrs(conf.GetString(fmt.Sprintf("%s.redis.sentinel.addrs", prefix)))
+		if master == "" || len(addrs) == 0 {
+			return nil, &RedisConnectionError{SourceError: fmt.Errorf("sentinel mode requires %s.redis.sentinel.master and addrs", prefix)}
+		}
+		if tlsEnabled {
+			log.W(l, "TLS is not supported by the sentinel client, connecting without it.")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    master,
+			SentinelAddrs: addrs,
+			Password:      redisPass,
+			DB:            redisDB,
+		})
+	case RedisModeCluster:
+		addrs := RedisAddrs(conf.GetString(fmt.Sprintf("%s.redis.cluster.addrs", prefix)))
+		if len(addrs) == 0 {
+			return nil, &RedisConnectionError{SourceError: fmt.Errorf("cluster mode requires %s.redis.cluster.addrs", prefix)}
+		}
+		if tlsEnabled {
+			log.W(l, "TLS is not supported by the cluster client, connecting without it.")
+		}
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: redisPass,
+		})
+	default:
+		return nil, &RedisConnectionError{SourceError: fmt.Errorf("unknown redis mode %s", redisMode)}
 	}
-	client := redis.NewClient(opt)
-	_, err := client.Ping().Result()
+	backoff := NewBackoff(100*time.Millisecond, 5*time.Second, 0.2, connectAttempts)
+	err := backoff.Retry(func() error {
+		_, err := client.Ping().Result()
+		return err
+	})
 	if err != nil {
 		log.E(l, "Connection to redis failed.", func(cm log.CM) {
 			cm.Write(zap.Error(err))
 		})
+		client.Close()
 		return nil, &RedisConnectionError{SourceError: err}
 	}
 	log.I(l, "Connected to redis successfully.")
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package extensions_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/extensions"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Redis Extension", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+
+	Describe("Redis addrs", func() {
+		It("should split and trim the addresses", func() {
+			Expect(extensions.RedisAddrs("a:26379, b:26379,,c:26379 ")).To(Equal([]string{"a:26379", "b:26379", "c:26379"}))
+			Expect(extensions.RedisAddrs("")).To(BeEmpty())
+		})
+	})
+
+	Describe("New redis", func() {
+		var config *viper.Viper
+
+		BeforeEach(func() {
+			config = GetConf()
+		})
+
+		It("should connect to a single node by default", func() {
+			client, err := extensions.NewRedis("workers", config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			Expect(client.Ping().Err()).NotTo(HaveOccurred())
+		})
+
+		It("should fail if the mode is unknown", func() {
+			config.Set("workers.redis.mode", "replicated")
+			_, err := extensions.NewRedis("workers", config, logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown redis mode replicated"))
+		})
+
+		It("should fail in sentinel mode without a master", func() {
+			config.Set("workers.redis.mode", "sentinel")
+			config.Set("workers.redis.sentinel.addrs", "localhost:26379")
+			_, err := extensions.NewRedis("workers", config, logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sentinel mode requires workers.redis.sentinel.master and addrs"))
+		})
+
+		It("should fail in cluster mode without addresses", func() {
+			config.Set("workers.redis.mode", "cluster")
+			_, err := extensions.NewRedis("workers", config, logger)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cluster mode requires workers.redis.cluster.addrs"))
+		})
+	})
+})
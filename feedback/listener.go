@@ -34,6 +34,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/extensions/kafka"
+	"github.com/topfreegames/marathon/extensions"
 	"github.com/topfreegames/marathon/interfaces"
 	"github.com/uber-go/zap"
 )
@@ -72,7 +73,9 @@ func (l *Listener) loadConfigurationDefaults() {
 
 func (l *Listener) configure() error {
 	l.Config = viper.New()
-	l.Config.SetConfigFile(l.ConfigFile)
+	if err := extensions.SetConfigFile(l.Config, l.ConfigFile); err != nil {
+		return err
+	}
 	l.Config.SetEnvPrefix("marathon")
 	l.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	l.Config.AutomaticEnv()
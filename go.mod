@@ -28,6 +28,9 @@ require (
 	github.com/topfreegames/go-extensions-http v1.0.0
 	github.com/uber-go/zap v0.0.0-20160809182253-d11d2851fcab
 	github.com/valyala/fasttemplate v1.2.1
+	github.com/xdg-go/scram v1.1.2
+	golang.org/x/text v0.4.0
+	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9
 	gopkg.in/pg.v5 v5.3.3
 	gopkg.in/redis.v5 v5.2.9
 )
@@ -86,13 +89,13 @@ require (
 	github.com/topfreegames/go-extensions-tracing v1.0.0 // indirect
 	github.com/uber-go/atomic v1.3.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
 	go.opentelemetry.io/otel v0.15.0 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
-	golang.org/x/text v0.4.0 // indirect
-	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
@@ -48,6 +48,7 @@ type JSON map[string]interface{}
 type CreateJobPayload struct {
 	Localized        bool        `json:"localized"`
 	ExpiresAt        int64       `json:"expiresAt"`
+	PushExpiry       int64       `json:"pushExpiry"`
 	StartsAt         int64       `json:"startsAt"`
 	Context          JSON        `json:"context"`
 	Service          string      `json:"service"`
@@ -70,6 +71,7 @@ type Job struct {
 	Localized           bool    `json:"localized"`
 	CompletedAt         int64   `json:"completedAt"`
 	ExpiresAt           int64   `json:"expiresAt"`
+	PushExpiry          int64   `json:"pushExpiry"`
 	StartsAt            int64   `json:"startsAt"`
 	Context             JSON    `json:"context"`
 	Service             string  `json:"service"`
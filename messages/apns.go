@@ -24,6 +24,8 @@ package messages
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
 )
 
 // APNSMessage might need to update the json encoding if we change to snake case
@@ -34,6 +36,7 @@ type APNSMessage struct {
 	Payload     APNSPayloadContent     `json:"Payload"`
 	PushExpiry  int64                  `json:"push_expiry"`
 	Metadata    map[string]interface{} `json:"metadata"`
+	CollapseID  string                 `json:"collapse_id,omitempty"`
 }
 
 // APNSPayloadContent stores payload content of apns message
@@ -62,13 +65,74 @@ func NewAPNSMessage(deviceToken string, pushExpiry int64, aps, messageMetadata m
 	}
 
 	msg.Payload = APNSPayloadContent{
-		Aps:          aps,
+		Aps:          normalizeAps(aps),
 		M:            messageMetadata,
 		TemplateName: templateName,
 	}
+	// a device only shows the last of the pushes with the same collapse id, and groups the
+	// pushes with the same thread id
+	if collapseKey, ok := pushMetadata["collapseKey"].(string); ok && collapseKey != "" {
+		msg.CollapseID = collapseKey
+		if _, ok := msg.Payload.Aps["thread-id"]; !ok {
+			msg.Payload.Aps["thread-id"] = collapseKey
+		}
+	}
 	return msg
 }
 
+// normalizeAps converts the aps fields that APNS only accepts with a given type, templates render
+// every substitution as a string: badge must be an integer and the content-available and
+// mutable-content flags must be 1, or be left out when they are off
+func normalizeAps(aps map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(aps))
+	for key, value := range aps {
+		normalized[key] = value
+	}
+	if badge, ok := toInt(normalized["badge"]); ok {
+		normalized["badge"] = badge
+	}
+	for _, key := range []string{"content-available", "mutable-content"} {
+		value, ok := normalized[key]
+		if !ok {
+			continue
+		}
+		if isOn(value) {
+			normalized[key] = 1
+		} else {
+			delete(normalized, key)
+		}
+	}
+	return normalized
+}
+
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	case string:
+		if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func isOn(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		on, err := strconv.ParseBool(strings.TrimSpace(v))
+		return err == nil && on
+	}
+	i, ok := toInt(value)
+	return ok && i != 0
+}
+
 //ToJSON returns the serialized message
 func (m *APNSMessage) ToJSON() (string, error) {
 	b, err := json.Marshal(m)
@@ -23,6 +23,8 @@
 package messages_test
 
 import (
+	"encoding/json"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/topfreegames/marathon/messages"
@@ -48,6 +50,56 @@ var _ = Describe("APNS Message", func() {
 			Expect(msg.Metadata).To(BeEquivalentTo(pushMetadata))
 		})
 
+		It("should render badge as an integer and the flags as 1", func() {
+			aps := map[string]interface{}{
+				"alert":             "hello",
+				"sound":             "default",
+				"badge":             "3",
+				"content-available": "true",
+				"mutable-content":   float64(1),
+			}
+			msg := messages.NewAPNSMessage("deviceToken", 0, aps, nil, nil, "tplname")
+			message, err := msg.ToJSON()
+			Expect(err).NotTo(HaveOccurred())
+
+			var parsed messages.APNSMessage
+			Expect(json.Unmarshal([]byte(message), &parsed)).To(Succeed())
+			Expect(parsed.Payload.Aps).To(Equal(map[string]interface{}{
+				"alert":             "hello",
+				"sound":             "default",
+				"badge":             float64(3),
+				"content-available": float64(1),
+				"mutable-content":   float64(1),
+			}))
+		})
+
+		It("should leave out the flags that are off", func() {
+			aps := map[string]interface{}{"alert": "hello", "content-available": "0", "mutable-content": false}
+			msg := messages.NewAPNSMessage("deviceToken", 0, aps, nil, nil, "tplname")
+			Expect(msg.Payload.Aps).To(Equal(map[string]interface{}{"alert": "hello"}))
+		})
+
+		It("should keep a badge that isn't a number", func() {
+			aps := map[string]interface{}{"badge": "many"}
+			msg := messages.NewAPNSMessage("deviceToken", 0, aps, nil, nil, "tplname")
+			Expect(msg.Payload.Aps["badge"]).To(Equal("many"))
+		})
+
+		It("should set the collapse id and thread id of the push", func() {
+			pushMetadata := map[string]interface{}{"collapseKey": "black-friday"}
+			msg := messages.NewAPNSMessage("deviceToken", 0, map[string]interface{}{"alert": "hello"}, nil, pushMetadata, "tplname")
+			Expect(msg.CollapseID).To(Equal("black-friday"))
+			Expect(msg.Payload.Aps["thread-id"]).To(Equal("black-friday"))
+		})
+
+		It("should keep the thread id of the template", func() {
+			pushMetadata := map[string]interface{}{"collapseKey": "black-friday"}
+			aps := map[string]interface{}{"alert": "hello", "thread-id": "deals"}
+			msg := messages.NewAPNSMessage("deviceToken", 0, aps, nil, pushMetadata, "tplname")
+			Expect(msg.CollapseID).To(Equal("black-friday"))
+			Expect(msg.Payload.Aps["thread-id"]).To(Equal("deals"))
+		})
+
 		It("should return message with nil maps", func() {
 			empty := map[string]interface{}{}
 			msg := messages.NewAPNSMessage("deviceToken", 357, nil, nil, nil, "tplname")
@@ -37,6 +37,7 @@ type GCMMessage struct {
 	DeliveryReceiptRequest bool                   `json:"delivery_receipt_requested,omitempty"`
 	DryRun                 bool                   `json:"dry_run"`
 	MessageID              string                 `json:"message_id"`
+	CollapseKey            string                 `json:"collapse_key,omitempty"`
 	Metadata               map[string]interface{} `json:"metadata"`
 }
 
@@ -61,6 +62,8 @@ func NewGCMMessage(to string, data, messageMetadata map[string]interface{}, push
 		MessageID:              "",
 		Metadata:               pushMetadata,
 	}
+	// a device only shows the last of the pushes with the same collapse key
+	msg.CollapseKey, _ = pushMetadata["collapseKey"].(string)
 
 	return msg
 }
@@ -44,6 +44,19 @@ var _ = Describe("GCM Message", func() {
 			Expect(msg.MessageID).To(Equal(""))
 		})
 
+		It("should set the collapse key of the push", func() {
+			msg := messages.NewGCMMessage("to", nil, nil, map[string]interface{}{"collapseKey": "black-friday"}, 357, "my-template")
+			Expect(msg.CollapseKey).To(Equal("black-friday"))
+		})
+
+		It("should not set a collapse key by default", func() {
+			msg := messages.NewGCMMessage("to", nil, nil, nil, 357, "my-template")
+			Expect(msg.CollapseKey).To(BeEmpty())
+			message, err := msg.ToJSON()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).NotTo(ContainSubstring("collapse_key"))
+		})
+
 		It("should return message if data is nil", func() {
 			msg := messages.NewGCMMessage("to", nil, nil, nil, 357, "my-template")
 			Expect(msg).NotTo(BeNil())
@@ -22,10 +22,16 @@
 
 package messages
 
+import "encoding/json"
+
 // KafkaMessage is the message to be sent to Kafka
 type KafkaMessage struct {
 	Topic   string
 	Message string
+	// Key is optional, messages with the same key go to the same partition
+	Key string
+	// Headers are optional, they let consumers route the message without parsing it
+	Headers map[string]string
 }
 
 //NewKafkaMessage returns a new configured kafka message
@@ -35,3 +41,42 @@ func NewKafkaMessage(topic, message string) *KafkaMessage {
 		Message: message,
 	}
 }
+
+//NewKafkaMessageWithKey returns a new configured kafka message partitioned by key
+func NewKafkaMessageWithKey(topic, message, key string) *KafkaMessage {
+	return &KafkaMessage{
+		Topic:   topic,
+		Message: message,
+		Key:     key,
+	}
+}
+
+// DeadLetterMessage is a message that couldn't be delivered with the reason, it is written to the
+// dead letter topic so it can be audited and replayed
+type DeadLetterMessage struct {
+	Topic    string `json:"topic"`
+	Message  string `json:"message"`
+	Key      string `json:"key,omitempty"`
+	Error    string `json:"error"`
+	FailedAt int64  `json:"failedAt"`
+}
+
+//NewDeadLetterMessage returns a new dead letter message for a kafka message that failed with err
+func NewDeadLetterMessage(msg *KafkaMessage, err error, failedAt int64) *DeadLetterMessage {
+	return &DeadLetterMessage{
+		Topic:    msg.Topic,
+		Message:  msg.Message,
+		Key:      msg.Key,
+		Error:    err.Error(),
+		FailedAt: failedAt,
+	}
+}
+
+// ToJSON returns the serialized message
+func (m *DeadLetterMessage) ToJSON() (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -23,6 +23,9 @@
 package messages_test
 
 import (
+	"encoding/json"
+	"errors"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/topfreegames/marathon/messages"
@@ -35,6 +38,35 @@ var _ = Describe("Kafka Message", func() {
 			Expect(msg).NotTo(BeNil())
 			Expect(msg.Topic).To(Equal("topic"))
 			Expect(msg.Message).To(Equal("message"))
+			Expect(msg.Key).To(BeEmpty())
+		})
+
+		It("should return message with key", func() {
+			msg := messages.NewKafkaMessageWithKey("topic", "message", "key")
+			Expect(msg).NotTo(BeNil())
+			Expect(msg.Topic).To(Equal("topic"))
+			Expect(msg.Message).To(Equal("message"))
+			Expect(msg.Key).To(Equal("key"))
+		})
+	})
+
+	Describe("Dead letter message", func() {
+		It("should keep the original message and the error", func() {
+			msg := messages.NewKafkaMessageWithKey("topic", `{"x":1}`, "key")
+			deadLetter := messages.NewDeadLetterMessage(msg, errors.New("broker down"), 123)
+
+			str, err := deadLetter.ToJSON()
+			Expect(err).NotTo(HaveOccurred())
+			var decoded messages.DeadLetterMessage
+			err = json.Unmarshal([]byte(str), &decoded)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded).To(Equal(messages.DeadLetterMessage{
+				Topic:    "topic",
+				Message:  `{"x":1}`,
+				Key:      "key",
+				Error:    "broker down",
+				FailedAt: 123,
+			}))
 		})
 	})
 })
@@ -0,0 +1,29 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE "campaign_results" (
+  "id" uuid DEFAULT uuid_generate_v4() UNIQUE,
+  "job_id" uuid NOT NULL UNIQUE,
+  "total_tokens" integer NOT NULL DEFAULT 0,
+  "completed_tokens" integer NOT NULL DEFAULT 0,
+  "failed_tokens" integer NOT NULL DEFAULT 0,
+  "dropped_by_reason" JSONB NOT NULL DEFAULT '{}'::JSONB,
+  "started_at" bigint,
+  "finished_at" bigint,
+  "duration" bigint,
+  "created_at" bigint,
+  PRIMARY KEY ("id")
+);
+
+ALTER TABLE "campaign_results"
+ADD CONSTRAINT campaign_results_job_id_jobs_id_foreign
+FOREIGN KEY (job_id)
+REFERENCES jobs(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE "campaign_results";
@@ -0,0 +1,8 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+ALTER TABLE "jobs" ADD COLUMN version_templates JSONB NOT NULL DEFAULT '[]'::JSONB;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+ALTER TABLE "jobs" DROP COLUMN version_templates;
@@ -0,0 +1,8 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+CREATE INDEX ix_jobs_metadata ON "jobs" USING GIN (metadata jsonb_path_ops);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+DROP INDEX ix_jobs_metadata;
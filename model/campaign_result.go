@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"github.com/satori/go.uuid"
+)
+
+// CampaignResult is the final summary of a job, persisted when it completes
+type CampaignResult struct {
+	tableName struct{} `sql:"campaign_results,alias:campaign_result"`
+
+	ID              uuid.UUID              `sql:",pk" json:"id"`
+	JobID           uuid.UUID              `sql:",notnull" json:"jobId"`
+	TotalTokens     int                    `json:"totalTokens"`
+	CompletedTokens int                    `json:"completedTokens"`
+	FailedTokens    int                    `json:"failedTokens"`
+	DroppedByReason map[string]interface{} `json:"droppedByReason"`
+	StartedAt       int64                  `json:"startedAt"`
+	FinishedAt      int64                  `json:"finishedAt"`
+	Duration        int64                  `json:"duration"`
+	CreatedAt       int64                  `json:"createdAt"`
+}
+
+// NewCampaignResult builds the summary of a completed job,
+// timestamps and duration are in nanoseconds like the job's
+func NewCampaignResult(job *Job, droppedByReason map[string]interface{}) *CampaignResult {
+	startedAt := job.StartsAt
+	if startedAt == 0 {
+		startedAt = job.CreatedAt
+	}
+	failedTokens := job.TotalTokens - job.CompletedTokens
+	if failedTokens < 0 {
+		failedTokens = 0
+	}
+	var duration int64
+	if job.CompletedAt > startedAt {
+		duration = job.CompletedAt - startedAt
+	}
+	return &CampaignResult{
+		JobID:           job.ID,
+		TotalTokens:     job.TotalTokens,
+		CompletedTokens: job.CompletedTokens,
+		FailedTokens:    failedTokens,
+		DroppedByReason: droppedByReason,
+		StartedAt:       startedAt,
+		FinishedAt:      job.CompletedAt,
+		Duration:        duration,
+	}
+}
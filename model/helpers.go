@@ -23,9 +23,11 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
+	uuid "github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/interfaces"
 	pg "gopkg.in/pg.v5"
 )
@@ -35,21 +37,84 @@ func InvalidField(field string) error {
 	return fmt.Errorf("invalid %s", field)
 }
 
+// ListJobsByMetadata returns the jobs of the app whose metadata contains all the given keys and values,
+// e.g. {"campaign": "black-friday"}. An empty templateName returns the jobs of every template
+func ListJobsByMetadata(db interfaces.DB, appID uuid.UUID, templateName string, metadata map[string]interface{}) ([]Job, error) {
+	contained, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	query := db.Model(&jobs).Column("job.*", "App").Where("job.app_id = ?", appID)
+	if templateName != "" {
+		query.Where("job.template_name = ?", templateName)
+	}
+	err = query.Where("job.metadata @> ?", string(contained)).Order("job.created_at DESC").Select()
+	return jobs, err
+}
+
+// ListTemplates returns the templates of the app with their app. A non empty name returns only the
+// templates with that name, one for each locale it is written in
+func ListTemplates(db interfaces.DB, appID uuid.UUID, name string) ([]Template, error) {
+	templates := []Template{}
+	query := db.Model(&templates).Column("template.*", "App").Where("template.app_id = ?", appID)
+	if name != "" {
+		query.Where("template.name = ?", name)
+	}
+	err := query.Select()
+	return templates, err
+}
+
+// GetTemplate returns the template of the app with the name and locale, or pg.ErrNoRows if there is none
+func GetTemplate(db interfaces.DB, appID uuid.UUID, name, locale string) (*Template, error) {
+	template := &Template{}
+	err := db.Model(template).Column("template.*").Where(
+		"template.app_id = ? AND template.name = ? AND template.locale = ?",
+		appID,
+		name,
+		locale,
+	).First()
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
 // GetJobInfoAndApp get the app and the job from the database
 // job.ID must be set
 func (j *Job) GetJobInfoAndApp(db interfaces.DB) error {
 	return db.Model(j).Column("job.*", "App").Where("job.id = ?", j.ID).Select()
 }
 
+// TemplatesNotFoundError is returned when the app has none of the templates of the job
+type TemplatesNotFoundError struct {
+	TemplateName string
+	AppID        uuid.UUID
+}
+
+func (e *TemplatesNotFoundError) Error() string {
+	return fmt.Sprintf("No templates were found with name %s and %s", e.TemplateName, e.AppID)
+}
+
+// TemplateNames returns the names of the templates of the job, including its version templates
+func (j *Job) TemplateNames() []string {
+	names := strings.Split(j.TemplateName, ",")
+	for _, vt := range j.VersionTemplates {
+		names = append(names, vt.TemplateName)
+	}
+	return names
+}
+
 // GetJobTemplatesByNameAndLocale ...
 func (j *Job) GetJobTemplatesByNameAndLocale(db interfaces.DB) (map[string]map[string]Template, error) {
 	var templates []Template
 	var err error
-	if len(strings.Split(j.TemplateName, ",")) > 1 {
+	names := j.TemplateNames()
+	if len(names) > 1 {
 		err = db.Model(&templates).Where(
 			"app_id = ? AND name IN (?)",
 			j.App.ID,
-			pg.In(strings.Split(j.TemplateName, ",")),
+			pg.In(names),
 		).Select()
 	} else {
 		err = db.Model(&templates).Where(
@@ -73,7 +138,7 @@ func (j *Job) GetJobTemplatesByNameAndLocale(db interfaces.DB) (map[string]map[s
 	}
 
 	if len(templateByLocale) == 0 {
-		return nil, fmt.Errorf("No templates were found with name %s and %s", j.TemplateName, j.App.ID)
+		return nil, &TemplatesNotFoundError{TemplateName: j.TemplateName, AppID: j.App.ID}
 	}
 	return templateByLocale, nil
 }
@@ -24,6 +24,9 @@ package model
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/asaskevich/govalidator"
@@ -32,6 +35,180 @@ import (
 	"github.com/topfreegames/marathon/interfaces"
 )
 
+const versionRegex = `^\d+(\.\d+)*$`
+
+// LastActiveDaysFilter is the filter that keeps only the tokens updated in the last given days
+const LastActiveDaysFilter = "lastActiveDays"
+
+// ParseLastActiveDays returns the days of the lastActiveDays filter, which must be a positive integer
+// given as a number or a string
+func ParseLastActiveDays(val interface{}) (int, error) {
+	var days int
+	switch v := val.(type) {
+	case string:
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be an integer, got '%s'", LastActiveDaysFilter, v)
+		}
+		days = parsed
+	case float64:
+		days = int(v)
+		if float64(days) != v {
+			return 0, fmt.Errorf("%s must be an integer, got %v", LastActiveDaysFilter, v)
+		}
+	default:
+		return 0, fmt.Errorf("%s must be an integer, got %T", LastActiveDaysFilter, val)
+	}
+	if days <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", LastActiveDaysFilter, days)
+	}
+	return days, nil
+}
+
+// FilterColumns are the columns of the push tables that the filters of a job can match, the worker also
+// checks that the push table of the job app and service has them
+var FilterColumns = []string{"user_id", "region", "locale", "tz", "adid", "fiu", "vendor_id", "app_version"}
+
+// NegatedFilterPrefix is the prefix of the filters that match the tokens whose column is none of the values
+const NegatedFilterPrefix = "NOT"
+
+// ParseFilterKey returns the column of a filter and whether it is negated, the column must be one of
+// FilterColumns as it is written into the query
+func ParseFilterKey(key string) (string, bool, error) {
+	column := strings.TrimPrefix(key, NegatedFilterPrefix)
+	for _, allowed := range FilterColumns {
+		if column == allowed {
+			return column, column != key, nil
+		}
+	}
+	return "", false, fmt.Errorf(
+		"unsupported filter '%s', it must be one of %s, optionally prefixed with %s",
+		key, strings.Join(FilterColumns, ", "), NegatedFilterPrefix,
+	)
+}
+
+// Filter operators, the values of a filter are compared for equality, matched with IN or matched as a
+// range with BETWEEN
+const (
+	FilterOperatorEqual   = "="
+	FilterOperatorIn      = "IN"
+	FilterOperatorBetween = "BETWEEN"
+)
+
+// BetweenFilterKey is the key of a filter value such as {"between": ["-0300", "+0000"]}, that matches the
+// tokens whose column is a number in the range, both ends included, the columns hold text such as the
+// "-0300" offsets of tz so the tokens whose column isn't a number match neither the range nor its negation
+const BetweenFilterKey = "between"
+
+// ParseFilterValue returns the operator and the values of a filter: a string matches each of its comma
+// separated values, a list matches its values with IN and {"between": [min, max]} matches the range,
+// whose ends are returned as numbers
+func ParseFilterValue(key string, val interface{}) (string, []string, error) {
+	switch v := val.(type) {
+	case string:
+		return FilterOperatorEqual, strings.Split(v, ","), nil
+	case []interface{}:
+		if len(v) == 0 {
+			return "", nil, fmt.Errorf("filter '%s' must have at least one value", key)
+		}
+		values, err := parseFilterList(key, v)
+		if err != nil {
+			return "", nil, err
+		}
+		return FilterOperatorIn, values, nil
+	case map[string]interface{}:
+		rangeVal, ok := v[BetweenFilterKey].([]interface{})
+		if !ok || len(v) != 1 || len(rangeVal) != 2 {
+			return "", nil, fmt.Errorf("filter '%s' must be {\"%s\": [min, max]}", key, BetweenFilterKey)
+		}
+		values, err := parseFilterRange(key, rangeVal)
+		if err != nil {
+			return "", nil, err
+		}
+		return FilterOperatorBetween, values, nil
+	}
+	return "", nil, fmt.Errorf("filter '%s' must be a string, a list or a range, got %T", key, val)
+}
+
+func parseFilterList(key string, list []interface{}) ([]string, error) {
+	values := make([]string, len(list))
+	for i, item := range list {
+		value, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("values of filter '%s' must be strings, got %T", key, item)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func parseFilterRange(key string, rangeVal []interface{}) ([]string, error) {
+	bounds := make([]float64, len(rangeVal))
+	for i, item := range rangeVal {
+		var err error
+		switch v := item.(type) {
+		case float64:
+			bounds[i] = v
+		case string:
+			bounds[i], err = strconv.ParseFloat(v, 64)
+		default:
+			err = fmt.Errorf("%T is not a number", item)
+		}
+		if err != nil || math.IsNaN(bounds[i]) || math.IsInf(bounds[i], 0) {
+			return nil, fmt.Errorf("range of filter '%s' must be numbers, got %v", key, item)
+		}
+	}
+	if bounds[0] > bounds[1] {
+		return nil, fmt.Errorf("range of filter '%s' must have min <= max, got %v", key, rangeVal)
+	}
+	values := make([]string, len(bounds))
+	for i, bound := range bounds {
+		values[i] = strconv.FormatFloat(bound, 'f', -1, 64)
+	}
+	return values, nil
+}
+
+// MapFilterValue returns the value of a filter with f applied to each of its strings, keeping its operator
+func MapFilterValue(val interface{}, f func(string) string) interface{} {
+	switch v := val.(type) {
+	case string:
+		return f(v)
+	case []interface{}:
+		mapped := make([]interface{}, len(v))
+		for i, item := range v {
+			mapped[i] = MapFilterValue(item, f)
+		}
+		return mapped
+	case map[string]interface{}:
+		mapped := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			mapped[k] = MapFilterValue(item, f)
+		}
+		return mapped
+	}
+	return val
+}
+
+// ValidateFilters checks that every filter matches a column name with a valid value, or is a valid
+// lastActiveDays filter
+func ValidateFilters(filters map[string]interface{}) error {
+	for key, val := range filters {
+		if key == LastActiveDaysFilter {
+			if _, err := ParseLastActiveDays(val); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, _, err := ParseFilterKey(key); err != nil {
+			return err
+		}
+		if _, _, err := ParseFilterValue(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Job is the job model struct
 type Job struct {
 	ID                  uuid.UUID              `sql:",pk" json:"id"`
@@ -45,6 +222,7 @@ type Job struct {
 	Localized           bool                   `json:"localized"`
 	CompletedAt         int64                  `json:"completedAt"`
 	ExpiresAt           int64                  `json:"expiresAt"`
+	PushExpiry          int64                  `json:"pushExpiry"`
 	StartsAt            int64                  `json:"startsAt"`
 	Context             map[string]interface{} `json:"context"`
 	Service             string                 `json:"service"`
@@ -63,6 +241,15 @@ type Job struct {
 	CreatedAt           int64                  `json:"createdAt"`
 	UpdatedAt           int64                  `json:"updatedAt"`
 	StatusEvents        []*Status              `json:"statusEvents"`
+	VersionTemplates    []VersionTemplate      `json:"versionTemplates"`
+}
+
+// VersionTemplate selects a template for the tokens whose app version is in [MinVersion, MaxVersion),
+// an empty bound is open
+type VersionTemplate struct {
+	MinVersion   string `json:"minVersion"`
+	MaxVersion   string `json:"maxVersion"`
+	TemplateName string `json:"templateName"`
 }
 
 // Validate implementation of the InputValidation interface
@@ -77,6 +264,11 @@ func (j *Job) Validate(c echo.Context) error {
 		return InvalidField("expiresAt")
 	}
 
+	valid = j.PushExpiry >= 0
+	if !valid {
+		return InvalidField("pushExpiry")
+	}
+
 	valid = j.StartsAt == 0 || j.Localized || time.Now().UnixNano() < j.StartsAt
 	if !valid {
 		return InvalidField("startsAt")
@@ -97,6 +289,19 @@ func (j *Job) Validate(c echo.Context) error {
 		return InvalidField("filters or csvPath must exist, not both")
 	}
 
+	if err := ValidateFilters(j.Filters); err != nil {
+		return InvalidField(fmt.Sprintf("filters: %s", err.Error()))
+	}
+
+	for _, vt := range j.VersionTemplates {
+		valid = !govalidator.IsNull(vt.TemplateName) &&
+			(vt.MinVersion == "" || govalidator.StringMatches(vt.MinVersion, versionRegex)) &&
+			(vt.MaxVersion == "" || govalidator.StringMatches(vt.MaxVersion, versionRegex))
+		if !valid {
+			return InvalidField("versionTemplates")
+		}
+	}
+
 	if !govalidator.IsNull(j.CSVPath) && govalidator.Contains(j.CSVPath, "s3://") {
 		return InvalidField("csvPath: cannot contain s3 protocol, just the bucket path")
 	}
@@ -23,11 +23,123 @@
 package model
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
 	"github.com/asaskevich/govalidator"
 	"github.com/labstack/echo/v4"
 	"github.com/satori/go.uuid"
+	"github.com/valyala/fasttemplate"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
 )
 
+// textTemplateRegex matches the text/template actions that the simple {{var}} substitution can't express
+var textTemplateRegex = regexp.MustCompile(`{{-?\s*(if|else|end|range|with|plural)\b`)
+
+// TemplateFuncs are the functions available to text/template bodies, none of them has side effects.
+// Bodies are rendered with the plural function of the template locale, see LocaleFuncs
+var TemplateFuncs = LocaleFuncs("")
+
+// LocaleFuncs returns TemplateFuncs with the plural function of the locale
+func LocaleFuncs(locale string) template.FuncMap {
+	tag := pluralLanguage(locale)
+	return template.FuncMap{
+		"default": func(def, val interface{}) interface{} {
+			if val == nil || val == "" {
+				return def
+			}
+			return val
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+		"plural": func(count interface{}, forms ...string) string {
+			return Plural(tag, count, forms...)
+		},
+	}
+}
+
+// pluralLanguage parses the template locale, also in the underscore form (pt_BR), falling back to
+// english whose plural rules the forms of a template without a known locale most likely follow
+func pluralLanguage(locale string) language.Tag {
+	tag, err := language.Parse(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+	if err != nil || tag == language.Und {
+		return language.English
+	}
+	return tag
+}
+
+// Plural returns the form of a word for count, forms are either one and other
+// ({{plural .count "message" "messages"}}) or zero, one and other
+// ({{plural .count "no messages" "message" "messages"}}). The form for one is picked when count
+// is in the CLDR one category of the locale, e.g. 0 and 1 in french but only 1 in english, and
+// the form for zero only when count is 0. The locales with more categories, e.g. few and many
+// in russian and polish, use the form for other in them
+func Plural(tag language.Tag, count interface{}, forms ...string) string {
+	if len(forms) == 0 {
+		return ""
+	}
+	n, ok := pluralCount(count)
+	if len(forms) >= 3 && ok && n == 0 {
+		return forms[len(forms)-3]
+	}
+	if len(forms) >= 2 && ok && pluralForm(tag, n) == plural.One {
+		return forms[len(forms)-2]
+	}
+	return forms[len(forms)-1]
+}
+
+// pluralForm returns the CLDR cardinal category of n in the language, the operands are taken from n
+// as it is written without trailing zeros
+func pluralForm(tag language.Tag, n float64) plural.Form {
+	digits := strconv.FormatFloat(math.Abs(n), 'f', -1, 64)
+	intPart, fraction := digits, ""
+	if idx := strings.Index(digits, "."); idx >= 0 {
+		intPart, fraction = digits[:idx], digits[idx+1:]
+	}
+	i, err := strconv.Atoi(intPart)
+	if err != nil {
+		return plural.Other
+	}
+	f := 0
+	if fraction != "" {
+		if f, err = strconv.Atoi(fraction); err != nil {
+			return plural.Other
+		}
+	}
+	return plural.Cardinal.MatchPlural(tag, i, len(fraction), len(fraction), f, f)
+}
+
+func pluralCount(count interface{}) (float64, bool) {
+	switch v := count.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// IsTextTemplate returns whether a body value has control structures and is rendered with text/template
+func IsTextTemplate(value string) bool {
+	return textTemplateRegex.MatchString(value)
+}
+
 // Template is the template model struct
 type Template struct {
 	ID        uuid.UUID              `sql:",pk" json:"id"`
@@ -56,5 +168,285 @@ func (t *Template) Validate(c echo.Context) error {
 	if !valid {
 		return InvalidField("body")
 	}
+	return t.Compile()
+}
+
+// Compile checks that the body can be rendered: values with control structures must parse as
+// text/template and the other tags must be closed. The keys can be sent in the job context,
+// so they are only resolved when the job is sent
+func (t *Template) Compile() error {
+	if err := compileValue("body", t.Body); err != nil {
+		return err
+	}
+	body, err := json.Marshal(t.Body)
+	if err != nil {
+		return fmt.Errorf("invalid body: %s", err.Error())
+	}
+	if _, err := fasttemplate.NewTemplate(string(body), "{{", "}}"); err != nil {
+		return fmt.Errorf("invalid body: %s", err.Error())
+	}
+	return nil
+}
+
+func compileValue(path string, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if !IsTextTemplate(v) {
+			return nil
+		}
+		if _, err := template.New(path).Funcs(TemplateFuncs).Parse(v); err != nil {
+			return fmt.Errorf("invalid %s: %s", path, err.Error())
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			if err := compileValue(fmt.Sprintf("%s.%s", path, key), item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for idx, item := range v {
+			if err := compileValue(fmt.Sprintf("%s[%d]", path, idx), item); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// Policies for template keys that neither the context nor the defaults resolve
+const (
+	// MissingKeyDefault uses the template and inline defaults, keys without a default render empty
+	MissingKeyDefault = "default"
+	// MissingKeyEmpty renders the keys resolved by neither the context nor a default empty, the same
+	// as MissingKeyDefault
+	MissingKeyEmpty = "empty"
+	// MissingKeyError uses the template and inline defaults and fails if any key is left unresolved
+	MissingKeyError = "error"
+)
+
+// Render renders the body of the template to json with the context merged over the defaults,
+// it fails if a key is left unresolved. Body values with control structures, e.g.
+// {{if .premium}}...{{end}}, are rendered with text/template, the others use the simple {{var}} substitution
+func (t *Template) Render(context map[string]interface{}) (string, error) {
+	return t.RenderWithPolicy(context, MissingKeyError)
+}
+
+// RenderWithPolicy renders the body of the template like Render handling the keys that are
+// missing from the context with missingKeyPolicy
+func (t *Template) RenderWithPolicy(context map[string]interface{}, missingKeyPolicy string) (string, error) {
+	switch missingKeyPolicy {
+	case MissingKeyDefault, MissingKeyEmpty, MissingKeyError:
+	default:
+		return "", fmt.Errorf("invalid missing key policy '%s'", missingKeyPolicy)
+	}
+	substitutions := make(map[string]interface{})
+	for k, v := range t.Defaults {
+		substitutions[k] = v
+	}
+	for k, v := range context {
+		substitutions[k] = v
+	}
+
+	renderedBody, err := renderValue(t.Body, t.Locale, substitutions, missingKeyPolicy == MissingKeyError)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(renderedBody)
+	if err != nil {
+		return "", err
+	}
+	ft, err := fasttemplate.NewTemplate(string(body), "{{", "}}")
+	if err != nil {
+		return "", err
+	}
+
+	missingKeys := []string{}
+	message := ft.ExecuteFuncString(func(w io.Writer, tag string) (int, error) {
+		if val, ok := substitutions[tag]; ok {
+			return writeSubstitution(w, val)
+		}
+		// tags may carry an inline default, e.g. {{city:your city}}
+		if idx := strings.Index(tag, ":"); idx >= 0 {
+			if val, ok := substitutions[tag[:idx]]; ok {
+				return writeSubstitution(w, val)
+			}
+			return w.Write([]byte(tag[idx+1:]))
+		}
+		missingKeys = append(missingKeys, tag)
+		return 0, nil
+	})
+	if missingKeyPolicy == MissingKeyError && len(missingKeys) > 0 {
+		return "", fmt.Errorf("unresolved template keys: %s", strings.Join(missingKeys, ", "))
+	}
+	return message, nil
+}
+
+// renderValue renders the strings with control structures found in value with text/template,
+// with the functions of the locale, missing keys render empty unless missingKeyError is set
+func renderValue(value interface{}, locale string, data map[string]interface{}, missingKeyError bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if !IsTextTemplate(v) {
+			return v, nil
+		}
+		t, err := parseValue(v, locale, missingKeyError)
+		if err != nil {
+			return nil, err
+		}
+		if !missingKeyError {
+			data = withMissingKeys(t, data)
+		}
+		var rendered bytes.Buffer
+		if err := t.Execute(&rendered, data); err != nil {
+			return nil, err
+		}
+		return rendered.String(), nil
+	case map[string]interface{}:
+		renderedMap := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered, err := renderValue(item, locale, data, missingKeyError)
+			if err != nil {
+				return nil, err
+			}
+			renderedMap[key] = rendered
+		}
+		return renderedMap, nil
+	case []interface{}:
+		renderedSlice := make([]interface{}, len(v))
+		for idx, item := range v {
+			rendered, err := renderValue(item, locale, data, missingKeyError)
+			if err != nil {
+				return nil, err
+			}
+			renderedSlice[idx] = rendered
+		}
+		return renderedSlice, nil
+	default:
+		return v, nil
+	}
+}
+
+// maxParsedValues bounds parsedValues, it is cleared when it is full
+const maxParsedValues = 1024
+
+// parsedValues keeps the text/template body values by their source, locale and missing key option, so a job
+// parses each of its values once instead of once per token. Parsed templates are safe to execute
+// concurrently
+var (
+	parsedValuesLock sync.Mutex
+	parsedValues     = map[string]*template.Template{}
+)
+
+func parseValue(source, locale string, missingKeyError bool) (*template.Template, error) {
+	missingKey := "missingkey=default"
+	if missingKeyError {
+		missingKey = "missingkey=error"
+	}
+	key := strings.Join([]string{missingKey, locale, source}, "\x00")
+	parsedValuesLock.Lock()
+	t, ok := parsedValues[key]
+	parsedValuesLock.Unlock()
+	if ok {
+		return t, nil
+	}
+	t, err := template.New("body").Funcs(LocaleFuncs(locale)).Option(missingKey).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	parsedValuesLock.Lock()
+	if len(parsedValues) >= maxParsedValues {
+		parsedValues = map[string]*template.Template{}
+	}
+	parsedValues[key] = t
+	parsedValuesLock.Unlock()
+	return t, nil
+}
+
+// withMissingKeys returns data with the keys that t references and data doesn't have set to an empty
+// string, text/template would print them as <no value>
+func withMissingKeys(t *template.Template, data map[string]interface{}) map[string]interface{} {
+	var filled map[string]interface{}
+	for _, key := range referencedKeys(t.Tree.Root, nil) {
+		if val, ok := data[key]; ok && val != nil {
+			continue
+		}
+		if filled == nil {
+			filled = make(map[string]interface{}, len(data)+1)
+			for k, v := range data {
+				filled[k] = v
+			}
+		}
+		filled[key] = ""
+	}
+	if filled == nil {
+		return data
+	}
+	return filled
+}
+
+// referencedKeys appends the keys of the data that the node and its children reference, as .key or $.key
+func referencedKeys(node parse.Node, keys []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return keys
+		}
+		for _, child := range n.Nodes {
+			keys = referencedKeys(child, keys)
+		}
+	case *parse.ActionNode:
+		keys = referencedKeys(n.Pipe, keys)
+	case *parse.IfNode:
+		keys = referencedBranchKeys(&n.BranchNode, keys)
+	case *parse.RangeNode:
+		keys = referencedBranchKeys(&n.BranchNode, keys)
+	case *parse.WithNode:
+		keys = referencedBranchKeys(&n.BranchNode, keys)
+	case *parse.TemplateNode:
+		keys = referencedKeys(n.Pipe, keys)
+	case *parse.PipeNode:
+		if n == nil {
+			return keys
+		}
+		for _, cmd := range n.Cmds {
+			keys = referencedKeys(cmd, keys)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			keys = referencedKeys(arg, keys)
+		}
+	case *parse.ChainNode:
+		keys = referencedKeys(n.Node, keys)
+	case *parse.FieldNode:
+		keys = append(keys, n.Ident[0])
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			keys = append(keys, n.Ident[1])
+		}
+	}
+	return keys
+}
+
+func referencedBranchKeys(n *parse.BranchNode, keys []string) []string {
+	keys = referencedKeys(n.Pipe, keys)
+	keys = referencedKeys(n.List, keys)
+	return referencedKeys(n.ElseList, keys)
+}
+
+// writeSubstitution writes the value escaped for the json string that contains the tag
+func writeSubstitution(w io.Writer, val interface{}) (int, error) {
+	var s string
+	switch v := val.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	escaped, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(escaped[1 : len(escaped)-1])
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2017 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// UserToken is a row of the push table of an app and service, it keeps the token of a user between
+// reading it from the push database and sending it in a batch
+type UserToken struct {
+	UserID string `json:"user_id,omitempty" sql:"user_id"`
+	Token  string `json:"token,omitempty" sql:"token"`
+	Locale string `json:"locale,omitempty" sql:"locale"`
+	Region string `json:"region,omitempty" sql:"region"`
+	Tz     string `json:"tz,omitempty" sql:"tz"`
+	// Service overrides the job service for this token, leave it empty to use the job's
+	Service string `json:"service,omitempty" sql:"service"`
+	// AppVersion is only fetched for jobs with version templates
+	AppVersion string `json:"app_version,omitempty" sql:"app_version"`
+	// UpdatedAt is when the token was last refreshed, it is only used to query the push table and is
+	// left out of the batches
+	UpdatedAt time.Time `json:"-" sql:"updated_at"`
+}
+
+// LastActiveColumn is the push table column of UserToken.UpdatedAt, which the lastActiveDays filter matches
+var LastActiveColumn = userTokenColumn("UpdatedAt")
+
+// userTokenColumn returns the push table column of a UserToken field from its sql tag
+func userTokenColumn(fieldName string) string {
+	field, ok := reflect.TypeOf(UserToken{}).FieldByName(fieldName)
+	if !ok {
+		panic(fmt.Sprintf("UserToken has no field %s", fieldName))
+	}
+	return strings.Split(field.Tag.Get("sql"), ",")[0]
+}
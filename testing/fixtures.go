@@ -235,6 +235,8 @@ func CreateTestJob(db interfaces.DB, appID uuid.UUID, templateName string, optio
 	job.CSVPath = getOpt(opts, "csvPath", "").(string)
 	job.PastTimeStrategy = getOpt(opts, "pastTimeStrategy", "").(string)
 	job.ExpiresAt = getOpt(opts, "expiresAt", time.Now().Add(time.Hour).UnixNano()).(int64)
+	job.PushExpiry = getOpt(opts, "pushExpiry", int64(0)).(int64)
+	job.VersionTemplates = getOpt(opts, "versionTemplates", []model.VersionTemplate{}).([]model.VersionTemplate)
 	job.CreatedBy = getOpt(opts, "createdBy", fmt.Sprintf("%s@test.com", strings.Split(uuid.NewV4().String(), "-")[0])).(string)
 	job.StartsAt = getOpt(opts, "startsAt", time.Now().Add(time.Hour).UnixNano()).(int64)
 
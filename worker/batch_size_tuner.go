@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+// BatchSizeTuner adjusts a page size toward a target amount of bytes per page
+// based on the observed size of the rows, keeping memory roughly constant
+type BatchSizeTuner struct {
+	TargetBytes int64
+	MinSize     uint64
+	MaxSize     uint64
+	// SampleEvery is how many pages share one measure, only the first of them is measured so the rows
+	// aren't scanned twice for every page, 0 or 1 measures every page
+	SampleEvery int
+
+	size  uint64
+	pages int
+}
+
+// NewBatchSizeTuner returns a new BatchSizeTuner starting at the given page size
+func NewBatchSizeTuner(initialSize uint64, targetBytes int64, minSize, maxSize uint64) *BatchSizeTuner {
+	t := &BatchSizeTuner{
+		TargetBytes: targetBytes,
+		MinSize:     minSize,
+		MaxSize:     maxSize,
+	}
+	t.size = t.clamp(initialSize)
+	return t
+}
+
+// Size returns the current page size
+func (t *BatchSizeTuner) Size() uint64 {
+	return t.size
+}
+
+// ShouldObserve returns whether the next page must be measured and passed to Observe, which is
+// true for the first page and then once every SampleEvery pages
+func (t *BatchSizeTuner) ShouldObserve() bool {
+	observe := t.SampleEvery <= 1 || t.pages%t.SampleEvery == 0
+	t.pages++
+	return observe
+}
+
+// Observe records that a page had the given number of rows and bytes and returns the next page size,
+// the size moves halfway toward the ideal one so a single odd page doesn't make it swing
+func (t *BatchSizeTuner) Observe(rows int, bytes int64) uint64 {
+	if rows <= 0 || bytes <= 0 {
+		return t.size
+	}
+	// the page may have gaps, so the ideal size is relative to the current one and not to the rows
+	ideal := uint64(float64(t.size) * float64(t.TargetBytes) / float64(bytes))
+	t.size = t.clamp((t.size + ideal) / 2)
+	return t.size
+}
+
+func (t *BatchSizeTuner) clamp(size uint64) uint64 {
+	if size < t.MinSize {
+		return t.MinSize
+	}
+	if t.MaxSize > 0 && size > t.MaxSize {
+		return t.MaxSize
+	}
+	return size
+}
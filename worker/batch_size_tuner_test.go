@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permifsion is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/marathon/worker"
+)
+
+var _ = Describe("Batch size tuner", func() {
+	Describe("Observe", func() {
+		It("should converge the page size toward the target bytes", func() {
+			rowBytes := int64(200)
+			targetBytes := int64(1000000)
+			tuner := worker.NewBatchSizeTuner(100000, targetBytes, 10, 1000000)
+			for i := 0; i < 20; i++ {
+				size := tuner.Size()
+				tuner.Observe(int(size), int64(size)*rowBytes)
+			}
+			Expect(tuner.Size()).To(BeNumerically("~", targetBytes/rowBytes, 10))
+		})
+
+		It("should grow the page size if rows are narrow", func() {
+			tuner := worker.NewBatchSizeTuner(1000, 1000000, 10, 1000000)
+			next := tuner.Observe(1000, 10000)
+			Expect(next).To(BeNumerically(">", 1000))
+		})
+
+		It("should keep the page size within bounds", func() {
+			tuner := worker.NewBatchSizeTuner(1000, 1000000, 500, 2000)
+			for i := 0; i < 10; i++ {
+				tuner.Observe(1, 1)
+			}
+			Expect(tuner.Size()).To(BeEquivalentTo(2000))
+			for i := 0; i < 10; i++ {
+				tuner.Observe(1000, 1000000000)
+			}
+			Expect(tuner.Size()).To(BeEquivalentTo(500))
+		})
+
+		It("should keep the page size if the page was empty", func() {
+			tuner := worker.NewBatchSizeTuner(1000, 1000000, 10, 1000000)
+			Expect(tuner.Observe(0, 0)).To(BeEquivalentTo(1000))
+		})
+	})
+
+	Describe("ShouldObserve", func() {
+		It("should observe the first page and then one of every SampleEvery pages", func() {
+			tuner := worker.NewBatchSizeTuner(1000, 1000000, 10, 1000000)
+			tuner.SampleEvery = 3
+			observed := []bool{}
+			for i := 0; i < 7; i++ {
+				observed = append(observed, tuner.ShouldObserve())
+			}
+			Expect(observed).To(Equal([]bool{true, false, false, true, false, false, true}))
+		})
+
+		It("should observe every page if SampleEvery is not set", func() {
+			tuner := worker.NewBatchSizeTuner(1000, 1000000, 10, 1000000)
+			for i := 0; i < 3; i++ {
+				Expect(tuner.ShouldObserve()).To(BeTrue())
+			}
+		})
+	})
+})
@@ -28,7 +28,6 @@ import (
 	"encoding/json"
 	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
-	"math"
 	"math/rand"
 	"time"
 
@@ -100,11 +99,13 @@ func (b *CreateBatchesWorker) updateCompletedAt(unixTime int64, job *model.Job)
 	b.checkErr(job, err)
 }
 
-func (b *CreateBatchesWorker) getUserBatchFromPG(userIds *[]string, job *model.Job) *[]User {
-	var users []User
+func (b *CreateBatchesWorker) getUserBatchFromPG(userIds *[]string, job *model.Job) *[]model.UserToken {
+	var users []model.UserToken
+	tableName := GetPushDBTableName(job.App.Name, job.Service)
+	tableColumns := b.Workers.getCachedPushTableColumns(tableName)
 	start := time.Now()
-	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s WHERE user_id IN (?)", GetPushDBTableName(job.App.Name, job.Service))
-	_, err := b.Workers.PushDB.Query(&users, query, pg.In(*userIds))
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id IN (?)", GetUsersColumns(job, tableColumns), tableName)
+	_, err := b.Workers.PushReadDB.Query(&users, query, pg.In(*userIds))
 	b.Workers.Statsd.Timing("get_csv_batch_from_pg", time.Now().Sub(start), job.Labels(), 1)
 
 	b.checkErr(job, err)
@@ -131,7 +132,7 @@ func (b *CreateBatchesWorker) processBatch(ids *[]string, job *model.Job) {
 	}
 }
 
-func (b *CreateBatchesWorker) sendBatches(users []User, job *model.Job) {
+func (b *CreateBatchesWorker) sendBatches(users []model.UserToken, job *model.Job) {
 	l := b.Logger
 	log.I(l, "sending batch of users to process batches worker", func(cm log.CM) {
 		cm.Write(zap.Int("numUsers", len(users)))
@@ -149,11 +150,16 @@ func (b *CreateBatchesWorker) updateTotalUsers(job *model.Job, totalUsers int) {
 func (b *CreateBatchesWorker) processIDs(userIds []string, msg *BatchPart) {
 	l := b.Logger
 	// create a controll group if needed
-	controlGroupSize := int(math.Ceil(float64(len(userIds)) * msg.Job.ControlGroup))
+	controlGroupSize, err := GetControlGroupSize(len(userIds), msg.Job.ControlGroup)
+	if err != nil {
+		// a part with few users can round its control group up to all of them, it is sent without one
+		// instead of dropping its users
+		log.W(l, "part is too small for the control group, sending it without one", func(cm log.CM) {
+			cm.Write(zap.Int("users", len(userIds)), zap.Error(err))
+		})
+		controlGroupSize = 0
+	}
 	if controlGroupSize > 0 {
-		if controlGroupSize >= len(userIds) {
-			panic("control group size cannot be higher than number of users")
-		}
 		log.I(l, "this job has a control group!", func(cm log.CM) {
 			cm.Write(
 				zap.Int("controlGroupSize", controlGroupSize),
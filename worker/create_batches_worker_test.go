@@ -129,11 +129,11 @@ user_id
 		CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
 			"context": context,
 		})
-		users := make([]worker.User, 2)
+		users := make([]model.UserToken, 2)
 		for index := range users {
 			id := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			users[index] = worker.User{
+			users[index] = model.UserToken{
 				UserID: id,
 				Token:  token,
 				Locale: "en",
@@ -28,7 +28,6 @@ import (
 	"encoding/json"
 	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
-	"math"
 	"math/rand"
 	"strings"
 	"time"
@@ -41,11 +40,16 @@ import (
 
 // DirectPartMsg saves information about a block to process
 type DirectPartMsg struct {
-	SmallestSeqID uint64 // not in the interval
-	BiggestSeqID  uint64 // in the interval
+	SmallestSeqID uint64 // in the interval
+	BiggestSeqID  uint64 // not in the interval
 	JobUUID       uuid.UUID
 }
 
+// PageID identifies the seq_id interval of the message among the pages of its job
+func (m DirectPartMsg) PageID() string {
+	return fmt.Sprintf("%d-%d", m.SmallestSeqID, m.BiggestSeqID)
+}
+
 const nameDirectWorker = "direct_worker"
 
 // DirectWorker is the DirectWorker struct
@@ -64,8 +68,7 @@ func NewDirectWorker(workers *Worker) *DirectWorker {
 	return b
 }
 
-func (b *DirectWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, expiresAt int64, templateName string) error {
-	pushExpiry := expiresAt / 1000000000 // convert from nanoseconds to seconds
+func (b *DirectWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, pushExpiry int64, templateName string) error {
 	switch service {
 	case "apns":
 		err := b.Workers.Kafka.SendAPNSPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
@@ -78,7 +81,7 @@ func (b *DirectWorker) sendToKafka(service, topic string, msg, messageMetadata m
 			return err
 		}
 	default:
-		panic("service should be in ['apns', 'gcm']")
+		return fmt.Errorf("service should be in ['apns', 'gcm'], got '%s'", service)
 	}
 	return nil
 }
@@ -98,19 +101,40 @@ func (b *DirectWorker) addCompletedBatch(job *model.Job) error {
 	return err
 }
 
+// movePageToPausedQueue keeps the page of a paused job so the ResumeJobWorker sends it when the job is resumed
+func (b *DirectWorker) movePageToPausedQueue(job *model.Job, msg DirectPartMsg) {
+	data, err := json.Marshal(msg)
+	b.checkErr(job, err)
+	key := pausedDirectPagesKey(job.ID)
+	_, err = b.Workers.RedisClient.RPush(key, string(data)).Result()
+	b.checkErr(job, err)
+	ttl, err := b.Workers.RedisClient.TTL(key).Result()
+	b.checkErr(job, err)
+	if ttl < 0 {
+		b.Workers.RedisClient.Expire(key, 7*24*time.Hour)
+	}
+}
+
 func (b *DirectWorker) checkComplete(job *model.Job) (bool, error) {
 	err := b.Workers.MarathonDB.Model(&job).Where("id = ?", job.ID).Select()
 	return job.CompletedBatches == job.TotalBatches, err
 }
 
-func (b *DirectWorker) getQuery(job *model.Job) string {
+// getQuery returns the query of the tokens of a page and the arguments of the placeholders of its
+// filters, which follow the seq_id bounds of the page
+func (b *DirectWorker) getQuery(job *model.Job, tableColumns []string) (string, []interface{}, error) {
 	filters := job.Filters
-	whereClause := GetWhereClauseFromFilters(filters)
-	query := fmt.Sprintf("SELECT user_id, token, locale, tz FROM %s WHERE seq_id >= ? AND seq_id < ?", GetPushDBTableName(job.App.Name, job.Service))
+	whereClause, args, err := GetWhereClauseFromFilters(filters)
+	if err != nil {
+		return "", nil, err
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE seq_id >= ? AND seq_id < ?", GetUsersColumns(job, tableColumns), GetPushDBTableName(job.App.Name, job.Service))
 	if (whereClause) != "" {
 		query = fmt.Sprintf("%s AND %s", query, whereClause)
 	}
-	return query
+	// the pages are disjoint seq_id ranges, ordering inside them makes which tokens a cancelled page
+	// sent and which duplicate the dedup keeps the same on every run
+	return fmt.Sprintf("%s ORDER BY seq_id", query), args, nil
 }
 
 // Process processes the messages sent to batch worker queue and send them to kafka
@@ -119,6 +143,14 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 		zap.String("worker", nameDirectWorker),
 	)
 
+	b.Workers.inFlight.Add(1)
+	defer b.Workers.inFlight.Done()
+
+	if b.Workers.IsStopping() {
+		// the page is retried later by another worker
+		return fmt.Errorf("worker is stopping")
+	}
+
 	var msg DirectPartMsg
 	data := message.Args().ToJson()
 	err := json.Unmarshal([]byte(data), &msg)
@@ -126,9 +158,11 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 
 	job, err := b.Workers.GetJob(msg.JobUUID)
 	checkErr(l, err)
+	b.Workers.TrackJob(job.ID)
+	defer b.Workers.UntrackJob(job.ID)
 	b.Workers.Statsd.Incr(DirectWorkerStart, job.Labels(), 1)
 
-	if job.ExpiresAt > 0 && job.ExpiresAt < time.Now().UnixNano() {
+	if IsJobExpired(job, time.Now()) {
 		log.I(l, "expired")
 		b.Workers.Statsd.Incr(DirectWorkerCompleted, job.Labels(), 1)
 		return nil
@@ -137,10 +171,12 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 	switch job.Status {
 	case "circuitbreak":
 		log.I(l, "circuit break")
+		b.movePageToPausedQueue(job, msg)
 		b.Workers.Statsd.Incr(DirectWorkerCompleted, job.Labels(), 1)
 		return nil
 	case "paused":
 		log.I(l, "paused")
+		b.movePageToPausedQueue(job, msg)
 		b.Workers.Statsd.Incr(DirectWorkerCompleted, job.Labels(), 1)
 		return nil
 	case "stopped":
@@ -151,23 +187,95 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 		log.D(l, "valid")
 	}
 
-	templatesByNameAndLocale, err := job.GetJobTemplatesByNameAndLocale(b.Workers.MarathonDB)
+	resume := b.Workers.Config.GetBool("workers.direct.resume")
+	if resume {
+		completed, err := b.Workers.IsPageCompleted(job.ID, msg.PageID())
+		if err != nil {
+			log.W(l, "failed to check if the page was completed", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+		}
+		if completed {
+			// the page was counted in the completed batches when it was sent
+			log.I(l, "page already completed")
+			b.Workers.Statsd.Incr(DirectWorkerCompleted, job.Labels(), 1)
+			return nil
+		}
+	}
+
+	templatesByNameAndLocale, err := b.Workers.GetJobTemplates(job)
 	b.checkErr(job, err)
 
 	topicTemplate := b.Workers.Config.GetString("workers.topicTemplate")
-	topic := BuildTopicName(job.App.Name, job.Service, topicTemplate)
+	// users may override the job service, so topics are built per service
+	topics := map[string]string{
+		job.Service: BuildTopicName(job.App.Name, job.Service, topicTemplate),
+	}
+	pushExpiry := GetPushExpiry(job, b.Workers.Config.GetInt64("workers.pushExpiry"))
+
+	tableColumns := b.Workers.getCachedPushTableColumns(GetPushDBTableName(job.App.Name, job.Service))
 
-	var users []User
+	var users []model.UserToken
 	start := time.Now()
 
-	q := b.getQuery(job)
-	r, err := b.Workers.PushDB.Query(&users, q, msg.SmallestSeqID, msg.BiggestSeqID)
+	q, filterArgs, err := b.getQuery(job, tableColumns)
+	if err != nil {
+		// a filter that isn't valid can't be sent to anyone, so the job is tagged instead of completing
+		// as if it had no tokens
+		job.TagError(b.Workers.MarathonDB, nameDirectWorker, err.Error())
+		b.Workers.Statsd.Incr(DirectWorkerError, job.Labels(), 1)
+		log.E(l, "invalid job filters", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return nil
+	}
+	args := append([]interface{}{msg.SmallestSeqID, msg.BiggestSeqID}, filterArgs...)
+	r, err := b.Workers.PushReadDB.Query(&users, q, args...)
 
 	if err != nil {
 		l.Error("Error fetching users", zap.Error(err))
 	}
 
-	b.Workers.Statsd.Timing(GetUsersFromDbTiming, time.Now().Sub(start), job.Labels(), 1)
+	stats := &stageStats{Fetch: time.Now().Sub(start)}
+	b.Workers.Statsd.Timing(GetUsersFromDbTiming, stats.Fetch, job.Labels(), 1)
+
+	if b.Workers.Config.GetBool("workers.dropEmptyTokens") {
+		var dropped int
+		users, dropped = DropUsersWithEmptyToken(users)
+		if dropped > 0 {
+			b.Workers.Statsd.Count(EmptyTokenDropped, int64(dropped), job.Labels(), 1)
+			log.W(l, "dropped users with empty token", func(cm log.CM) {
+				cm.Write(zap.Int("dropped", dropped))
+			})
+		}
+	}
+	if b.Workers.Config.GetBool("workers.postgres.dedup") {
+		var duplicated, sentByOtherPages int
+		users, duplicated = DropDuplicatedTokens(users)
+		users, sentByOtherPages, err = b.Workers.DropTokensOfOtherPages(job.ID, msg.PageID(), users)
+		if err != nil {
+			log.W(l, "failed to drop the tokens sent by other pages", func(cm log.CM) {
+				cm.Write(zap.Error(err))
+			})
+		}
+		if dropped := duplicated + sentByOtherPages; dropped > 0 {
+			b.Workers.Statsd.Count(DuplicatedTokenDropped, int64(dropped), job.Labels(), 1)
+			b.Workers.IncrJobStatus(job.ID, JobStatusDuplicatedTokens, int64(dropped))
+			log.D(l, "dropped users with duplicated token", func(cm log.CM) {
+				cm.Write(zap.Int("dropped", dropped))
+			})
+		}
+	}
+	if b.Workers.Config.GetBool("workers.locale.normalize") {
+		var normalized int
+		users, normalized = NormalizeUsersLocale(users, b.Workers.Config.GetString("workers.locale.default"))
+		if normalized > 0 {
+			b.Workers.Statsd.Count(LocaleNormalized, int64(normalized), job.Labels(), 1)
+			log.D(l, "normalized users locale", func(cm log.CM) {
+				cm.Write(zap.Int("normalized", normalized))
+			})
+		}
+	}
 
 	successfulUsers := len(users)
 
@@ -184,11 +292,16 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 	})
 
 	// create a controll group if needed
-	controlGroupSize := int(math.Ceil(float64(len(users)) * job.ControlGroup))
+	controlGroupSize, err := GetControlGroupSize(len(users), job.ControlGroup)
+	if err != nil {
+		// a page with few users can round its control group up to all of them, it is sent without a
+		// control group so the page still counts towards the completed batches of the job
+		log.W(l, "page is too small for the control group, sending it without one", func(cm log.CM) {
+			cm.Write(zap.Int("users", len(users)), zap.Error(err))
+		})
+		controlGroupSize = 0
+	}
 	if controlGroupSize > 0 {
-		if controlGroupSize >= len(users) {
-			panic("control group size cannot be higher than number of users")
-		}
 		// shuffle slice in place
 		for i := range users {
 			j := rand.Intn(i + 1)
@@ -205,7 +318,30 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 		users = append(users[:len(users)-controlGroupSize], users[len(users):]...)
 	}
 
-	for _, user := range users {
+	defaultLocale := b.Workers.Config.GetString("workers.templates.defaultLocale")
+	missingKeyPolicy := b.Workers.Config.GetString("workers.templates.missingKeyPolicy")
+	stats.Users = len(users)
+	cancelCheckInterval := b.Workers.Config.GetInt("workers.direct.cancelCheckInterval")
+	cancelled := false
+	expired := 0
+	for i, user := range users {
+		// a page that takes long to send must not send the pushes after the job expired
+		if IsJobExpired(job, time.Now()) {
+			expired = len(users) - i
+			successfulUsers -= expired
+			break
+		}
+		// a job stopped while the page is sent stops it, the pushes that were already produced are still delivered
+		if cancelCheckInterval > 0 && i > 0 && i%cancelCheckInterval == 0 {
+			if cancelled, _ = b.Workers.IsJobCancelled(job.ID); cancelled {
+				log.I(l, "job stopped while sending the page", func(cm log.CM) {
+					cm.Write(zap.Int("sent", i), zap.Int("skipped", len(users)-i))
+				})
+				successfulUsers -= len(users) - i
+				break
+			}
+		}
+		buildStart := time.Now()
 		templateName := job.TemplateName
 		templateNames := strings.Split(job.TemplateName, ",")
 
@@ -216,17 +352,20 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 			})
 		}
 
-		templatesByLocale := templatesByNameAndLocale[templateName]
-		var template model.Template
-		if val, ok := templatesByLocale[strings.ToLower(user.Locale)]; ok {
-			template = val
-		} else if val, ok := templatesByLocale["en"]; ok {
-			template = val
-		} else {
-			b.checkErr(job, fmt.Errorf("there is no template for the given locale or 'en'"))
+		if versionTemplateName := GetVersionTemplateName(job.VersionTemplates, user.AppVersion); versionTemplateName != "" {
+			templateName = versionTemplateName
+		}
+
+		template, matchedLocale, ok := FindTemplate(templatesByNameAndLocale[templateName], user.Locale, defaultLocale)
+		if !ok {
+			b.checkErr(job, fmt.Errorf("there is no template for the locale '%s' or '%s'", user.Locale, defaultLocale))
+		} else if matchedLocale != strings.ToLower(user.Locale) {
+			log.D(l, "template locale fallback", func(cm log.CM) {
+				cm.Write(zap.String("locale", user.Locale), zap.String("matchedLocale", matchedLocale))
+			})
 		}
 
-		msgStr, msgErr := BuildMessageFromTemplate(template, job.Context)
+		msgStr, msgErr := BuildMessageFromTemplateWithPolicy(template, job.Context, missingKeyPolicy)
 		b.checkErr(job, msgErr)
 
 		var msg map[string]interface{}
@@ -238,6 +377,7 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 			"pushTime":     time.Now().Unix(),
 			"templateName": templateName,
 			"jobId":        job.ID.String(),
+			"appName":      job.App.Name,
 			"pushType":     "massive",
 			"muid":         uuid.NewV4().String(),
 		}
@@ -248,8 +388,21 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 				pushMetadata["dryRun"] = dryRun
 			}
 		}
+		if collapseKey, ok := job.Metadata["collapseKey"].(string); ok && collapseKey != "" {
+			pushMetadata["collapseKey"] = collapseKey
+		}
+
+		service := GetUserService(user, job.Service)
+		userTopic, ok := topics[service]
+		if !ok {
+			userTopic = BuildTopicName(job.App.Name, service, topicTemplate)
+			topics[service] = userTopic
+		}
+		sendStart := time.Now()
+		stats.Build += sendStart.Sub(buildStart)
 
-		err = b.sendToKafka(job.Service, topic, msg, job.Metadata, pushMetadata, user.Token, job.ExpiresAt, templateName)
+		err = b.sendToKafka(service, userTopic, msg, job.Metadata, pushMetadata, user.Token, pushExpiry, templateName)
+		stats.Send += time.Now().Sub(sendStart)
 		if err != nil {
 			log.E(l, "error sending message to kafa", func(cm log.CM) {
 				cm.Write(zap.Error(err))
@@ -257,21 +410,37 @@ func (b *DirectWorker) Process(message *goworkers2.Msg) error {
 			successfulUsers--
 		}
 	}
+	stats.Sent = successfulUsers
+	if expired > 0 {
+		b.Workers.Statsd.Count(ExpiredTokenDropped, int64(expired), job.Labels(), 1)
+		b.Workers.IncrJobStatus(job.ID, JobStatusExpiredTokens, int64(expired))
+		log.I(l, "job expired while sending the page", func(cm log.CM) {
+			cm.Write(zap.Int("expired", expired))
+		})
+	}
 
 	// ignore errors
 	b.addCompletedTokens(job, successfulUsers)
+	b.Workers.IncrJobStatus(job.ID, JobStatusProcessedTokens, int64(successfulUsers))
+	if cancelled {
+		stats.report(b.Workers, l, job.Labels())
+		return nil
+	}
 	b.addCompletedBatch(job)
+	b.Workers.IncrJobStatus(job.ID, JobStatusProcessedPages, 1)
+	if resume {
+		b.Workers.MarkPageCompleted(job.ID, msg.PageID())
+	}
 	complete, _ := b.checkComplete(job)
 	if complete {
 		job.CompletedAt = time.Now().UnixNano()
 		_, err = b.Workers.MarathonDB.Model(&job).Column("completed_at").Update()
 
-		at := time.Now().Add(b.Workers.Config.GetDuration("workers.processBatch.intervalToSendCompletedJob")).UnixNano()
-		_, err = b.Workers.ScheduleJobCompletedJob(job.ID.String(), at)
+		err = b.Workers.finishJob(job)
 	}
 
 	b.Workers.Statsd.Incr(DirectWorkerCompleted, job.Labels(), 1)
-	l.Info("finished")
+	stats.report(b.Workers, l, job.Labels())
 
 	return nil
 }
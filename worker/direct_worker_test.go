@@ -21,9 +21,11 @@ package worker_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
 	"math/rand"
+	"sort"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -79,6 +81,8 @@ var _ = Describe("Complete Test", func() {
 		w.PushDB.Query(nil, `
 				DROP TABLE myapp_apns;
 			`)
+		// the table is created again by each test, so its columns can't be cached between them
+		w.Config.Set("workers.postgres.columnsTTL", "0s")
 		w.PushDB.Query(nil, `
 				CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;
 			`)
@@ -101,6 +105,46 @@ var _ = Describe("Complete Test", func() {
 		w.Kafka = producer
 	})
 
+	Describe("Create direct batches job", func() {
+		It("should fail with an unknown app error if the app has no push table", func() {
+			unknownApp := CreateTestApp(w.MarathonDB, map[string]interface{}{"name": "unknownapp"})
+			unknownTemplate := CreateTestTemplate(w.MarathonDB, unknownApp.ID, map[string]interface{}{"locale": "en"})
+			j := CreateTestJob(w.MarathonDB, unknownApp.ID, unknownTemplate.Name)
+
+			err := w.CreateDirectBatchesJob(j)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("unknown app unknownapp: there is no push table unknownapp_apns"))
+			queued, err := w.RedisClient.LLen("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(queued).To(BeZero())
+		})
+
+		It("should fail and tag the job if a filter is on a column the push table doesn't have", func() {
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters": map[string]interface{}{"app_version": "1.0"},
+			})
+
+			err := w.CreateDirectBatchesJob(j)
+			Expect(err).To(MatchError("unsupported filter 'app_version', the push table has no column app_version"))
+			queued, err := w.RedisClient.LLen("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(queued).To(BeZero())
+
+			var statuses []*model.Status
+			err = w.MarathonDB.Model(&statuses).Column("status.*", "Events").Where("job_id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Events).To(HaveLen(1))
+			Expect(statuses[0].Events[0].State).To(Equal("fail"))
+		})
+
+		It("should find the push table of the app", func() {
+			exists, err := w.PushTableExists("myapp_apns")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+		})
+	})
+
 	Describe("Process", func() {
 		It("create 10000 queries test", func() {
 			_, err := w.PushDB.Query(nil, `
@@ -191,5 +235,482 @@ var _ = Describe("Complete Test", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(dbJob.ControlGroupCSVPath).To(Equal(key))
 		})
+
+		It("should keep the total tokens snapshot when the job batches are created again", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 100) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+				ANALYZE myapp_apns;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			totalTokens := dbJob.TotalTokens
+			Expect(totalTokens).To(BeNumerically(">", 0))
+
+			_, err = w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(101, 300) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+				ANALYZE myapp_apns;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = w.CreateDirectBatchesJob(dbJob)
+			Expect(err).NotTo(HaveOccurred())
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.TotalTokens).To(Equal(totalTokens))
+		})
+
+		It("should send disjoint tokens in consecutive pages", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 100) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			pages := []worker.DirectPartMsg{
+				{SmallestSeqID: 0, BiggestSeqID: 51, JobUUID: j.ID},
+				{SmallestSeqID: 51, BiggestSeqID: 101, JobUUID: j.ID},
+			}
+			tokensByPage := []map[string]bool{}
+			for _, page := range pages {
+				_, err = w.Manager.Producer().Enqueue("direct_worker", "Add", page)
+				Expect(err).NotTo(HaveOccurred())
+				data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+				Expect(err).NotTo(HaveOccurred())
+				msg, err := goworkers2.NewMsg(data)
+				Expect(err).NotTo(HaveOccurred())
+
+				sent := len(producer.APNSMessages)
+				Expect(directWorker.Process(msg)).To(Succeed())
+
+				tokens := map[string]bool{}
+				for _, message := range producer.APNSMessages[sent:] {
+					var apnsMessage map[string]interface{}
+					Expect(json.Unmarshal([]byte(message), &apnsMessage)).To(Succeed())
+					tokens[apnsMessage["DeviceToken"].(string)] = true
+				}
+				tokensByPage = append(tokensByPage, tokens)
+			}
+
+			Expect(tokensByPage[0]).To(HaveLen(50))
+			Expect(tokensByPage[1]).To(HaveLen(50))
+			for token := range tokensByPage[0] {
+				Expect(tokensByPage[1]).NotTo(HaveKey(token))
+			}
+		})
+
+		It("should create pages with the same number of tokens using keyset pagination", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 1000, 10) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			w.Config.Set("workers.postgres.pagination", "keyset")
+			w.Config.Set("workers.postgres.autoTuneBatch", true)
+			w.Config.Set("workers.postgres.minPageSize", 25)
+			w.Config.Set("workers.postgres.maxPageSize", 25)
+			defer func() {
+				w.Config.Set("workers.postgres.pagination", "range")
+				w.Config.Set("workers.postgres.autoTuneBatch", false)
+				w.Config.Set("workers.postgres.minPageSize", 1000)
+				w.Config.Set("workers.postgres.maxPageSize", 1000000)
+			}()
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			runAllSteps(j)
+
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.TotalBatches).To(Equal(4))
+			Expect(len(producer.APNSMessages)).To(Equal(100))
+		})
+
+		It("should send every token exactly once across the pages", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 3000, 3) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			w.Config.Set("workers.postgres.autoTuneBatch", true)
+			w.Config.Set("workers.postgres.minPageSize", 70)
+			w.Config.Set("workers.postgres.maxPageSize", 70)
+			defer func() {
+				w.Config.Set("workers.postgres.autoTuneBatch", false)
+				w.Config.Set("workers.postgres.minPageSize", 1000)
+				w.Config.Set("workers.postgres.maxPageSize", 1000000)
+			}()
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			runAllSteps(j)
+
+			var tokens []string
+			_, err = w.PushDB.Query(&tokens, "SELECT token FROM myapp_apns")
+			Expect(err).NotTo(HaveOccurred())
+			sent := []string{}
+			for _, message := range producer.APNSMessages {
+				var apnsMessage map[string]interface{}
+				Expect(json.Unmarshal([]byte(message), &apnsMessage)).To(Succeed())
+				sent = append(sent, apnsMessage["DeviceToken"].(string))
+			}
+			Expect(sent).To(ConsistOf(tokens))
+		})
+
+		It("should skip the pages already completed when the job is resumed", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 3000) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			w.Config.Set("workers.direct.resume", true)
+			defer w.Config.Set("workers.direct.resume", false)
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := goworkers2.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directWorker.Process(msg)).To(Succeed())
+			sentBeforeResume := len(producer.APNSMessages)
+			Expect(sentBeforeResume).To(BeNumerically(">", 0))
+			w.RedisClient.Del("queue:direct_worker")
+
+			err = w.SetJobStatus(j.ID, map[string]string{"status": "interrupted"})
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": {j.ID},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			resumeMsg, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(worker.NewResumeJobWorker(w).Process(resumeMsg)).To(Succeed())
+			status, err := w.GetJobStatus(j.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status["status"]).To(Equal(""))
+			dataSlice, err := w.RedisClient.LRange("queue:direct_worker", 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			for _, data := range dataSlice {
+				msg, err := goworkers2.NewMsg(data)
+				Expect(err).NotTo(HaveOccurred())
+				directWorker.Process(msg)
+			}
+
+			Expect(len(producer.APNSMessages)).To(Equal(3000))
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedBatches).To(Equal(dbJob.TotalBatches))
+		})
+
+		It("should not resume an interrupted job when the completed pages aren't tracked", func() {
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err := w.SetJobStatus(j.ID, map[string]string{"status": "interrupted"})
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": {j.ID},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			resumeMsg, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(worker.NewResumeJobWorker(w).Process(resumeMsg)).To(Succeed())
+
+			status, err := w.GetJobStatus(j.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status["status"]).To(Equal("interrupted"))
+			res, err := w.RedisClient.LLen("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeZero())
+			Expect(w.ResumeDirectBatchesJob(j)).To(HaveOccurred())
+		})
+
+		It("should send only the tokens updated in the last days of the lastActiveDays filter", func() {
+			_, err := w.PushDB.Query(nil, `
+				ALTER TABLE myapp_apns ADD COLUMN updated_at timestamp NOT NULL DEFAULT now();
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz, updated_at)
+				VALUES
+					(1, 'active', 'active-token', 'en', 'us', '+0000', now() - interval '29 days 23 hours'),
+					(2, 'inactive', 'inactive-token', 'en', 'us', '+0000', now() - interval '30 days 1 hour');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"filters": map[string]interface{}{
+					"lastActiveDays": float64(30),
+				},
+			})
+			runAllSteps(j)
+
+			Expect(producer.APNSMessages).To(HaveLen(1))
+			var apnsMessage map[string]interface{}
+			Expect(json.Unmarshal([]byte(producer.APNSMessages[0]), &apnsMessage)).To(Succeed())
+			Expect(apnsMessage["DeviceToken"]).To(Equal("active-token"))
+		})
+
+		It("should send the tokens of another service to the topic of that service", func() {
+			_, err := w.PushDB.Query(nil, `
+				ALTER TABLE myapp_apns ADD COLUMN service varchar(255) NOT NULL DEFAULT '';
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz, service)
+				VALUES
+					(1, 'apns-user', 'apns-token', 'en', 'us', '+0000', ''),
+					(2, 'gcm-user', 'gcm-token', 'en', 'us', '+0000', 'gcm');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			runAllSteps(j)
+
+			topicTemplate := w.Config.GetString("workers.topicTemplate")
+			Expect(producer.APNSMessages).To(HaveLen(1))
+			Expect(producer.APNSTopics).To(Equal([]string{worker.BuildTopicName("myapp", "apns", topicTemplate)}))
+			Expect(producer.GCMMessages).To(HaveLen(1))
+			Expect(producer.GCMTopics).To(Equal([]string{worker.BuildTopicName("myapp", "gcm", topicTemplate)}))
+			var gcmMessage map[string]interface{}
+			Expect(json.Unmarshal([]byte(producer.GCMMessages[0]), &gcmMessage)).To(Succeed())
+			Expect(gcmMessage["to"]).To(Equal("gcm-token"))
+		})
+
+		It("should read the columns of the push table once per columnsTTL", func() {
+			w.Config.Set("workers.postgres.columnsTTL", "1h")
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1, 'apns-user', 'apns-token', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+			runAllSteps(CreateTestJob(w.MarathonDB, app.ID, template.Name))
+			Expect(producer.APNSMessages).To(HaveLen(1))
+
+			_, err = w.PushDB.Query(nil, `
+				ALTER TABLE myapp_apns ADD COLUMN service varchar(255) NOT NULL DEFAULT '';
+				UPDATE myapp_apns SET service = 'gcm';
+			`)
+			Expect(err).NotTo(HaveOccurred())
+			runAllSteps(CreateTestJob(w.MarathonDB, app.ID, template.Name))
+
+			// the service column was added after the columns were cached, so it isn't read yet
+			Expect(producer.APNSMessages).To(HaveLen(2))
+			Expect(producer.GCMMessages).To(BeEmpty())
+		})
+
+		It("should tag the job instead of sending the page if its filters are invalid", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1, 'user', 'token', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			j.Filters = map[string]interface{}{"region>=": "us"}
+			_, err = w.MarathonDB.Model(j).Column("filters").Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := goworkers2.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directWorker.Process(msg)).To(Succeed())
+
+			Expect(producer.APNSMessages).To(BeEmpty())
+			var statuses []*model.Status
+			err = w.MarathonDB.Model(&statuses).Column("status.*", "Events").Where("job_id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Events[0].State).To(Equal("fail"))
+			Expect(statuses[0].Events[0].Message).To(ContainSubstring("unsupported filter 'region>='"))
+		})
+
+		It("should finish the job without the job completed worker in dry run mode", func() {
+			w.Config.Set("workers.dryRun.enabled", true)
+			defer w.Config.Set("workers.dryRun.enabled", false)
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1, 'user', 'token', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			runAllSteps(j)
+
+			scheduled, err := w.RedisClient.ZCard("schedule").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled).To(BeZero())
+			count, err := w.MarathonDB.Model(&model.CampaignResult{}).Where("job_id = ?", j.ID).Count()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero())
+
+			var statuses []*model.Status
+			err = w.MarathonDB.Model(&statuses).Column("status.*", "Events").Where("job_id = ?", j.ID).Where("name = ?", "job_completed_worker").Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Events[0].State).To(Equal("success"))
+			Expect(statuses[0].Events[0].Message).To(Equal("finished in dry run mode"))
+		})
+
+		It("should send the page without a control group if the control group takes every user of the page", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				VALUES (1, 'user', 'token', 'en', 'us', '+0000');
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"controlGroup": 0.1,
+			})
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := goworkers2.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() { Expect(directWorker.Process(msg)).To(Succeed()) }).NotTo(Panic())
+
+			Expect(producer.APNSMessages).To(HaveLen(1))
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedBatches).To(Equal(dbJob.TotalBatches))
+		})
+
+		It("should keep the page of a paused job to send it when the job is resumed", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 100) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.MarathonDB.Model(&model.Job{}).Set("status = 'paused'").Where("id = ?", j.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := goworkers2.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directWorker.Process(msg)).To(Succeed())
+
+			Expect(producer.APNSMessages).To(BeEmpty())
+			pages, err := w.RedisClient.LRange(fmt.Sprintf("%s-pauseddirectpages", j.ID.String()), 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pages).To(HaveLen(1))
+			Expect(pages[0]).To(MatchJSON(msg.Args().ToJson()))
+		})
+
+		It("should stop sending a page when the job is cancelled", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					generate_series(1, 1000) AS seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					encode(gen_random_bytes(60), 'hex') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			w.Config.Set("workers.direct.cancelCheckInterval", 100)
+			defer w.Config.Set("workers.direct.cancelCheckInterval", 1000)
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			err = w.CreateDirectBatchesJob(j)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.CancelJob(j.ID)).To(Succeed())
+			data, err := w.RedisClient.LPop("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			msg, err := goworkers2.NewMsg(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(directWorker.Process(msg)).To(Succeed())
+
+			Expect(len(producer.APNSMessages)).To(Equal(100))
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", j.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedTokens).To(Equal(100))
+			Expect(dbJob.CompletedBatches).To(Equal(0))
+		})
+
+		It("should send the tokens of a page in seq_id order", func() {
+			_, err := w.PushDB.Query(nil, `
+				INSERT INTO myapp_apns (seq_id, user_id, token, locale, region, tz)
+				SELECT
+					seq_id,
+					encode(gen_random_bytes(20), 'hex') as user_id,
+					lpad(seq_id::text, 8, '0') AS token,
+					'en' as locale,
+					'us' as region,
+					'+0000' as tz
+				FROM (SELECT generate_series(200, 1, -1) AS seq_id) AS ids;
+			`)
+			Expect(err).NotTo(HaveOccurred())
+
+			j := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			runAllSteps(j)
+
+			sent := []string{}
+			for _, message := range producer.APNSMessages {
+				var apnsMessage map[string]interface{}
+				Expect(json.Unmarshal([]byte(message), &apnsMessage)).To(Succeed())
+				sent = append(sent, apnsMessage["DeviceToken"].(string))
+			}
+			Expect(sent).To(HaveLen(200))
+			Expect(sort.StringsAreSorted(sent)).To(BeTrue())
+		})
 	})
 })
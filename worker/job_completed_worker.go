@@ -27,6 +27,7 @@ import (
 	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
 	"io"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/email"
@@ -53,7 +54,9 @@ func NewJobCompletedWorker(workers *Worker) *JobCompletedWorker {
 	return b
 }
 
-func (b *JobCompletedWorker) flushControlGroup(job *model.Job) {
+// flushControlGroup uploads the control group of the job and returns how many users it has, the
+// campaign result counts the users of the csv so the two always agree
+func (b *JobCompletedWorker) flushControlGroup(job *model.Job) int {
 	hash := job.ID.String()
 	hash = fmt.Sprintf("%s-CONTROL", hash)
 	controlGroup, err := b.Workers.RedisClient.LRange(hash, 0, -1).Result()
@@ -76,6 +79,7 @@ func (b *JobCompletedWorker) flushControlGroup(job *model.Job) {
 
 	err = b.Workers.RedisClient.Del(hash).Err()
 	b.checkErr(job, err)
+	return len(controlGroup)
 }
 
 func (b *JobCompletedWorker) updateJobControlGroupCSVPath(job *model.Job, csvPath string) {
@@ -84,6 +88,24 @@ func (b *JobCompletedWorker) updateJobControlGroupCSVPath(job *model.Job, csvPat
 	b.checkErr(job, err)
 }
 
+func (b *JobCompletedWorker) saveCampaignResult(job *model.Job, droppedByReason map[string]interface{}) {
+	result := model.NewCampaignResult(job, droppedByReason)
+	result.ID = uuid.NewV4()
+	result.CreatedAt = time.Now().UnixNano()
+	// the worker may be retried, so the result of a job is overwritten instead of duplicated
+	_, err := b.Workers.MarathonDB.Model(result).
+		OnConflict("(job_id) DO UPDATE").
+		Set("total_tokens = EXCLUDED.total_tokens").
+		Set("completed_tokens = EXCLUDED.completed_tokens").
+		Set("failed_tokens = EXCLUDED.failed_tokens").
+		Set("dropped_by_reason = EXCLUDED.dropped_by_reason").
+		Set("started_at = EXCLUDED.started_at").
+		Set("finished_at = EXCLUDED.finished_at").
+		Set("duration = EXCLUDED.duration").
+		Insert()
+	b.checkErr(job, err)
+}
+
 // Process processes the messages sent to worker queue
 func (b *JobCompletedWorker) Process(message *goworkers2.Msg) error {
 	arr, err := message.Args().Array()
@@ -109,8 +131,16 @@ func (b *JobCompletedWorker) Process(message *goworkers2.Msg) error {
 		b.checkErr(job, err)
 	}
 
+	err = b.Workers.DeleteJobTokens(job.ID)
+	b.checkErr(job, err)
+
 	job.TagRunning(b.Workers.MarathonDB, nameJobCompleted, "sending control group")
-	b.flushControlGroup(job)
+	controlGroupSize := b.flushControlGroup(job)
+
+	job.TagRunning(b.Workers.MarathonDB, nameJobCompleted, "saving campaign result")
+	b.saveCampaignResult(job, map[string]interface{}{
+		"controlGroup": controlGroupSize,
+	})
 
 	job.TagSuccess(b.Workers.MarathonDB, nameJobCompleted, "finished")
 	b.Workers.Statsd.Incr(JobCompletedWorkerCompleted, job.Labels(), 1)
@@ -24,6 +24,7 @@ package worker_test
 
 import (
 	"encoding/json"
+	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
 
 	. "github.com/onsi/ginkgo"
@@ -72,6 +73,65 @@ var _ = Describe("JobCompleted Worker", func() {
 			}).ShouldNot(Panic())
 		})
 
+		It("should write the campaign result", func() {
+			_, err := w.MarathonDB.Model(job).Set("total_tokens = 10, completed_tokens = 8").Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{job.ID.String()}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			jobCompletedWorker.Process(message)
+
+			result := &model.CampaignResult{}
+			err = w.MarathonDB.Model(result).Where("job_id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.TotalTokens).To(Equal(10))
+			Expect(result.CompletedTokens).To(Equal(8))
+			Expect(result.FailedTokens).To(Equal(2))
+			Expect(result.DroppedByReason).To(HaveKey("controlGroup"))
+			Expect(result.CreatedAt).NotTo(BeZero())
+		})
+
+		It("should count the control group users that were uploaded", func() {
+			w.SendControlGroupToRedis(job, []string{"user-1", "user-2", "user-3"})
+			messageObj := []interface{}{job.ID.String()}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			jobCompletedWorker.Process(message)
+
+			result := &model.CampaignResult{}
+			err = w.MarathonDB.Model(result).Where("job_id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.DroppedByReason["controlGroup"]).To(BeEquivalentTo(3))
+		})
+
+		It("should delete the tokens claimed by the pages of the job", func() {
+			_, _, err := w.DropTokensOfOtherPages(job.ID, "1-10", []model.UserToken{{UserID: "a", Token: "token-a"}})
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{job.ID.String()}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			jobCompletedWorker.Process(message)
+
+			exists, err := w.RedisClient.Exists(fmt.Sprintf("%s-tokens", job.ID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
 		It("should not process when job is not found in db", func() {
 			_, err := w.MarathonDB.Exec("DELETE FROM jobs;")
 			Expect(err).NotTo(HaveOccurred())
@@ -1,5 +1,12 @@
 package worker
 
+import (
+	"time"
+
+	"github.com/topfreegames/marathon/log"
+	"github.com/uber-go/zap"
+)
+
 const (
 	CreateBatchesWorkerStart     = "starting_create_batches_worker"
 	CreateBatchesWorkerCompleted = "completed_create_batches_worker"
@@ -25,6 +32,46 @@ const (
 	ResumeJobWorkerCompleted = "completed_resume_job_worker"
 	ResumeJobWorkerError     = "error_resume_job_worker"
 
+	EmptyTokenDropped      = "empty_token"
+	DuplicatedTokenDropped = "duplicated_token"
+	ExpiredTokenDropped    = "expired_token"
+	LocaleNormalized       = "locale_normalized"
+
 	GetCsvFromS3Timing   = "get_csv_from_s3"
 	GetUsersFromDbTiming = "get_from_pg"
+	BuildMessagesTiming  = "build_messages"
+	SendMessagesTiming   = "send_messages"
+	MessagesSent         = "messages_sent"
 )
+
+// stageStats are the durations of the stages a page or batch of users goes through,
+// they show which stage is the bottleneck when a job is slow
+type stageStats struct {
+	Fetch time.Duration
+	Build time.Duration
+	Send  time.Duration
+	Users int
+	Sent  int
+}
+
+// report sends the stage timings to statsd and logs them with the finished message
+func (s *stageStats) report(w *Worker, l zap.Logger, labels []string) {
+	w.Statsd.Timing(BuildMessagesTiming, s.Build, labels, 1)
+	w.Statsd.Timing(SendMessagesTiming, s.Send, labels, 1)
+	w.Statsd.Count(MessagesSent, int64(s.Sent), labels, 1)
+
+	messagesPerSecond := 0.0
+	if total := s.Fetch + s.Build + s.Send; total > 0 {
+		messagesPerSecond = float64(s.Sent) / total.Seconds()
+	}
+	log.I(l, "finished", func(cm log.CM) {
+		cm.Write(
+			zap.Int("users", s.Users),
+			zap.Int("sent", s.Sent),
+			zap.Duration("fetchDuration", s.Fetch),
+			zap.Duration("buildDuration", s.Build),
+			zap.Duration("sendDuration", s.Send),
+			zap.Float64("messagesPerSecond", messagesPerSecond),
+		)
+	})
+}
@@ -30,6 +30,7 @@ import (
 	"strings"
 	"time"
 
+	raven "github.com/getsentry/raven-go"
 	uuid "github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/email"
 	"github.com/topfreegames/marathon/log"
@@ -81,8 +82,7 @@ func (b *ProcessBatchWorker) incrFailedBatches(j *model.Job, appName string) {
 	}
 }
 
-func (b *ProcessBatchWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, expiresAt int64, templateName string) error {
-	pushExpiry := expiresAt / 1000000000 // convert from nanoseconds to seconds
+func (b *ProcessBatchWorker) sendToKafka(service, topic string, msg, messageMetadata map[string]interface{}, pushMetadata map[string]interface{}, deviceToken string, pushExpiry int64, templateName string) error {
 	switch service {
 	case "apns":
 		err := b.Workers.Kafka.SendAPNSPush(topic, deviceToken, msg, messageMetadata, pushMetadata, pushExpiry, templateName)
@@ -95,7 +95,7 @@ func (b *ProcessBatchWorker) sendToKafka(service, topic string, msg, messageMeta
 			return err
 		}
 	default:
-		panic("service should be in ['apns', 'gcm']")
+		return fmt.Errorf("service should be in ['apns', 'gcm'], got '%s'", service)
 	}
 	return nil
 }
@@ -130,8 +130,7 @@ func (b *ProcessBatchWorker) updateJobBatchesInfo(jobID uuid.UUID) error {
 		if err != nil {
 			return err
 		}
-		at := time.Now().Add(b.Workers.Config.GetDuration("workers.processBatch.intervalToSendCompletedJob")).UnixNano()
-		_, err = b.Workers.ScheduleJobCompletedJob(jobID.String(), at)
+		err = b.Workers.finishJob(&job)
 	}
 	return err
 }
@@ -171,11 +170,30 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 	arr, err := message.Args().Array()
 	checkErr(l, err)
 	parsed, err := ParseProcessBatchWorkerMessageArray(arr)
-	checkErr(l, err)
+	if err != nil {
+		// a malformed batch can't succeed on retry, so it is dropped instead of panicking
+		raven.CaptureError(err, nil)
+		log.E(l, "Failed to parse batch message, dropping it.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+		return nil
+	}
 	log.D(l, "Parsed message info successfully.")
 
+	b.Workers.inFlight.Add(1)
+	defer b.Workers.inFlight.Done()
+
+	if b.Workers.IsStopping() {
+		// the batch is rescheduled so another worker picks it up
+		log.I(l, "worker is stopping, rescheduling batch")
+		_, err = b.Workers.ScheduleProcessBatchJob(parsed.JobID.String(), parsed.AppName, &parsed.Users, time.Now().UnixNano())
+		return err
+	}
+
 	job, err := b.Workers.GetJob(parsed.JobID)
 	b.checkErrWithReEnqueue(parsed, l, err)
+	b.Workers.TrackJob(job.ID)
+	defer b.Workers.UntrackJob(job.ID)
 
 	l = l.With(
 		zap.String("jobID", job.ID.String()),
@@ -186,8 +204,10 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 	log.D(l, "Retrieved job successfully.")
 	b.Workers.Statsd.Incr(ProcessBatchWorkerStart, job.Labels(), 1)
 
-	if job.ExpiresAt > 0 && job.ExpiresAt < time.Now().UnixNano() {
+	if IsJobExpired(job, time.Now()) {
 		log.I(l, "expired")
+		b.Workers.Statsd.Count(ExpiredTokenDropped, int64(len(parsed.Users)), job.Labels(), 1)
+		b.Workers.IncrJobStatus(job.ID, JobStatusExpiredTokens, int64(len(parsed.Users)))
 		b.Workers.Statsd.Incr(ProcessBatchWorkerCompleted, job.Labels(), 1)
 		return nil
 	}
@@ -211,7 +231,7 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 		log.D(l, "valid")
 	}
 
-	templatesByNameAndLocale, err := job.GetJobTemplatesByNameAndLocale(b.Workers.MarathonDB)
+	templatesByNameAndLocale, err := b.Workers.GetJobTemplates(job)
 	if err != nil {
 		b.incrFailedBatches(job, parsed.AppName)
 	}
@@ -225,7 +245,41 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 	log.D(l, "Built topic name successfully.", func(cm log.CM) {
 		cm.Write(zap.String("topic", topic))
 	})
-	for _, user := range parsed.Users {
+	// users may override the job service, so topics are built per service
+	topics := map[string]string{job.Service: topic}
+	pushExpiry := GetPushExpiry(job, b.Workers.Config.GetInt64("workers.pushExpiry"))
+	users := parsed.Users
+	if b.Workers.Config.GetBool("workers.dropEmptyTokens") {
+		var dropped int
+		users, dropped = DropUsersWithEmptyToken(users)
+		if dropped > 0 {
+			b.Workers.Statsd.Count(EmptyTokenDropped, int64(dropped), job.Labels(), 1)
+			log.W(l, "Dropped users with empty token.", func(cm log.CM) {
+				cm.Write(zap.Int("dropped", dropped))
+			})
+		}
+	}
+	if b.Workers.Config.GetBool("workers.locale.normalize") {
+		var normalized int
+		users, normalized = NormalizeUsersLocale(users, b.Workers.Config.GetString("workers.locale.default"))
+		if normalized > 0 {
+			b.Workers.Statsd.Count(LocaleNormalized, int64(normalized), job.Labels(), 1)
+			log.D(l, "Normalized users locale.", func(cm log.CM) {
+				cm.Write(zap.Int("normalized", normalized))
+			})
+		}
+	}
+	defaultLocale := b.Workers.Config.GetString("workers.templates.defaultLocale")
+	missingKeyPolicy := b.Workers.Config.GetString("workers.templates.missingKeyPolicy")
+	stats := &stageStats{Users: len(users)}
+	expired := 0
+	for i, user := range users {
+		// a batch that takes long to send must not send the pushes after the job expired
+		if IsJobExpired(job, time.Now()) {
+			expired = len(users) - i
+			break
+		}
+		buildStart := time.Now()
 		templateName := job.TemplateName
 		templateNames := strings.Split(job.TemplateName, ",")
 
@@ -236,18 +290,21 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 			})
 		}
 
-		templatesByLocale := templatesByNameAndLocale[templateName]
-		var template model.Template
-		if val, ok := templatesByLocale[strings.ToLower(user.Locale)]; ok {
-			template = val
-		} else if val, ok := templatesByLocale["en"]; ok {
-			template = val
-		} else {
+		if versionTemplateName := GetVersionTemplateName(job.VersionTemplates, user.AppVersion); versionTemplateName != "" {
+			templateName = versionTemplateName
+		}
+
+		template, matchedLocale, ok := FindTemplate(templatesByNameAndLocale[templateName], user.Locale, defaultLocale)
+		if !ok {
 			b.incrFailedBatches(job, parsed.AppName)
-			b.checkErr(job, fmt.Errorf("there is no template for the given locale or 'en'"))
+			b.checkErr(job, fmt.Errorf("there is no template for the locale '%s' or '%s'", user.Locale, defaultLocale))
+		} else if matchedLocale != strings.ToLower(user.Locale) {
+			log.D(l, "Template locale fallback.", func(cm log.CM) {
+				cm.Write(zap.String("locale", user.Locale), zap.String("matchedLocale", matchedLocale))
+			})
 		}
 
-		msgStr, msgErr := BuildMessageFromTemplate(template, job.Context)
+		msgStr, msgErr := BuildMessageFromTemplateWithPolicy(template, job.Context, missingKeyPolicy)
 		if msgErr != nil {
 			b.incrFailedBatches(job, parsed.AppName)
 		}
@@ -263,6 +320,7 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 			"pushTime":     time.Now().Unix(),
 			"templateName": templateName,
 			"jobId":        job.ID.String(),
+			"appName":      parsed.AppName,
 			"pushType":     "massive",
 			"muid":         uuid.NewV4().String(),
 		}
@@ -273,14 +331,27 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 				pushMetadata["dryRun"] = dryRun
 			}
 		}
+		if collapseKey, ok := job.Metadata["collapseKey"].(string); ok && collapseKey != "" {
+			pushMetadata["collapseKey"] = collapseKey
+		}
 
-		err = b.sendToKafka(job.Service, topic, msg, job.Metadata, pushMetadata, user.Token, job.ExpiresAt, templateName)
+		service := GetUserService(user, job.Service)
+		userTopic, ok := topics[service]
+		if !ok {
+			userTopic = BuildTopicName(parsed.AppName, service, topicTemplate)
+			topics[service] = userTopic
+		}
+		sendStart := time.Now()
+		stats.Build += sendStart.Sub(buildStart)
+
+		err = b.sendToKafka(service, userTopic, msg, job.Metadata, pushMetadata, user.Token, pushExpiry, templateName)
+		stats.Send += time.Now().Sub(sendStart)
 		if err != nil {
 			batchErrorCounter = batchErrorCounter + 1
 			log.E(l, "Failed to send message to Kafka.", func(cm log.CM) {
 				cm.Write(
-					zap.String("service", job.Service),
-					zap.String("topic", topic),
+					zap.String("service", service),
+					zap.String("topic", userTopic),
 					zap.Object("msg", msg),
 					zap.Object("metadata", job.Metadata),
 					zap.Object("token", user.Token),
@@ -290,20 +361,40 @@ func (b *ProcessBatchWorker) Process(message *goworkers2.Msg) error {
 			})
 		}
 	}
+	sent := len(users) - batchErrorCounter - expired
+	stats.Sent = sent
+	if expired > 0 {
+		b.Workers.Statsd.Count(ExpiredTokenDropped, int64(expired), job.Labels(), 1)
+		log.I(l, "Job expired while sending the batch.", func(cm log.CM) {
+			cm.Write(zap.Int("expired", expired))
+		})
+	}
 	log.D(l, "Sent push to pusher for batch users.")
 	err = b.updateJobBatchesInfo(parsed.JobID)
 	b.checkErr(job, err)
 	log.D(l, "Updated job batches info successfully.")
-	err = b.updateJobUsersInfo(parsed.JobID, len(parsed.Users)-batchErrorCounter)
+	err = b.updateJobUsersInfo(parsed.JobID, sent)
 	b.checkErr(job, err)
 	log.D(l, "Updated job users info successfully.")
+	err = b.Workers.IncrJobStatus(parsed.JobID, JobStatusProcessedTokens, int64(sent))
+	if err == nil && expired > 0 {
+		err = b.Workers.IncrJobStatus(parsed.JobID, JobStatusExpiredTokens, int64(expired))
+	}
+	if err == nil {
+		err = b.Workers.IncrJobStatus(parsed.JobID, JobStatusProcessedBatches, 1)
+	}
+	if err != nil {
+		log.W(l, "Failed to update job status counters.", func(cm log.CM) {
+			cm.Write(zap.Error(err))
+		})
+	}
 	if float64(batchErrorCounter)/float64(len(parsed.Users)) > b.Workers.Config.GetFloat64("workers.processBatch.maxUserFailureInBatch") {
 		b.incrFailedBatches(job, parsed.AppName)
 		b.checkErr(job, fmt.Errorf("failed to send message to several users, considering batch as failed"))
 	}
 
 	b.Workers.Statsd.Incr(ProcessBatchWorkerCompleted, job.Labels(), 1)
-	log.I(l, "finished")
+	stats.report(b.Workers, l, job.Labels())
 
 	return nil
 }
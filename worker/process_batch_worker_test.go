@@ -63,7 +63,7 @@ var _ = Describe("ProcessBatch Worker", func() {
 	var context map[string]interface{}
 	var jobWithManyTemplates *model.Job
 	var gcmJob *model.Job
-	var users []worker.User
+	var users []model.UserToken
 	var mockKafkaProducer *FakeKafkaProducer
 
 	logger := zap.New(
@@ -138,11 +138,11 @@ var _ = Describe("ProcessBatch Worker", func() {
 			"service": "gcm",
 		})
 		Expect(job.CompletedAt).To(Equal(int64(0)))
-		users = make([]worker.User, 2)
+		users = make([]model.UserToken, 2)
 		for index := range users {
 			id := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			users[index] = worker.User{
+			users[index] = model.UserToken{
 				UserID: id,
 				Token:  token,
 				Locale: "en",
@@ -185,6 +185,54 @@ var _ = Describe("ProcessBatch Worker", func() {
 			}
 		})
 
+		It("should drop a malformed message without panicking", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+			messageObj := []interface{}{
+				gcmJob.ID,
+				appName,
+				123,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() {
+				err = processBatchWorker.Process(message)
+			}).NotTo(Panic())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mockKafkaProducer.GCMMessages).To(BeEmpty())
+		})
+
+		It("should increment the job status counters", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				gcmJob.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+
+			status, err := w.GetJobStatus(gcmJob.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status[worker.JobStatusProcessedTokens]).To(Equal(fmt.Sprint(len(users))))
+			Expect(status[worker.JobStatusProcessedBatches]).To(Equal("1"))
+		})
+
 		It("should process when service is apns and increment job completed batches", func() {
 			_, err := w.MarathonDB.Model(&model.Job{}).Set("service = apns").Where("id = ?", job.ID).Update()
 			appName := strings.Split(app.BundleID, ".")[2]
@@ -218,6 +266,149 @@ var _ = Describe("ProcessBatch Worker", func() {
 			}
 		})
 
+		It("should use the job pushExpiry instead of expiresAt when it is set", func() {
+			pushExpiry := time.Now().Add(30 * time.Minute).Unix()
+			jobWithPushExpiry := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"context":    context,
+				"pushExpiry": pushExpiry,
+			})
+			appName := strings.Split(app.BundleID, ".")[2]
+
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				jobWithPushExpiry.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			processBatchWorker.Process(message)
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(len(users)))
+			for _, m := range mockKafkaProducer.APNSMessages {
+				var apnsMessage messages.APNSMessage
+				err = json.Unmarshal([]byte(m), &apnsMessage)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(apnsMessage.PushExpiry).To(BeEquivalentTo(pushExpiry))
+			}
+		})
+
+		It("should send each user to the topic of its own service when users have mixed services", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+			users[1].Service = "gcm"
+
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			processBatchWorker.Process(message)
+
+			topicTemplate := w.Config.GetString("workers.topicTemplate")
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			Expect(mockKafkaProducer.APNSTopics).To(Equal([]string{worker.BuildTopicName(appName, "apns", topicTemplate)}))
+			Expect(mockKafkaProducer.GCMMessages).To(HaveLen(1))
+			Expect(mockKafkaProducer.GCMTopics).To(Equal([]string{worker.BuildTopicName(appName, "gcm", topicTemplate)}))
+
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.DeviceToken).To(Equal(users[0].Token))
+
+			var gcmMessage messages.GCMMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.GCMMessages[0]), &gcmMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gcmMessage.To).To(Equal(users[1].Token))
+		})
+
+		It("should drop users with empty token", func() {
+			appName := strings.Split(app.BundleID, ".")[2]
+			users[0].Token = ""
+
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				job.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			processBatchWorker.Process(message)
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.DeviceToken).To(Equal(users[1].Token))
+
+			dbJob := &model.Job{}
+			err = w.MarathonDB.Model(dbJob).Where("id = ?", job.ID).Select()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbJob.CompletedTokens).To(Equal(1))
+		})
+
+		It("should select the template by the user app version", func() {
+			jobWithVersionTemplates := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"context": context,
+				"versionTemplates": []model.VersionTemplate{
+					{MaxVersion: "2.0", TemplateName: template2.Name},
+				},
+			})
+			appName := strings.Split(app.BundleID, ".")[2]
+			users[0].AppVersion = "1.5"
+			users[1].AppVersion = "2.1"
+
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			messageObj := []interface{}{
+				jobWithVersionTemplates.ID,
+				appName,
+				compressedUsers,
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": messageObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			processBatchWorker.Process(message)
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(2))
+			expected := []string{
+				"Everyone just disliked your village!",
+				"Everyone just liked your village!",
+			}
+			for idx, m := range mockKafkaProducer.APNSMessages {
+				var apnsMessage messages.APNSMessage
+				err = json.Unmarshal([]byte(m), &apnsMessage)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(apnsMessage.DeviceToken).To(Equal(users[idx].Token))
+				Expect(apnsMessage.Payload.Aps["alert"]).To(Equal(expected[idx]))
+			}
+		})
+
 		It("should choose a random template and put it in push metadata when many are passed to the job", func() {
 			appName := strings.Split(app.BundleID, ".")[2]
 
@@ -434,6 +625,9 @@ var _ = Describe("ProcessBatch Worker", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(dbJob.CompletedBatches).To(Equal(0))
 			Expect(dbJob.CompletedTokens).To(Equal(0))
+			status, err := w.GetJobStatus(job.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status[worker.JobStatusExpiredTokens]).To(Equal(fmt.Sprint(len(users))))
 		})
 
 		It("should not process batch if job is stopped", func() {
@@ -466,11 +660,11 @@ var _ = Describe("ProcessBatch Worker", func() {
 		})
 
 		It("should process the message using the correct template", func() {
-			users = make([]worker.User, 2)
+			users = make([]model.UserToken, 2)
 			for index := range users {
 				id := uuid.NewV4().String()
 				token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-				users[index] = worker.User{
+				users[index] = model.UserToken{
 					UserID: id,
 					Token:  token,
 					Locale: "PT",
@@ -510,13 +704,13 @@ var _ = Describe("ProcessBatch Worker", func() {
 			userID := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
 			// createdAt := time.Now()
-			user := worker.User{
+			user := model.UserToken{
 				UserID: userID,
 				Token:  token,
 				Locale: "pt",
 			}
 			appName := strings.Split(app.BundleID, ".")[2]
-			compressedUsers, err := worker.CompressUsers(&[]worker.User{user})
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
 			Expect(err).NotTo(HaveOccurred())
 			messageObj := []interface{}{
 				job.ID,
@@ -554,17 +748,47 @@ var _ = Describe("ProcessBatch Worker", func() {
 			}
 		})
 
+		It("should put the collapse key of the job on the pushes", func() {
+			collapseJob := CreateTestJob(w.MarathonDB, app.ID, template.Name, map[string]interface{}{
+				"metadata": map[string]interface{}{"collapseKey": "black-friday"},
+			})
+			user := model.UserToken{
+				UserID: uuid.NewV4().String(),
+				Token:  strings.Replace(uuid.NewV4().String(), "-", "", -1),
+				Locale: "en",
+			}
+			appName := strings.Split(app.BundleID, ".")[2]
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
+			Expect(err).NotTo(HaveOccurred())
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": {collapseJob.ID, appName, compressedUsers},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+
+			processBatchWorker.Process(message)
+
+			Expect(mockKafkaProducer.APNSMessages).To(HaveLen(1))
+			var apnsMessage messages.APNSMessage
+			err = json.Unmarshal([]byte(mockKafkaProducer.APNSMessages[0]), &apnsMessage)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(apnsMessage.CollapseID).To(Equal("black-friday"))
+			Expect(apnsMessage.Payload.Aps["thread-id"]).To(Equal("black-friday"))
+			Expect(apnsMessage.Metadata["collapseKey"]).To(Equal("black-friday"))
+		})
+
 		It("should process the message and put the right pushMetadata on it if gcm push", func() {
 			userID := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
 			// createdAt := time.Now()
-			user := worker.User{
+			user := model.UserToken{
 				UserID: userID,
 				Token:  token,
 				Locale: "pt",
 			}
 			appName := strings.Split(app.BundleID, ".")[2]
-			compressedUsers, err := worker.CompressUsers(&[]worker.User{user})
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
 			Expect(err).NotTo(HaveOccurred())
 			messageObj := []interface{}{
 				gcmJob.ID,
@@ -846,13 +1070,13 @@ var _ = Describe("ProcessBatch Worker", func() {
 			userID := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
 			// createdAt := time.Now()
-			user := worker.User{
+			user := model.UserToken{
 				UserID: userID,
 				Token:  token,
 				Locale: "pt",
 			}
 			appName := strings.Split(app.BundleID, ".")[2]
-			compressedUsers, err := worker.CompressUsers(&[]worker.User{user})
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
 			Expect(err).NotTo(HaveOccurred())
 			messageObj := []interface{}{
 				dryRunJob.ID,
@@ -903,14 +1127,14 @@ var _ = Describe("ProcessBatch Worker", func() {
 			userID := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
 			// createdAt := time.Now()
-			user := worker.User{
+			user := model.UserToken{
 				// CreatedAt: pg.NullTime{createdAt},
 				UserID: userID,
 				Token:  token,
 				Locale: "pt",
 			}
 			appName := strings.Split(app.BundleID, ".")[2]
-			compressedUsers, err := worker.CompressUsers(&[]worker.User{user})
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
 			Expect(err).NotTo(HaveOccurred())
 			messageObj := []interface{}{
 				dryRunJob.ID,
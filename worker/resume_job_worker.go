@@ -23,6 +23,7 @@
 package worker
 
 import (
+	"encoding/json"
 	"fmt"
 	goworkers2 "github.com/digitalocean/go-workers2"
 	"github.com/topfreegames/marathon/model"
@@ -69,7 +70,7 @@ func (b *ResumeJobWorker) Process(message *goworkers2.Msg) error {
 	b.Workers.Statsd.Incr(ResumeJobWorkerStart, job.Labels(), 1)
 	if job.Status == stoppedJobStatus {
 		l.Info("stopped job resume_job_worker")
-		err := b.Workers.RedisClient.Del(fmt.Sprintf("%s-pausedjobs", jobID.(string))).Err()
+		err := b.Workers.RedisClient.Del(fmt.Sprintf("%s-pausedjobs", jobID.(string)), pausedDirectPagesKey(id)).Err()
 		if err != nil && err != redis.Nil {
 			checkErr(b.Logger, err)
 		}
@@ -77,6 +78,18 @@ func (b *ResumeJobWorker) Process(message *goworkers2.Msg) error {
 		return nil
 	}
 
+	interrupted, err := b.Workers.IsJobInterrupted(job)
+	b.checkErr(job, err)
+	if interrupted && len(job.CSVPath) == 0 && !b.Workers.CanResumeInterruptedJobs() {
+		l.Warn("not resuming interrupted job without workers.direct.resume")
+	} else if interrupted && len(job.CSVPath) == 0 {
+		l.Info("resuming interrupted job")
+		err = b.Workers.SetJobStatus(id, map[string]string{"status": ""})
+		b.checkErr(job, err)
+		err = b.Workers.ResumeDirectBatchesJob(job)
+		b.checkErr(job, err)
+	}
+
 	for {
 		batchInfo, err := b.Workers.RedisClient.RPop(fmt.Sprintf("%s-pausedjobs", jobID.(string))).Result()
 		if err != nil && err == redis.Nil {
@@ -93,6 +106,19 @@ func (b *ResumeJobWorker) Process(message *goworkers2.Msg) error {
 		b.checkErr(job, err)
 	}
 
+	for {
+		pageInfo, err := b.Workers.RedisClient.RPop(pausedDirectPagesKey(id)).Result()
+		if err != nil && err == redis.Nil {
+			break
+		}
+		b.checkErr(job, err)
+		var page DirectPartMsg
+		err = json.Unmarshal([]byte(pageInfo), &page)
+		b.checkErr(job, err)
+		_, err = b.Workers.CreateDirectPageJob(page)
+		b.checkErr(job, err)
+	}
+
 	b.Workers.Statsd.Incr(ResumeJobWorkerCompleted, job.Labels(), 1)
 	log.I(b.Logger, "finished resume_job_worker")
 
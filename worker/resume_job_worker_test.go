@@ -42,7 +42,7 @@ var _ = Describe("ProcessBatch Worker", func() {
 	var app *model.App
 	var template *model.Template
 	var job *model.Job
-	var users []worker.User
+	var users []model.UserToken
 
 	logger := zap.New(
 		zap.NewJSONEncoder(zap.NoTime()),
@@ -58,17 +58,17 @@ var _ = Describe("ProcessBatch Worker", func() {
 		appName := strings.Split(app.BundleID, ".")[2]
 		template = CreateTestTemplate(w.MarathonDB, app.ID)
 		job = CreateTestJob(w.MarathonDB, app.ID, template.Name)
-		users = make([]worker.User, 10)
+		users = make([]model.UserToken, 10)
 		for index := range users {
 			id := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			user := worker.User{
+			user := model.UserToken{
 				UserID: id,
 				Token:  token,
 				Locale: "en",
 			}
 			users[index] = user
-			compressedUsers, err := worker.CompressUsers(&[]worker.User{user})
+			compressedUsers, err := worker.CompressUsers(&[]model.UserToken{user})
 			Expect(err).NotTo(HaveOccurred())
 			messageObj := []interface{}{
 				job.ID,
@@ -133,5 +133,35 @@ var _ = Describe("ProcessBatch Worker", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(exists).To(BeFalse())
 		})
+
+		It("should remove the pages from the paused direct pages list and enqueue them to direct_worker", func() {
+			key := fmt.Sprintf("%s-pauseddirectpages", job.ID.String())
+			for _, seqID := range []uint64{1, 1001} {
+				page, err := json.Marshal(worker.DirectPartMsg{
+					SmallestSeqID: seqID,
+					BiggestSeqID:  seqID + 1000,
+					JobUUID:       job.ID,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = w.RedisClient.RPush(key, string(page)).Result()
+				Expect(err).NotTo(HaveOccurred())
+			}
+			msgB, err := json.Marshal(map[string][]interface{}{
+				"args": {job.ID},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			message, err := goworkers2.NewMsg(string(msgB))
+			Expect(err).NotTo(HaveOccurred())
+			resumeJobWorker.Process(message)
+
+			res, err := w.RedisClient.LLen("queue:direct_worker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(BeEquivalentTo(2))
+
+			exists, err := w.RedisClient.Exists(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
 	})
 })
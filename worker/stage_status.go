@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 
-	redis "gopkg.in/redis.v5"
+	"github.com/topfreegames/marathon/interfaces"
 )
 
 // StageStatus holds information about a stage from a worker pipeline in Redis
@@ -13,7 +13,7 @@ type StageStatus struct {
 	Stage       string
 	StageKey    string
 	Description string
-	Client      *redis.Client
+	Client      interfaces.Redis
 
 	MaxProgress     int
 	CurrentProgress int
@@ -23,7 +23,7 @@ type StageStatus struct {
 }
 
 // NewStageStatus returns a new StageStatus instance
-func NewStageStatus(client *redis.Client,
+func NewStageStatus(client interfaces.Redis,
 	jobID, stage, description string,
 	maxProgress int) (*StageStatus, error) {
 
@@ -7,16 +7,16 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/spf13/viper"
 	"github.com/topfreegames/marathon/extensions"
+	"github.com/topfreegames/marathon/interfaces"
 	. "github.com/topfreegames/marathon/testing"
 	"github.com/topfreegames/marathon/worker"
 	"github.com/uber-go/zap"
-	redis "gopkg.in/redis.v5"
 )
 
 var _ = Describe("ProcessBatch Worker", func() {
 	var config *viper.Viper
 	var logger zap.Logger
-	var redisClient *redis.Client
+	var redisClient interfaces.Redis
 	var err error
 
 	BeforeEach(func() {
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// statusCoalescer accumulates the increments of the job status counters in memory and writes them
+// at most maxWrites times per second, so the workers sharing a redis don't write in bursts
+type statusCoalescer struct {
+	interval time.Duration
+	jitter   float64
+	write    func(jobID uuid.UUID, counters map[string]int64) error
+
+	lock    sync.Mutex
+	pending map[uuid.UUID]map[string]int64
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newStatusCoalescer(maxWrites, jitter float64, write func(jobID uuid.UUID, counters map[string]int64) error) *statusCoalescer {
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	s := &statusCoalescer{
+		interval: time.Duration(float64(time.Second) / maxWrites),
+		jitter:   jitter,
+		write:    write,
+		pending:  map[uuid.UUID]map[string]int64{},
+		done:     make(chan struct{}),
+	}
+	s.stopped.Add(1)
+	go s.run()
+	return s
+}
+
+// Add accumulates the increment until the next write
+func (s *statusCoalescer) Add(jobID uuid.UUID, field string, n int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counters, ok := s.pending[jobID]
+	if !ok {
+		counters = map[string]int64{}
+		s.pending[jobID] = counters
+	}
+	counters[field] += n
+}
+
+// Flush writes the accumulated increments of every job
+func (s *statusCoalescer) Flush() {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = map[uuid.UUID]map[string]int64{}
+	s.lock.Unlock()
+	for jobID, counters := range pending {
+		// a failed write was already retried and logged, the status is best-effort
+		s.write(jobID, counters)
+	}
+}
+
+// Close stops the periodic writes and writes what is still pending
+func (s *statusCoalescer) Close() {
+	close(s.done)
+	s.stopped.Wait()
+	s.Flush()
+}
+
+// nextInterval shortens or lengthens the interval randomly by up to the jitter fraction, so
+// workers started together don't keep writing together
+func (s *statusCoalescer) nextInterval() time.Duration {
+	return s.interval + time.Duration((rand.Float64()*2-1)*s.jitter*float64(s.interval))
+}
+
+func (s *statusCoalescer) run() {
+	defer s.stopped.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(s.nextInterval()):
+			s.Flush()
+		}
+	}
+}
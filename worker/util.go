@@ -28,36 +28,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
-
-	// pg "gopkg.in/pg.v5"
-	"gopkg.in/redis.v5"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
 	uuid "github.com/satori/go.uuid"
+	"github.com/topfreegames/marathon/interfaces"
 	"github.com/topfreegames/marathon/log"
 	"github.com/topfreegames/marathon/model"
 	"github.com/uber-go/zap"
-	"github.com/valyala/fasttemplate"
+	"golang.org/x/text/language"
+	pg "gopkg.in/pg.v5"
 )
 
 const stoppedJobStatus = "stopped"
 
-// User is the struct that will keep users before sending them to send batches worker
-type User struct {
-	UserID string `json:"user_id,omitempty" sql:"user_id"`
-	Token  string `json:"token,omitempty" sql:"token"`
-	Locale string `json:"locale,omitempty" sql:"locale"`
-	Region string `json:"region,omitempty" sql:"region"`
-	Tz     string `json:"tz,omitempty" sql:"tz"`
-	// CreatedAt pg.NullTime `json:"created_at,omitempty" sql:"created_at"`
-	// Fiu       string      `json:"fiu,omitempty" sql:"fiu"`
-	// Adid      string      `json:"adid,omitempty" sql:"adid"`
-	// VendorID  string      `json:"vendor_id,omitempty" sql:"vendor_id"`
-}
+const interruptedJobStatus = "interrupted"
 
 // Batch is a struct that helps tracking processes pages
 type Batch struct {
@@ -94,7 +84,7 @@ func IsUserIDValid(userID string) bool {
 	return true
 }
 
-func isPageProcessed(page int, jobID uuid.UUID, redisClient *redis.Client, l zap.Logger) bool {
+func isPageProcessed(page int, jobID uuid.UUID, redisClient interfaces.Redis, l zap.Logger) bool {
 	res, err := redisClient.SIsMember(fmt.Sprintf("%s-processedpages", jobID.String()), page).Result()
 	checkErr(l, err)
 	return res
@@ -118,13 +108,13 @@ func GetTimeOffsetFromUTCInSeconds(tz string, l zap.Logger) (int, error) {
 	return offsetInSeconds, err
 }
 
-func checkIsReexecution(jobID uuid.UUID, redisClient *redis.Client, l zap.Logger) bool {
+func checkIsReexecution(jobID uuid.UUID, redisClient interfaces.Redis, l zap.Logger) bool {
 	res, err := redisClient.Exists(fmt.Sprintf("%s-processedpages", jobID.String())).Result()
 	checkErr(l, err)
 	return res
 }
 
-func markProcessedPage(page int, jobID uuid.UUID, redisClient *redis.Client) {
+func markProcessedPage(page int, jobID uuid.UUID, redisClient interfaces.Redis) {
 	redisClient.SAdd(fmt.Sprintf("%s-processedpages", jobID.String()), page)
 }
 
@@ -137,34 +127,139 @@ func checkErr(l zap.Logger, err error) {
 	}
 }
 
-// GetWhereClauseFromFilters returns a string cointaining the where clause to use in the query
-func GetWhereClauseFromFilters(filters map[string]interface{}) string {
+// GetWhereClauseFromFilters returns a string cointaining the where clause to use in the query and the
+// arguments of its placeholders, a filter that isn't valid is an error instead of being written into the query
+func GetWhereClauseFromFilters(filters map[string]interface{}) (string, []interface{}, error) {
 	if len(filters) == 0 {
-		return ""
+		return "", nil, nil
 	}
 
 	queryFilters := []string{}
+	args := []interface{}{}
 	for key, val := range filters {
-		operator := "="
-		connector := " OR "
-		if strings.Contains(key, "NOT") {
-			key = strings.Trim(key, "NOT")
-			operator = "!="
-			connector = " AND "
+		if key == model.LastActiveDaysFilter {
+			clause, err := getLastActiveClause(val)
+			if err != nil {
+				return "", nil, err
+			}
+			queryFilters = append(queryFilters, clause)
+			continue
+		}
+		column, negated, err := model.ParseFilterKey(key)
+		if err != nil {
+			return "", nil, err
+		}
+		filterOperator, vals, err := model.ParseFilterValue(key, val)
+		if err != nil {
+			return "", nil, err
 		}
-		strVal := val.(string)
-		if strings.Contains(strVal, ",") {
-			filterArray := []string{}
-			vals := strings.Split(strVal, ",")
-			for _, fVal := range vals {
-				filterArray = append(filterArray, fmt.Sprintf("\"%s\"%s'%s'", key, operator, fVal))
+		switch filterOperator {
+		case model.FilterOperatorIn:
+			queryFilters = append(queryFilters, getInClause(column, negated))
+			args = append(args, pg.In(vals))
+		case model.FilterOperatorBetween:
+			queryFilters = append(queryFilters, getBetweenClause(column, negated))
+			args = append(args, vals[0], vals[1])
+		default:
+			operator := "="
+			connector := " OR "
+			if negated {
+				operator = "!="
+				connector = " AND "
+			}
+			if len(vals) > 1 {
+				filterArray := []string{}
+				for _, fVal := range vals {
+					filterArray = append(filterArray, getFilterClause(column, operator))
+					args = append(args, fVal)
+				}
+				queryFilters = append(queryFilters, fmt.Sprintf("(%s)", strings.Join(filterArray, connector)))
+			} else {
+				queryFilters = append(queryFilters, getFilterClause(column, operator))
+				args = append(args, vals[0])
 			}
-			queryFilters = append(queryFilters, fmt.Sprintf("(%s)", strings.Join(filterArray, connector)))
-		} else {
-			queryFilters = append(queryFilters, fmt.Sprintf("\"%s\"%s'%s'", key, operator, val))
 		}
 	}
-	return strings.Join(queryFilters, " AND ")
+	return strings.Join(queryFilters, " AND "), args, nil
+}
+
+// ValidateFilterColumns checks that the filters only match columns of the push table, a job can
+// filter by the columns of model.FilterColumns that the table of its app and service has
+func ValidateFilterColumns(filters map[string]interface{}, columns []string) error {
+	allowed := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		allowed[column] = true
+	}
+	for key := range filters {
+		column := model.LastActiveColumn
+		if key != model.LastActiveDaysFilter {
+			var err error
+			if column, _, err = model.ParseFilterKey(key); err != nil {
+				return err
+			}
+		}
+		if !allowed[column] {
+			return fmt.Errorf("unsupported filter '%s', the push table has no column %s", key, column)
+		}
+	}
+	return nil
+}
+
+// getFilterClause compares the column to the value of a placeholder
+func getFilterClause(column, operator string) string {
+	return fmt.Sprintf("\"%s\"%s?", column, operator)
+}
+
+// getInClause matches the column to any of the values of a placeholder, which ParseFilterValue
+// guarantees aren't empty
+func getInClause(column string, negated bool) string {
+	operator := model.FilterOperatorIn
+	if negated {
+		operator = "NOT " + operator
+	}
+	return fmt.Sprintf("\"%s\" %s (?)", column, operator)
+}
+
+// numericPattern matches the text of the numbers a range compares, it avoids ? because pg would read it
+// as a placeholder
+const numericPattern = "^[+-]{0,1}[0-9]+([.][0-9]+){0,1}$"
+
+// getBetweenClause matches the column cast to a number to the range of two placeholders, both included,
+// the column is only cast when it holds a number so a token with any other text doesn't fail the query
+func getBetweenClause(column string, negated bool) string {
+	operator := model.FilterOperatorBetween
+	if negated {
+		operator = "NOT " + operator
+	}
+	return fmt.Sprintf(
+		"CASE WHEN \"%s\"::text ~ '%s' THEN \"%s\"::text::numeric END %s ? AND ?",
+		column, numericPattern, column, operator,
+	)
+}
+
+// getLastActiveClause only lets the days into the query after they are parsed as an integer
+func getLastActiveClause(val interface{}) (string, error) {
+	days, err := model.ParseLastActiveDays(val)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\"%s\">=now()-interval '%d days'", model.LastActiveColumn, days), nil
+}
+
+// EstimateAudience counts the tokens of the app and service that match the filters, so the reach of
+// a job can be known without creating it
+func EstimateAudience(db interfaces.DB, appName, service string, filters map[string]interface{}) (int, error) {
+	whereClause, args, err := GetWhereClauseFromFilters(filters)
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("SELECT count(*) FROM %s", GetPushDBTableName(appName, service))
+	if whereClause != "" {
+		query = fmt.Sprintf("%s WHERE %s", query, whereClause)
+	}
+	var count int
+	_, err = db.QueryOne(&count, query, args...)
+	return count, err
 }
 
 // GetPushDBTableName get the table name using appName and service
@@ -172,9 +267,198 @@ func GetPushDBTableName(appName, service string) string {
 	return fmt.Sprintf("%s_%s", appName, service)
 }
 
+// GetPushExpiry returns the push expiry in seconds that will be sent to the pusher,
+// the job pushExpiry takes precedence over its expiresAt, which takes precedence over the default
+func GetPushExpiry(job *model.Job, defaultPushExpiry int64) int64 {
+	if job.PushExpiry > 0 {
+		return job.PushExpiry
+	}
+	if job.ExpiresAt > 0 {
+		return job.ExpiresAt / 1000000000 // convert from nanoseconds to seconds
+	}
+	return defaultPushExpiry
+}
+
+// GetControlGroupSize returns how many of the users are kept out of the job as its control group,
+// it fails if the control group would take every user
+func GetControlGroupSize(users int, controlGroup float64) (int, error) {
+	size := int(math.Ceil(float64(users) * controlGroup))
+	if size > 0 && size >= users {
+		return 0, fmt.Errorf("control group size cannot be higher than number of users")
+	}
+	return size, nil
+}
+
+// IsJobExpired returns whether the job expiresAt has passed, a job without expiresAt never expires
+func IsJobExpired(job *model.Job, now time.Time) bool {
+	return job.ExpiresAt > 0 && job.ExpiresAt < now.UnixNano()
+}
+
+// GetUserService returns the service the push to the given user should be sent through,
+// the user service takes precedence over the job service
+func GetUserService(user model.UserToken, jobService string) string {
+	if user.Service != "" {
+		return user.Service
+	}
+	return jobService
+}
+
+// HasTotalTokensDrifted returns true if current differs from the snapshot by more than maxDrift,
+// maxDrift is a fraction of the snapshot, e.g. 0.1 for 10%
+func HasTotalTokensDrifted(snapshot, current int, maxDrift float64) bool {
+	if snapshot <= 0 {
+		return false
+	}
+	return math.Abs(float64(current-snapshot))/float64(snapshot) > maxDrift
+}
+
+// DropUsersWithEmptyToken returns the users that have a token and how many were dropped,
+// since a push to an empty token is undeliverable
+func DropUsersWithEmptyToken(users []model.UserToken) ([]model.UserToken, int) {
+	valid := make([]model.UserToken, 0, len(users))
+	for _, user := range users {
+		if user.Token != "" {
+			valid = append(valid, user)
+		}
+	}
+	return valid, len(users) - len(valid)
+}
+
+// DropDuplicatedTokens returns the users with the first occurrence of each token and how many
+// were dropped, since the same token may be in more than one row
+func DropDuplicatedTokens(users []model.UserToken) ([]model.UserToken, int) {
+	seen := make(map[string]struct{}, len(users))
+	unique := make([]model.UserToken, 0, len(users))
+	for _, user := range users {
+		if _, ok := seen[user.Token]; ok {
+			continue
+		}
+		seen[user.Token] = struct{}{}
+		unique = append(unique, user)
+	}
+	return unique, len(users) - len(unique)
+}
+
+// NormalizeLocale parses the locale as a BCP 47 tag, also accepting the underscore form (pt_BR),
+// and returns it lowercased as the templates are looked up (pt-br). Unparsable locales fall back
+// to defaultLocale. Deprecated codes are kept (iw isn't replaced by he) as templates may be stored
+// under them, FindTemplate falls back to the current code
+func NormalizeLocale(locale, defaultLocale string) string {
+	tag, err := language.Raw.Parse(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+	if err != nil || tag == language.Und {
+		return strings.ToLower(defaultLocale)
+	}
+	return strings.ToLower(tag.String())
+}
+
+// NormalizeUsersLocale normalizes the locale of every user and returns how many of them changed
+func NormalizeUsersLocale(users []model.UserToken, defaultLocale string) ([]model.UserToken, int) {
+	normalized := 0
+	for idx := range users {
+		locale := NormalizeLocale(users[idx].Locale, defaultLocale)
+		if locale != strings.ToLower(users[idx].Locale) {
+			normalized++
+		}
+		users[idx].Locale = locale
+	}
+	return users, normalized
+}
+
+// FindTemplate returns the template for the locale, falling back to the locale with its deprecated
+// codes replaced (he for iw), to the locale language (pt for pt-br) and then to defaultLocale, along
+// with the locale that matched. It returns false if nothing matches
+func FindTemplate(templatesByLocale map[string]model.Template, locale, defaultLocale string) (model.Template, string, bool) {
+	locale = strings.ToLower(locale)
+	locales := []string{locale}
+	if tag, err := language.Parse(locale); err == nil && strings.ToLower(tag.String()) != locale {
+		locales = append(locales, strings.ToLower(tag.String()))
+	}
+	candidates := append([]string{}, locales...)
+	for _, l := range locales {
+		if idx := strings.IndexAny(l, "-_"); idx > 0 {
+			candidates = append(candidates, l[:idx])
+		}
+	}
+	candidates = append(candidates, strings.ToLower(defaultLocale))
+	for _, candidate := range candidates {
+		if template, ok := templatesByLocale[candidate]; ok {
+			return template, candidate, true
+		}
+	}
+	return model.Template{}, "", false
+}
+
+// CompareVersions compares two dot separated versions numerically,
+// it returns -1 if a < b, 0 if a == b and 1 if a > b
+func CompareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bPart, _ = strconv.Atoi(bParts[i])
+		}
+		if aPart < bPart {
+			return -1
+		}
+		if aPart > bPart {
+			return 1
+		}
+	}
+	return 0
+}
+
+// GetVersionTemplateName returns the name of the first version template whose range contains appVersion,
+// or an empty string if there is none so the job template is used
+func GetVersionTemplateName(versionTemplates []model.VersionTemplate, appVersion string) string {
+	if appVersion == "" {
+		return ""
+	}
+	for _, vt := range versionTemplates {
+		if vt.MinVersion != "" && CompareVersions(appVersion, vt.MinVersion) < 0 {
+			continue
+		}
+		if vt.MaxVersion != "" && CompareVersions(appVersion, vt.MaxVersion) >= 0 {
+			continue
+		}
+		return vt.TemplateName
+	}
+	return ""
+}
+
+// GetUsersColumns returns the push db columns that must be fetched for the users of the job, the
+// service of each user is only fetched from the push tables that have that column
+func GetUsersColumns(job *model.Job, tableColumns []string) string {
+	columns := "user_id, token, locale, tz"
+	if len(job.VersionTemplates) > 0 {
+		columns = fmt.Sprintf("%s, app_version", columns)
+	}
+	for _, column := range tableColumns {
+		if column == "service" {
+			columns = fmt.Sprintf("%s, service", columns)
+			break
+		}
+	}
+	return columns
+}
+
 // InvalidMessageArray is the string returned when the message array of the process batch worker is not valid
 var InvalidMessageArray = "array must be of the form [jobId, appName, users]"
 
+// ProcessBatchMessageV1 is the version tag of the [jobId, appName, users] message array,
+// arrays without a version tag are parsed with this format
+const ProcessBatchMessageV1 = "v1"
+
+var messageVersionRegex = regexp.MustCompile(`^v[0-9]+$`)
+
+// processBatchMessageDecoders maps each message array version to the function that decodes it
+var processBatchMessageDecoders = map[string]func([]interface{}) (*BatchWorkerMessage, error){
+	ProcessBatchMessageV1: parseProcessBatchWorkerMessageV1,
+}
+
 // BuildTopicName builds a topic name based in appName, service and a template
 func BuildTopicName(appName, service, topicTemplate string) string {
 	return fmt.Sprintf(topicTemplate, appName, service)
@@ -184,23 +468,24 @@ func BuildTopicName(appName, service, topicTemplate string) string {
 type BatchWorkerMessage struct {
 	JobID   uuid.UUID
 	AppName string
-	Users   []User
+	Users   []model.UserToken
 }
 
 // TODO remove this hacky code
-func cleanUpUserInfo(user *User) *User {
-	return &User{
+func cleanUpUserInfo(user *model.UserToken) *model.UserToken {
+	return &model.UserToken{
 		// UserID: user.UserID,
-		Token:  user.Token,
-		Locale: user.Locale,
+		Token:   user.Token,
+		Locale:  user.Locale,
+		Service: user.Service,
 	}
 }
 
 // TODO test this function
 
 // CompressUsers compresses users payload for enqueuing the message
-func CompressUsers(users *[]User) (string, error) {
-	cleanUsers := make([]*User, len(*users))
+func CompressUsers(users *[]model.UserToken) (string, error) {
+	cleanUsers := make([]*model.UserToken, len(*users))
 	for idx, u := range *users {
 		cleanUsers[idx] = cleanUpUserInfo(&u)
 	}
@@ -224,8 +509,22 @@ func CompressUsers(users *[]User) (string, error) {
 	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
 }
 
-// ParseProcessBatchWorkerMessageArray parses the message array of the process batch worker
+// ParseProcessBatchWorkerMessageArray parses the message array of the process batch worker,
+// the array may start with a version tag, e.g. ["v1", jobId, appName, users]
 func ParseProcessBatchWorkerMessageArray(arr []interface{}) (*BatchWorkerMessage, error) {
+	if len(arr) > 0 {
+		if version, ok := arr[0].(string); ok && messageVersionRegex.MatchString(version) {
+			decode, ok := processBatchMessageDecoders[version]
+			if !ok {
+				return nil, fmt.Errorf("unsupported message array version '%s'", version)
+			}
+			return decode(arr[1:])
+		}
+	}
+	return parseProcessBatchWorkerMessageV1(arr)
+}
+
+func parseProcessBatchWorkerMessageV1(arr []interface{}) (*BatchWorkerMessage, error) {
 	// arr is of the following format
 	// [jobId, appName, users]
 	// users is an array of jsons { user_id: uuid, token: string, locale: string } compressed with zlib
@@ -233,28 +532,27 @@ func ParseProcessBatchWorkerMessageArray(arr []interface{}) (*BatchWorkerMessage
 		return nil, fmt.Errorf(InvalidMessageArray)
 	}
 
-	jobIDStr := arr[0].(string)
+	jobIDStr, ok := arr[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("jobId must be a string, got %T", arr[0])
+	}
 	jobID, err := uuid.FromString(jobIDStr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("jobId must be a valid uuid: %s", err.Error())
 	}
 
-	usersCompressed, err := base64.StdEncoding.DecodeString(arr[2].(string))
-	if err != nil {
-		return nil, err
+	appName, ok := arr[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("appName must be a string, got %T", arr[1])
 	}
-	usersBytesReader, err := zlib.NewReader(bytes.NewReader(usersCompressed))
-	if err != nil {
-		return nil, err
-	}
-	usersBytes, err := ioutil.ReadAll(usersBytesReader)
-	if err != nil {
-		return nil, err
+
+	compressedUsers, ok := arr[2].(string)
+	if !ok {
+		return nil, fmt.Errorf("users must be a compressed string, got %T", arr[2])
 	}
-	users := []User{}
-	err = json.Unmarshal(usersBytes, &users)
+	users, err := decompressUsers(compressedUsers)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("users could not be decompressed: %s", err.Error())
 	}
 
 	if len(users) == 0 {
@@ -263,33 +561,133 @@ func ParseProcessBatchWorkerMessageArray(arr []interface{}) (*BatchWorkerMessage
 
 	message := &BatchWorkerMessage{
 		JobID:   jobID,
-		AppName: arr[1].(string),
+		AppName: appName,
 		Users:   users,
 	}
 
 	return message, nil
 }
 
-// BuildMessageFromTemplate build a message using a template and the context
-func BuildMessageFromTemplate(template model.Template, context map[string]interface{}) (string, error) {
-	body, err := json.Marshal(template.Body)
+// NewBatchWorkerMessageFromMap builds a BatchWorkerMessage from a map of the form
+// { jobId: uuid, appName: string, users: [compressed users|array of users] },
+// it is the safe counterpart of ParseProcessBatchWorkerMessageArray
+func NewBatchWorkerMessageFromMap(m map[string]interface{}) (*BatchWorkerMessage, error) {
+	jobIDStr, ok := m["jobId"].(string)
+	if !ok {
+		return nil, fmt.Errorf("jobId must be a string, got %T", m["jobId"])
+	}
+	jobID, err := uuid.FromString(jobIDStr)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("jobId must be a valid uuid: %s", err.Error())
 	}
-	bodyString := string(body)
-	t := fasttemplate.New(bodyString, "{{", "}}")
 
-	substitutions := make(map[string]interface{})
-	for k, v := range template.Defaults {
-		substitutions[k] = v
+	appName, ok := m["appName"].(string)
+	if !ok {
+		return nil, fmt.Errorf("appName must be a string, got %T", m["appName"])
+	}
+	if appName == "" {
+		return nil, fmt.Errorf("appName must not be empty")
 	}
-	for k, v := range context {
-		substitutions[k] = v
+
+	var users []model.UserToken
+	switch val := m["users"].(type) {
+	case string:
+		users, err = decompressUsers(val)
+		if err != nil {
+			return nil, fmt.Errorf("users could not be decompressed: %s", err.Error())
+		}
+	case []interface{}:
+		users, err = usersFromArray(val)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("users must be a compressed string or an array, got %T", m["users"])
 	}
-	message := t.ExecuteString(substitutions)
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("there must be at least one user")
+	}
+
+	message := &BatchWorkerMessage{
+		JobID:   jobID,
+		AppName: appName,
+		Users:   users,
+	}
+
 	return message, nil
 }
 
+func usersFromArray(arr []interface{}) ([]model.UserToken, error) {
+	users := make([]model.UserToken, len(arr))
+	for idx, val := range arr {
+		userMap, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("users[%d] must be an object, got %T", idx, val)
+		}
+		fields := map[string]*string{
+			"user_id": &users[idx].UserID,
+			"token":   &users[idx].Token,
+			"locale":  &users[idx].Locale,
+			"region":  &users[idx].Region,
+			"tz":      &users[idx].Tz,
+		}
+		for name, field := range fields {
+			fieldVal, ok := userMap[name]
+			if !ok || fieldVal == nil {
+				continue
+			}
+			str, ok := fieldVal.(string)
+			if !ok {
+				return nil, fmt.Errorf("users[%d].%s must be a string, got %T", idx, name, fieldVal)
+			}
+			*field = str
+		}
+	}
+	return users, nil
+}
+
+func decompressUsers(compressed string) ([]model.UserToken, error) {
+	usersCompressed, err := base64.StdEncoding.DecodeString(compressed)
+	if err != nil {
+		return nil, err
+	}
+	usersBytesReader, err := zlib.NewReader(bytes.NewReader(usersCompressed))
+	if err != nil {
+		return nil, err
+	}
+	usersBytes, err := ioutil.ReadAll(usersBytesReader)
+	if err != nil {
+		return nil, err
+	}
+	users := []model.UserToken{}
+	err = json.Unmarshal(usersBytes, &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Policies for template keys that neither the context nor the defaults resolve
+const (
+	MissingKeyDefault = model.MissingKeyDefault
+	MissingKeyEmpty   = model.MissingKeyEmpty
+	MissingKeyError   = model.MissingKeyError
+)
+
+// BuildMessageFromTemplate build a message using a template and the context.
+// Body values with control structures, e.g. {{if .premium}}...{{end}}, are rendered with text/template,
+// the others use the simple {{var}} substitution
+func BuildMessageFromTemplate(template model.Template, context map[string]interface{}) (string, error) {
+	return template.RenderWithPolicy(context, MissingKeyDefault)
+}
+
+// BuildMessageFromTemplateWithPolicy builds a message like BuildMessageFromTemplate handling the keys
+// that are missing from the context with missingKeyPolicy
+func BuildMessageFromTemplateWithPolicy(template model.Template, context map[string]interface{}, missingKeyPolicy string) (string, error) {
+	return template.RenderWithPolicy(context, missingKeyPolicy)
+}
+
 // RandomElementFromSlice gets a random element from a slice
 func RandomElementFromSlice(elements []string) string {
 	element := elements[rand.Intn(len(elements))]
@@ -25,6 +25,7 @@ package worker_test
 import (
 	"encoding/json"
 	"strings"
+	"time"
 
 	workers "github.com/jrallison/go-workers"
 	. "github.com/onsi/ginkgo"
@@ -32,11 +33,12 @@ import (
 	uuid "github.com/satori/go.uuid"
 	"github.com/topfreegames/marathon/model"
 	"github.com/topfreegames/marathon/worker"
+	"gopkg.in/pg.v5/orm"
 )
 
 var _ = Describe("Worker Util", func() {
 	var template model.Template
-	var users []worker.User
+	var users []model.UserToken
 	var usersObj []interface{}
 	var jobID string
 	var appName string
@@ -51,12 +53,12 @@ var _ = Describe("Worker Util", func() {
 			},
 		}
 
-		users = make([]worker.User, 2)
+		users = make([]model.UserToken, 2)
 		usersObj = make([]interface{}, 2)
 		for index, _ := range users {
 			id := uuid.NewV4().String()
 			token := strings.Replace(uuid.NewV4().String(), "-", "", -1)
-			users[index] = worker.User{
+			users[index] = model.UserToken{
 				UserID: id,
 				Token:  token,
 				Locale: "en",
@@ -135,6 +137,458 @@ var _ = Describe("Worker Util", func() {
 			Expect(msg["alert"]).NotTo(ContainSubstring("{{user_name}}"))
 			Expect(msg["alert"]).NotTo(ContainSubstring("{{object_name}}"))
 		})
+
+		It("should use the inline default if neither context nor defaults have the value", func() {
+			template.Body["alert"] = "{{user_name}} just visited {{city:your city}}!"
+			context := map[string]interface{}{}
+			msgString, err := worker.BuildMessageFromTemplate(template, context)
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(msg["alert"]).To(Equal("Someone just visited your city!"))
+		})
+
+		It("should prefer the context over the inline default", func() {
+			template.Body["alert"] = "{{user_name}} just visited {{city:your city}}!"
+			context := map[string]interface{}{
+				"city": "Rio",
+			}
+			msgString, err := worker.BuildMessageFromTemplate(template, context)
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(msg["alert"]).To(Equal("Someone just visited Rio!"))
+		})
+
+		It("should prefer the template defaults over the inline default", func() {
+			template.Body["alert"] = "{{user_name:a friend}} just liked your village!"
+			context := map[string]interface{}{}
+			msgString, err := worker.BuildMessageFromTemplate(template, context)
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(msg["alert"]).To(Equal("Someone just liked your village!"))
+		})
+
+		It("should escape substitutions so the message is valid json", func() {
+			context := map[string]interface{}{
+				"user_name": `Camila "the builder"`,
+			}
+			msgString, err := worker.BuildMessageFromTemplate(template, context)
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(msg["alert"]).To(Equal(`Camila "the builder" just liked your village!`))
+		})
+
+		It("should render conditionals with text/template", func() {
+			template.Body["alert"] = `{{if .premium}}{{.user_name}}, your {{.object_name}} is ready!{{else}}Upgrade to get your {{.object_name}}!{{end}}`
+			msgString, err := worker.BuildMessageFromTemplate(template, map[string]interface{}{"premium": true})
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["alert"]).To(Equal("Someone, your village is ready!"))
+
+			msgString, err = worker.BuildMessageFromTemplate(template, map[string]interface{}{"premium": false})
+			Expect(err).NotTo(HaveOccurred())
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["alert"]).To(Equal("Upgrade to get your village!"))
+		})
+
+		It("should render iterations and nested values with text/template", func() {
+			template.Body["data"] = map[string]interface{}{
+				"items": []interface{}{`{{range $i, $item := .items}}{{if $i}}, {{end}}{{$item}}{{end}}`},
+			}
+			context := map[string]interface{}{
+				"items": []interface{}{"sword", `"shield"`},
+			}
+			msgString, err := worker.BuildMessageFromTemplate(template, context)
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			data := msg["data"].(map[string]interface{})
+			Expect(data["items"]).To(Equal([]interface{}{`sword, "shield"`}))
+		})
+
+		It("should render missing keys empty or with the default function", func() {
+			template.Body["alert"] = `{{if .premium}}premium{{end}}Hi {{.city}}{{.nickname | default "friend"}}!`
+			msgString, err := worker.BuildMessageFromTemplate(template, map[string]interface{}{})
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["alert"]).To(Equal("Hi friend!"))
+		})
+
+		It("should keep text that looks like a missing key", func() {
+			template.Body["alert"] = `{{if .premium}}premium{{end}}<no value> is not {{.city}}a value`
+			msgString, err := worker.BuildMessageFromTemplate(template, map[string]interface{}{})
+			Expect(err).NotTo(HaveOccurred())
+			var msg map[string]interface{}
+			err = json.Unmarshal([]byte(msgString), &msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg["alert"]).To(Equal("<no value> is not a value"))
+		})
+
+		Describe("Pluralization", func() {
+			render := func(count interface{}) string {
+				msgString, err := worker.BuildMessageFromTemplate(template, map[string]interface{}{"count": count})
+				Expect(err).NotTo(HaveOccurred())
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(msgString), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				return msg["alert"].(string)
+			}
+
+			It("should pick the form for one and other", func() {
+				template.Body["alert"] = `You have {{.count}} new {{plural .count "message" "messages"}}`
+				Expect(render(0)).To(Equal("You have 0 new messages"))
+				Expect(render(1)).To(Equal("You have 1 new message"))
+				Expect(render(3)).To(Equal("You have 3 new messages"))
+			})
+
+			It("should pick the form for zero when there is one", func() {
+				template.Body["alert"] = `{{plural .count "Não há mensagens" "Você tem 1 mensagem" "Você tem mensagens"}}`
+				Expect(render(0)).To(Equal("Não há mensagens"))
+				Expect(render(1)).To(Equal("Você tem 1 mensagem"))
+				Expect(render(7)).To(Equal("Você tem mensagens"))
+			})
+
+			It("should parse counts sent as strings", func() {
+				template.Body["alert"] = `{{plural .count "message" "messages"}}`
+				Expect(render("1")).To(Equal("message"))
+				Expect(render("12")).To(Equal("messages"))
+			})
+
+			It("should pick the form for one with the plural rules of the template locale", func() {
+				template.Body["alert"] = `{{plural .count "message" "messages"}}`
+				template.Locale = "fr"
+				Expect(render(0)).To(Equal("message"))
+				Expect(render(1.5)).To(Equal("message"))
+				Expect(render(2)).To(Equal("messages"))
+
+				template.Locale = "ru"
+				Expect(render(21)).To(Equal("message"))
+				Expect(render(11)).To(Equal("messages"))
+			})
+
+			It("should use the other form when there is no count", func() {
+				template.Body["alert"] = `{{plural .count "message" "messages"}}`
+				Expect(render(nil)).To(Equal("messages"))
+			})
+		})
+
+		Describe("Missing key policies", func() {
+			BeforeEach(func() {
+				template.Body["alert"] = "{{user_name}} just liked your {{object_name}} in {{city:your city}}!{{badge}}"
+			})
+
+			It("should use the defaults and render missing keys empty with the default policy", func() {
+				msgString, err := worker.BuildMessageFromTemplateWithPolicy(template, map[string]interface{}{}, worker.MissingKeyDefault)
+				Expect(err).NotTo(HaveOccurred())
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(msgString), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg["alert"]).To(Equal("Someone just liked your village in your city!"))
+			})
+
+			It("should use the defaults and render only the keys without one empty with the empty policy", func() {
+				context := map[string]interface{}{"user_name": "Camila"}
+				msgString, err := worker.BuildMessageFromTemplateWithPolicy(template, context, worker.MissingKeyEmpty)
+				Expect(err).NotTo(HaveOccurred())
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(msgString), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg["alert"]).To(Equal("Camila just liked your village in your city!"))
+			})
+
+			It("should list the unresolved keys with the error policy", func() {
+				_, err := worker.BuildMessageFromTemplateWithPolicy(template, map[string]interface{}{}, worker.MissingKeyError)
+				Expect(err).To(MatchError("unresolved template keys: badge"))
+			})
+
+			It("should not fail with the error policy if every key is resolved", func() {
+				context := map[string]interface{}{"badge": " (gold)"}
+				msgString, err := worker.BuildMessageFromTemplateWithPolicy(template, context, worker.MissingKeyError)
+				Expect(err).NotTo(HaveOccurred())
+				var msg map[string]interface{}
+				err = json.Unmarshal([]byte(msgString), &msg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(msg["alert"]).To(Equal("Someone just liked your village in your city! (gold)"))
+			})
+
+			It("should fail text/template bodies with missing keys with the error policy", func() {
+				template.Body["alert"] = "{{if .premium}}premium{{end}}"
+				_, err := worker.BuildMessageFromTemplateWithPolicy(template, map[string]interface{}{}, worker.MissingKeyError)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("should return an error for an invalid policy", func() {
+				_, err := worker.BuildMessageFromTemplateWithPolicy(template, map[string]interface{}{}, "ignore")
+				Expect(err).To(MatchError("invalid missing key policy 'ignore'"))
+			})
+		})
+
+		Describe("Template render", func() {
+			It("should render the same message as the worker with the context over the defaults", func() {
+				context := map[string]interface{}{"user_name": "Camila"}
+				rendered, err := template.Render(context)
+				Expect(err).NotTo(HaveOccurred())
+				built, err := worker.BuildMessageFromTemplate(template, context)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rendered).To(Equal(built))
+			})
+
+			It("should fail if a key is left unresolved", func() {
+				template.Body["alert"] = "{{user_name}} earned {{badge}}"
+				_, err := template.Render(map[string]interface{}{})
+				Expect(err).To(MatchError("unresolved template keys: badge"))
+			})
+		})
+
+		It("should return an error if the text/template is invalid", func() {
+			template.Body["alert"] = `{{if .premium}}premium`
+			_, err := worker.BuildMessageFromTemplate(template, map[string]interface{}{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Get push expiry", func() {
+		It("should use the job pushExpiry if it is set", func() {
+			job := &model.Job{
+				PushExpiry: 1500000000,
+				ExpiresAt:  1600000000000000000,
+			}
+			Expect(worker.GetPushExpiry(job, 10)).To(BeEquivalentTo(1500000000))
+		})
+
+		It("should use the job expiresAt in seconds if pushExpiry is not set", func() {
+			job := &model.Job{
+				ExpiresAt: 1600000000000000000,
+			}
+			Expect(worker.GetPushExpiry(job, 10)).To(BeEquivalentTo(1600000000))
+		})
+
+		It("should fallback to the default if neither pushExpiry nor expiresAt are set", func() {
+			job := &model.Job{}
+			Expect(worker.GetPushExpiry(job, 10)).To(BeEquivalentTo(10))
+		})
+	})
+
+	Describe("Get control group size", func() {
+		It("should round the control group up", func() {
+			size, err := worker.GetControlGroupSize(10, 0.15)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(Equal(2))
+
+			size, err = worker.GetControlGroupSize(10, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(Equal(0))
+		})
+
+		It("should fail instead of panicking if the control group takes every user", func() {
+			var err error
+			Expect(func() { _, err = worker.GetControlGroupSize(1, 0.1) }).NotTo(Panic())
+			Expect(err).To(MatchError("control group size cannot be higher than number of users"))
+		})
+	})
+
+	Describe("Is job expired", func() {
+		It("should be expired after the job expiresAt", func() {
+			now := time.Now()
+			job := &model.Job{ExpiresAt: now.UnixNano()}
+			Expect(worker.IsJobExpired(job, now.Add(-time.Second))).To(BeFalse())
+			Expect(worker.IsJobExpired(job, now.Add(time.Second))).To(BeTrue())
+		})
+
+		It("should never expire a job without expiresAt", func() {
+			job := &model.Job{}
+			Expect(worker.IsJobExpired(job, time.Now().Add(24*time.Hour))).To(BeFalse())
+		})
+	})
+
+	Describe("Has total tokens drifted", func() {
+		It("should return false if the count is within the max drift", func() {
+			Expect(worker.HasTotalTokensDrifted(100, 105, 0.1)).To(BeFalse())
+			Expect(worker.HasTotalTokensDrifted(100, 95, 0.1)).To(BeFalse())
+		})
+
+		It("should return true if the count is beyond the max drift", func() {
+			Expect(worker.HasTotalTokensDrifted(100, 111, 0.1)).To(BeTrue())
+			Expect(worker.HasTotalTokensDrifted(100, 89, 0.1)).To(BeTrue())
+		})
+
+		It("should return false if there is no snapshot", func() {
+			Expect(worker.HasTotalTokensDrifted(0, 100, 0.1)).To(BeFalse())
+		})
+	})
+
+	Describe("Drop users with empty token", func() {
+		It("should keep users with token", func() {
+			valid, dropped := worker.DropUsersWithEmptyToken(users)
+			Expect(dropped).To(Equal(0))
+			Expect(valid).To(Equal(users))
+		})
+
+		It("should drop users without token", func() {
+			users[0].Token = ""
+			valid, dropped := worker.DropUsersWithEmptyToken(users)
+			Expect(dropped).To(Equal(1))
+			Expect(valid).To(Equal([]model.UserToken{users[1]}))
+		})
+	})
+
+	Describe("Drop users with duplicated token", func() {
+		It("should keep users with distinct tokens", func() {
+			unique, dropped := worker.DropDuplicatedTokens(users)
+			Expect(dropped).To(Equal(0))
+			Expect(unique).To(Equal(users))
+		})
+
+		It("should keep only the first user of each token", func() {
+			duplicated := append(users, users[0])
+			unique, dropped := worker.DropDuplicatedTokens(duplicated)
+			Expect(dropped).To(Equal(1))
+			Expect(unique).To(Equal(users))
+		})
+	})
+
+	Describe("Normalize locale", func() {
+		It("should keep well formed locales", func() {
+			Expect(worker.NormalizeLocale("en", "en")).To(Equal("en"))
+			Expect(worker.NormalizeLocale("pt-BR", "en")).To(Equal("pt-br"))
+		})
+
+		It("should accept the underscore form", func() {
+			Expect(worker.NormalizeLocale("pt_BR", "en")).To(Equal("pt-br"))
+			Expect(worker.NormalizeLocale(" en_US ", "en")).To(Equal("en-us"))
+		})
+
+		It("should keep deprecated language codes", func() {
+			Expect(worker.NormalizeLocale("iw", "en")).To(Equal("iw"))
+			Expect(worker.NormalizeLocale("in_ID", "en")).To(Equal("in-id"))
+		})
+
+		It("should fall back to the default locale for garbage", func() {
+			Expect(worker.NormalizeLocale("en_US_extra", "en")).To(Equal("en"))
+			Expect(worker.NormalizeLocale("!!!", "en")).To(Equal("en"))
+			Expect(worker.NormalizeLocale("", "fr")).To(Equal("fr"))
+		})
+
+		It("should count the users whose locale changed", func() {
+			users := []model.UserToken{
+				{UserID: "a", Token: "a", Locale: "en"},
+				{UserID: "b", Token: "b", Locale: "pt-BR"},
+				{UserID: "c", Token: "c", Locale: "pt_BR"},
+				{UserID: "d", Token: "d", Locale: "en_US_extra"},
+			}
+			normalized, count := worker.NormalizeUsersLocale(users, "en")
+			Expect(count).To(Equal(2))
+			Expect(normalized[0].Locale).To(Equal("en"))
+			Expect(normalized[1].Locale).To(Equal("pt-br"))
+			Expect(normalized[2].Locale).To(Equal("pt-br"))
+			Expect(normalized[3].Locale).To(Equal("en"))
+		})
+	})
+
+	Describe("Find template", func() {
+		templatesByLocale := map[string]model.Template{
+			"en":    {Name: "tpl", Locale: "en"},
+			"pt":    {Name: "tpl", Locale: "pt"},
+			"fr-ca": {Name: "tpl", Locale: "fr-ca"},
+		}
+
+		It("should match the exact locale", func() {
+			template, locale, ok := worker.FindTemplate(templatesByLocale, "FR-CA", "en")
+			Expect(ok).To(BeTrue())
+			Expect(locale).To(Equal("fr-ca"))
+			Expect(template.Locale).To(Equal("fr-ca"))
+		})
+
+		It("should fall back to the locale language", func() {
+			template, locale, ok := worker.FindTemplate(templatesByLocale, "pt-BR", "en")
+			Expect(ok).To(BeTrue())
+			Expect(locale).To(Equal("pt"))
+			Expect(template.Locale).To(Equal("pt"))
+		})
+
+		It("should match templates stored under deprecated codes before the current ones", func() {
+			byLocale := map[string]model.Template{
+				"iw": {Name: "tpl", Locale: "iw"},
+				"he": {Name: "tpl", Locale: "he"},
+				"id": {Name: "tpl", Locale: "id"},
+			}
+			_, locale, ok := worker.FindTemplate(byLocale, worker.NormalizeLocale("iw", "en"), "en")
+			Expect(ok).To(BeTrue())
+			Expect(locale).To(Equal("iw"))
+			_, locale, ok = worker.FindTemplate(byLocale, worker.NormalizeLocale("in_ID", "en"), "en")
+			Expect(ok).To(BeTrue())
+			Expect(locale).To(Equal("id"))
+		})
+
+		It("should fall back to the default locale", func() {
+			template, locale, ok := worker.FindTemplate(templatesByLocale, "de-DE", "en")
+			Expect(ok).To(BeTrue())
+			Expect(locale).To(Equal("en"))
+			Expect(template.Locale).To(Equal("en"))
+		})
+
+		It("should not match if there is no template for the locale or the default", func() {
+			_, _, ok := worker.FindTemplate(templatesByLocale, "de", "es")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Compare versions", func() {
+		It("should compare versions numerically", func() {
+			Expect(worker.CompareVersions("1.2", "1.10")).To(Equal(-1))
+			Expect(worker.CompareVersions("2.0", "1.10")).To(Equal(1))
+			Expect(worker.CompareVersions("1.2.0", "1.2")).To(Equal(0))
+		})
+	})
+
+	Describe("Get users columns", func() {
+		It("should fetch the service of the users if the push table has it", func() {
+			job := &model.Job{}
+			Expect(worker.GetUsersColumns(job, []string{"user_id", "token", "service"})).To(Equal("user_id, token, locale, tz, service"))
+		})
+
+		It("should not fetch the service of the users if the push table doesn't have it", func() {
+			job := &model.Job{}
+			Expect(worker.GetUsersColumns(job, []string{"user_id", "token"})).To(Equal("user_id, token, locale, tz"))
+		})
+	})
+
+	Describe("Get version template name", func() {
+		versionTemplates := []model.VersionTemplate{
+			{MaxVersion: "2.0", TemplateName: "old"},
+			{MinVersion: "2.0", MaxVersion: "3.0", TemplateName: "current"},
+		}
+
+		It("should select the template whose range contains the version", func() {
+			Expect(worker.GetVersionTemplateName(versionTemplates, "1.9.9")).To(Equal("old"))
+			Expect(worker.GetVersionTemplateName(versionTemplates, "2.0")).To(Equal("current"))
+			Expect(worker.GetVersionTemplateName(versionTemplates, "2.5.1")).To(Equal("current"))
+		})
+
+		It("should return empty if no range matches", func() {
+			Expect(worker.GetVersionTemplateName(versionTemplates, "3.0")).To(BeEmpty())
+		})
+
+		It("should return empty if the version is unknown", func() {
+			Expect(worker.GetVersionTemplateName(versionTemplates, "")).To(BeEmpty())
+		})
 	})
 
 	Describe("Parse ProcessBatchWorker message array", func() {
@@ -167,6 +621,35 @@ var _ = Describe("Worker Util", func() {
 			}
 		})
 
+		It("should succeed if array has a version tag", func() {
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			arr := []interface{}{worker.ProcessBatchMessageV1, jobID, appName, compressedUsers}
+
+			parsed, err := worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.JobID.String()).To(Equal(jobID))
+			Expect(parsed.AppName).To(Equal(appName))
+			Expect(parsed.Users).To(Equal(users))
+		})
+
+		It("should fail if array has an unsupported version tag", func() {
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			arr := []interface{}{"v99", jobID, appName, compressedUsers}
+
+			_, err = worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("unsupported message array version 'v99'"))
+		})
+
+		It("should fail if versioned array has less than 3 elements", func() {
+			arr := []interface{}{worker.ProcessBatchMessageV1, jobID, appName}
+			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(worker.InvalidMessageArray))
+		})
+
 		It("should fail if array has less than 3 elements", func() {
 			arr := []interface{}{jobID, appName}
 			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
@@ -192,21 +675,135 @@ var _ = Describe("Worker Util", func() {
 			arr := []interface{}{jobID, appName, "some-string"}
 			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(Equal("illegal base64 data at input byte 4"))
+			Expect(err.Error()).To(Equal("users could not be decompressed: illegal base64 data at input byte 4"))
 		})
 
 		It("should fail if users is an empty array", func() {
 			emptyUsers := []interface{}{}
 			arr := []interface{}{jobID, appName, emptyUsers}
-			Expect(func() { worker.ParseProcessBatchWorkerMessageArray(arr) }).Should(Panic())
+			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("users must be a compressed string, got []interface {}"))
+		})
+
+		It("should fail if jobID is not a string", func() {
+			arr := []interface{}{123, appName, usersObj}
+			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("jobId must be a string, got int"))
+		})
+
+		It("should fail if appName is not a string", func() {
+			arr := []interface{}{jobID, map[string]interface{}{}, usersObj}
+			_, err := worker.ParseProcessBatchWorkerMessageArray(arr)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("appName must be a string, got map[string]interface {}"))
+		})
+	})
+
+	Describe("New BatchWorkerMessage from map", func() {
+		It("should succeed with compressed users", func() {
+			compressedUsers, err := worker.CompressUsers(&users)
+			Expect(err).NotTo(HaveOccurred())
+			parsed, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   jobID,
+				"appName": appName,
+				"users":   compressedUsers,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.JobID.String()).To(Equal(jobID))
+			Expect(parsed.AppName).To(Equal(appName))
+			Expect(parsed.Users).To(Equal(users))
+		})
+
+		It("should succeed with an array of users", func() {
+			parsed, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   jobID,
+				"appName": appName,
+				"users":   usersObj,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.JobID.String()).To(Equal(jobID))
+			Expect(parsed.AppName).To(Equal(appName))
+			Expect(parsed.Users).To(Equal(users))
+		})
+
+		It("should fail if jobId is not a string", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   123,
+				"appName": appName,
+				"users":   usersObj,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("jobId must be a string, got int"))
+		})
+
+		It("should fail if jobId is not uuid", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   "some-string",
+				"appName": appName,
+				"users":   usersObj,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("jobId must be a valid uuid"))
+		})
+
+		It("should fail if appName is missing", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId": jobID,
+				"users": usersObj,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("appName must be a string, got <nil>"))
+		})
 
+		It("should fail if users has the wrong type", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   jobID,
+				"appName": appName,
+				"users":   42,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("users must be a compressed string or an array, got int"))
+		})
+
+		It("should fail if a user field has the wrong type", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   jobID,
+				"appName": appName,
+				"users": []interface{}{
+					map[string]interface{}{"user_id": "id", "token": 123},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("users[0].token must be a string, got int"))
+		})
+
+		It("should fail if users is an empty array", func() {
+			_, err := worker.NewBatchWorkerMessageFromMap(map[string]interface{}{
+				"jobId":   jobID,
+				"appName": appName,
+				"users":   []interface{}{},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("there must be at least one user"))
 		})
 	})
 
 	Describe("Get Clause From Filters", func() {
+		// formatWhere renders the clause with its arguments the way pg sends it to the database
+		formatWhere := func(filters map[string]interface{}) (string, error) {
+			where, args, err := worker.GetWhereClauseFromFilters(filters)
+			if err != nil {
+				return "", err
+			}
+			return string(orm.Formatter{}.FormatQuery(nil, where, args...)), nil
+		}
+
 		It("should return empty string if filters is empty", func() {
 			filters := map[string]interface{}{}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(Equal(""))
 		})
 
@@ -214,7 +811,8 @@ var _ = Describe("Worker Util", func() {
 			filters := map[string]interface{}{
 				"region": "US",
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(Equal("\"region\"='US'"))
 		})
 
@@ -222,7 +820,8 @@ var _ = Describe("Worker Util", func() {
 			filters := map[string]interface{}{
 				"region": "US,CA",
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(Equal("(\"region\"='US' OR \"region\"='CA')"))
 		})
 
@@ -230,7 +829,8 @@ var _ = Describe("Worker Util", func() {
 			filters := map[string]interface{}{
 				"NOTregion": "US",
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(Equal("\"region\"!='US'"))
 		})
 
@@ -238,7 +838,8 @@ var _ = Describe("Worker Util", func() {
 			filters := map[string]interface{}{
 				"NOTregion": "US,CA",
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(Equal("(\"region\"!='US' AND \"region\"!='CA')"))
 		})
 
@@ -247,10 +848,161 @@ var _ = Describe("Worker Util", func() {
 				"NOTregion": "US,CA",
 				"locale":    "en,fr",
 			}
-			where := worker.GetWhereClauseFromFilters(filters)
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
 			Expect(where).To(ContainSubstring("(\"locale\"='en' OR \"locale\"='fr')"))
 			Expect(where).To(ContainSubstring("(\"region\"!='US' AND \"region\"!='CA')"))
 			Expect(where).To(ContainSubstring(") AND ("))
 		})
+
+		It("should filter by the days since the token was updated", func() {
+			filters := map[string]interface{}{
+				"lastActiveDays": float64(30),
+				"locale":         "en",
+			}
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(ContainSubstring("\"updated_at\">=now()-interval '30 days'"))
+			Expect(where).To(ContainSubstring("\"locale\"='en'"))
+
+			filters = map[string]interface{}{"lastActiveDays": "7"}
+			where, err = formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("\"updated_at\">=now()-interval '7 days'"))
+		})
+
+		It("should fail if the days since the token was updated are invalid", func() {
+			for _, days := range []interface{}{"30 days'; DROP TABLE myapp_apns; --", "-1", float64(0), 1.5, true} {
+				filters := map[string]interface{}{"lastActiveDays": days}
+				_, _, err := worker.GetWhereClauseFromFilters(filters)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("should fail if a filter is not a column name", func() {
+			for _, key := range []string{"region\"='US' OR 1=1; --", "region>=", "Region", "NOT"} {
+				filters := map[string]interface{}{key: "US"}
+				_, _, err := worker.GetWhereClauseFromFilters(filters)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("should match a list of values with IN", func() {
+			filters := map[string]interface{}{
+				"locale": []interface{}{"pt", "es", "en"},
+			}
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("\"locale\" IN ('pt','es','en')"))
+
+			filters = map[string]interface{}{
+				"NOTlocale": []interface{}{"pt", "es"},
+			}
+			where, err = formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("\"locale\" NOT IN ('pt','es')"))
+		})
+
+		It("should fail if the list of values is empty", func() {
+			for _, key := range []string{"locale", "NOTlocale"} {
+				filters := map[string]interface{}{key: []interface{}{}}
+				_, _, err := worker.GetWhereClauseFromFilters(filters)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("should match a range of numbers with BETWEEN", func() {
+			filters := map[string]interface{}{
+				"tz": map[string]interface{}{"between": []interface{}{"-0300", "+0000"}},
+			}
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal(
+				"CASE WHEN \"tz\"::text ~ '^[+-]{0,1}[0-9]+([.][0-9]+){0,1}$' THEN \"tz\"::text::numeric END BETWEEN '-300' AND '0'",
+			))
+
+			filters = map[string]interface{}{
+				"NOTtz": map[string]interface{}{"between": []interface{}{float64(-500), "0130"}},
+			}
+			where, err = formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal(
+				"CASE WHEN \"tz\"::text ~ '^[+-]{0,1}[0-9]+([.][0-9]+){0,1}$' THEN \"tz\"::text::numeric END NOT BETWEEN '-500' AND '130'",
+			))
+		})
+
+		It("should fail if the range is invalid", func() {
+			for _, val := range []interface{}{
+				map[string]interface{}{"between": []interface{}{"-0300"}},
+				map[string]interface{}{"between": []interface{}{"-0300", 2}},
+				map[string]interface{}{"between": []interface{}{"-0300", "0000'; --"}},
+				map[string]interface{}{"between": []interface{}{"-0300", "Inf"}},
+				map[string]interface{}{"between": []interface{}{"+0000", "-0300"}},
+				map[string]interface{}{"between": "-0300,+0000"},
+				map[string]interface{}{"min": "-0300", "max": "+0000"},
+			} {
+				filters := map[string]interface{}{"tz": val}
+				_, _, err := worker.GetWhereClauseFromFilters(filters)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("should allow a range on any filter column", func() {
+			filters := map[string]interface{}{
+				"app_version": map[string]interface{}{"between": []interface{}{"1", "2.5"}},
+			}
+			where, args, err := worker.GetWhereClauseFromFilters(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(HavePrefix("CASE WHEN \"app_version\"::text ~ "))
+			Expect(where).To(HaveSuffix("END BETWEEN ? AND ?"))
+			Expect(where).NotTo(ContainSubstring("2.5"))
+			Expect(args).To(Equal([]interface{}{"1", "2.5"}))
+		})
+
+		It("should only allow the filters on columns of the push table", func() {
+			columns := []string{"user_id", "token", "region", "locale", "updated_at"}
+			err := worker.ValidateFilterColumns(map[string]interface{}{
+				"NOTregion":      "US",
+				"locale":         []interface{}{"en"},
+				"lastActiveDays": float64(7),
+			}, columns)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = worker.ValidateFilterColumns(map[string]interface{}{"token": "abc"}, columns)
+			Expect(err).To(HaveOccurred())
+
+			err = worker.ValidateFilterColumns(map[string]interface{}{"NOTapp_version": "1.0"}, columns)
+			Expect(err).To(MatchError("unsupported filter 'NOTapp_version', the push table has no column app_version"))
+
+			err = worker.ValidateFilterColumns(map[string]interface{}{"lastActiveDays": float64(7)}, columns[:4])
+			Expect(err).To(MatchError("unsupported filter 'lastActiveDays', the push table has no column updated_at"))
+		})
+
+		It("should quote the values of the filters", func() {
+			filters := map[string]interface{}{
+				"locale": "en' OR '1'='1",
+			}
+			where, err := formatWhere(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("\"locale\"='en'' OR ''1''=''1'"))
+		})
+
+		It("should pass the values of the filters as arguments", func() {
+			filters := map[string]interface{}{
+				"NOTlocale": []interface{}{"pt", "es"},
+			}
+			where, args, err := worker.GetWhereClauseFromFilters(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("\"locale\" NOT IN (?)"))
+			Expect(args).To(HaveLen(1))
+
+			filters = map[string]interface{}{
+				"region": "US,CA",
+			}
+			where, args, err = worker.GetWhereClauseFromFilters(filters)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(where).To(Equal("(\"region\"=? OR \"region\"=?)"))
+			Expect(args).To(Equal([]interface{}{"US", "CA"}))
+		})
 	})
 })
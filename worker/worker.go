@@ -23,12 +23,17 @@
 package worker
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -47,18 +52,37 @@ import (
 type Worker struct {
 	Logger                    zap.Logger
 	PushDB                    interfaces.DB
+	PushReadDB                interfaces.DB // push.replica if it is configured, otherwise the same as PushDB
 	MarathonDB                interfaces.DB
 	Config                    *viper.Viper
 	DBPageSize                int
 	S3Client                  interfaces.S3
 	PageProcessingConcurrency int
 	Statsd                    *statsd.Client
-	RedisClient               *redis.Client
+	RedisClient               interfaces.Redis
 	ConfigPath                string
 	SendgridClient            *extensions.SendgridClient
 	Kafka                     interfaces.PushProducer
 
 	Manager *goworkers2.Manager
+
+	stopping     int32
+	inFlight     sync.WaitGroup
+	stopOnce     sync.Once
+	closeOnce    sync.Once
+	shutdownOnce sync.Once
+	closed       chan struct{}
+
+	jobsLock  sync.Mutex
+	jobsInRun map[uuid.UUID]int
+
+	pushColumnsLock sync.Mutex
+	pushColumns     map[string]cachedPushColumns
+
+	statusOnce      sync.Once
+	statusCoalescer *statusCoalescer
+
+	statsServer *http.Server
 }
 
 // NewWorker returns a configured worker
@@ -66,6 +90,7 @@ func NewWorker(l zap.Logger, configPath string) *Worker {
 	worker := &Worker{
 		Logger:     l,
 		ConfigPath: configPath,
+		closed:     make(chan struct{}),
 	}
 
 	worker.configure()
@@ -75,7 +100,9 @@ func NewWorker(l zap.Logger, configPath string) *Worker {
 func (w *Worker) configure() {
 	w.Config = viper.New()
 
-	w.Config.SetConfigFile(w.ConfigPath)
+	if err := extensions.SetConfigFile(w.Config, w.ConfigPath); err != nil {
+		panic(err)
+	}
 	w.Config.SetEnvPrefix("marathon")
 	w.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	w.Config.AutomaticEnv()
@@ -86,6 +113,9 @@ func (w *Worker) configure() {
 		panic(err)
 	}
 	w.loadConfigurationDefaults()
+	if err := ValidateConfig(w.Config); err != nil {
+		panic(err)
+	}
 	w.configureSentry()
 	w.configureRedis()
 	w.configureStatsd()
@@ -102,13 +132,115 @@ func (w *Worker) loadConfigurationDefaults() {
 	w.Config.SetDefault("workers.redis.server", "localhost:6379")
 	w.Config.SetDefault("workers.redis.database", "0")
 	w.Config.SetDefault("workers.redis.poolSize", "10")
+	w.Config.SetDefault("workers.redis.mode", extensions.RedisModeSingle)
 	w.Config.SetDefault("workers.statsPort", 8081)
+	w.Config.SetDefault("healthcheck.workingText", "WORKING")
+	w.Config.SetDefault("workers.pgPingTimeout", "5s")
 	w.Config.SetDefault("workers.concurrency", 10)
+	w.Config.SetDefault("workers.pushExpiry", 0)
+	w.Config.SetDefault("workers.dropEmptyTokens", true)
+	w.Config.SetDefault("workers.dryRun.enabled", false)
+	w.Config.SetDefault("workers.dryRun.sampleSize", 10)
+	w.Config.SetDefault("workers.locale.normalize", true)
+	w.Config.SetDefault("workers.locale.default", "en")
+	w.Config.SetDefault("workers.templates.defaultLocale", "en")
+	w.Config.SetDefault("workers.templates.missingKeyPolicy", "default")
+	w.Config.SetDefault("workers.templates.missingTTL", "30s")
+	w.Config.SetDefault("workers.status.ttl", "720h")
+	w.Config.SetDefault("workers.gracefulShutdownTimeout", 30)
+	w.Config.SetDefault("workers.status.retryAttempts", 3)
+	w.Config.SetDefault("workers.status.retryBackoff", "100ms")
+	w.Config.SetDefault("workers.status.maxWritesPerSecond", 0)
+	w.Config.SetDefault("workers.status.jitter", 0.2)
+	w.Config.SetDefault("workers.direct.maxTotalTokensDrift", 0.1)
+	w.Config.SetDefault("workers.direct.resume", false)
+	w.Config.SetDefault("workers.direct.cancelCheckInterval", 1000)
+	w.Config.SetDefault("workers.direct.tokensTTL", "24h")
+	w.Config.SetDefault("workers.postgres.pagination", "range")
+	w.Config.SetDefault("workers.postgres.dedup", false)
+	w.Config.SetDefault("workers.postgres.autoTuneBatch", false)
+	w.Config.SetDefault("workers.postgres.targetBytesPerPage", 10*1024*1024)
+	w.Config.SetDefault("workers.postgres.minPageSize", 1000)
+	w.Config.SetDefault("workers.postgres.maxPageSize", 1000000)
+	w.Config.SetDefault("workers.postgres.tuneSampleEvery", 10)
+	w.Config.SetDefault("workers.postgres.columnsTTL", "5m")
 	w.Config.SetDefault("database.url", "postgres://localhost:5432/marathon?sslmode=disable")
 	w.Config.SetDefault("workers.statsd.host", "127.0.0.1:8125")
 	w.Config.SetDefault("workers.statsd.prefix", "marathon.")
 }
 
+type requiredKey struct {
+	key     string
+	integer bool
+}
+
+// requiredConfig are the keys that must be set before connecting to anything
+var requiredConfig = []requiredKey{
+	{"db.host", false},
+	{"db.port", true},
+	{"db.user", false},
+	{"db.database", false},
+	{"push.db.host", false},
+	{"push.db.port", true},
+	{"push.db.user", false},
+	{"push.db.database", false},
+}
+
+// requiredRedisConfig are the keys of the workers redis that must be set in each redis mode, in
+// cluster mode the job queue needs a standalone redis because go-workers2 has no cluster client
+var requiredRedisConfig = map[string][]requiredKey{
+	extensions.RedisModeSingle: {
+		{"workers.redis.host", false},
+		{"workers.redis.port", true},
+	},
+	extensions.RedisModeSentinel: {
+		{"workers.redis.sentinel.master", false},
+		{"workers.redis.sentinel.addrs", false},
+	},
+	extensions.RedisModeCluster: {
+		{"workers.redis.cluster.addrs", false},
+		{"workers.redis.queue.host", false},
+		{"workers.redis.queue.port", true},
+	},
+}
+
+// ValidateConfig returns an error listing every required key that is missing or isn't of the right type
+func ValidateConfig(config *viper.Viper) error {
+	missing := []string{}
+	invalid := []string{}
+	problems := []string{}
+	redisMode := config.GetString("workers.redis.mode")
+	if redisMode == "" {
+		redisMode = extensions.RedisModeSingle
+	}
+	redisConfig, ok := requiredRedisConfig[redisMode]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("unknown workers.redis.mode: %s", redisMode))
+	}
+	for _, required := range append(redisConfig, requiredConfig...) {
+		value := config.Get(required.key)
+		if value == nil || fmt.Sprint(value) == "" {
+			missing = append(missing, required.key)
+			continue
+		}
+		// values set by environment variables are strings
+		if _, err := strconv.Atoi(fmt.Sprint(value)); required.integer && err != nil {
+			invalid = append(invalid, required.key)
+		}
+	}
+
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing config: %s", strings.Join(missing, ", ")))
+	}
+	if len(invalid) > 0 {
+		problems = append(problems, fmt.Sprintf("config must be an integer: %s", strings.Join(invalid, ", ")))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
 func (w *Worker) configureSendgrid() {
 	apiKey := w.Config.GetString("sendgrid.key")
 	if apiKey != "" {
@@ -119,12 +251,26 @@ func (w *Worker) configureSendgrid() {
 func (w *Worker) configurePushDatabase() {
 	connection, err := extensions.NewPGClient("push.db", w.Config, w.Logger)
 	checkErr(w.Logger, err)
+	// pg connects lazily, so a misconfigured host only shows up here instead of on the first job
+	checkErr(w.Logger, connection.Ping(w.Config.GetDuration("workers.pgPingTimeout")))
 	w.PushDB = connection.DB
+
+	// the tokens of the jobs are read from the replica so big jobs don't load the primary
+	w.PushReadDB = w.PushDB
+	if w.Config.GetString("push.replica.host") == "" {
+		return
+	}
+	replica, err := extensions.NewPGClient("push.replica", w.Config, w.Logger)
+	checkErr(w.Logger, err)
+	checkErr(w.Logger, replica.Ping(w.Config.GetDuration("workers.pgPingTimeout")))
+	w.PushReadDB = replica.DB
 }
 
 func (w *Worker) configureMarathonDatabase() {
 	connection, err := extensions.NewPGClient("db", w.Config, w.Logger)
 	checkErr(w.Logger, err)
+	// pg connects lazily, so a misconfigured host only shows up here instead of on the first job
+	checkErr(w.Logger, connection.Ping(w.Config.GetDuration("workers.pgPingTimeout")))
 	w.MarathonDB = connection.DB
 }
 
@@ -174,6 +320,17 @@ func (w *Worker) configureRedis() {
 		ProcessID:  hostname,
 		Password:   redisPassword,
 	}
+	switch w.Config.GetString("workers.redis.mode") {
+	case extensions.RedisModeSentinel:
+		opt.ServerAddr = ""
+		opt.SentinelAddrs = strings.Join(extensions.RedisAddrs(w.Config.GetString("workers.redis.sentinel.addrs")), ",")
+		opt.RedisMasterName = w.Config.GetString("workers.redis.sentinel.master")
+	case extensions.RedisModeCluster:
+		// the queue has no cluster client, so it uses a standalone redis
+		opt.ServerAddr = fmt.Sprintf("%s:%d", w.Config.GetString("workers.redis.queue.host"), w.Config.GetInt("workers.redis.queue.port"))
+		opt.Database = w.Config.GetInt("workers.redis.queue.db")
+		opt.Password = w.Config.GetString("workers.redis.queue.pass")
+	}
 	if tlsEnabled {
 		opt.RedisTLSConfig = &tls.Config{
 			InsecureSkipVerify: true,
@@ -227,6 +384,14 @@ func (w *Worker) configureSentry() {
 }
 
 func (w *Worker) configureKafkaProducer() {
+	if w.IsDryRun() {
+		// the jobs run through the whole pipeline and report their totals, but nothing is pushed
+		w.Logger.Warn("Running in dry run mode, pushes are discarded.")
+		producer := extensions.NewDiscardProducer(w.Logger, w.Config.GetInt("workers.dryRun.sampleSize"))
+		producer.OnSample = w.AddDryRunSample
+		w.Kafka = producer
+		return
+	}
 	var kafka *extensions.KafkaProducer
 	var err error
 	kafka, err = extensions.NewKafkaProducer(w.Config, w.Logger, w.Statsd)
@@ -283,6 +448,96 @@ func (w *Worker) CreateDirectBatchesJob(job *model.Job) error {
 	})
 }
 
+// CreateDirectPageJob enqueues a single page of a DirectWorker job
+func (w *Worker) CreateDirectPageJob(msg DirectPartMsg) (string, error) {
+	maxRetries := w.Config.GetInt("workers.direct.maxRetries")
+	producer := w.Manager.Producer()
+	return producer.EnqueueWithOptions("direct_worker", "Add", msg, goworkers2.EnqueueOptions{
+		Retry:      true,
+		RetryCount: maxRetries,
+	})
+}
+
+// PushTableExists returns whether the push database has the table with the tokens of an app and service,
+// in the schema the queries of the workers use
+func (w *Worker) PushTableExists(tableName string) (bool, error) {
+	var exists bool
+	_, err := w.PushDB.QueryOne(&exists, "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?)", tableName)
+	return exists, err
+}
+
+// GetPushTableColumns returns the columns of a push table, which are the ones its jobs can filter by
+func (w *Worker) GetPushTableColumns(tableName string) ([]string, error) {
+	var columns []string
+	_, err := w.PushDB.Query(&columns, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ?", tableName)
+	return columns, err
+}
+
+// cachedPushColumns are the columns of a push table and when they were read
+type cachedPushColumns struct {
+	columns   []string
+	fetchedAt time.Time
+}
+
+// getCachedPushTableColumns returns the columns of a push table for the pages and batches of its jobs,
+// they are read once per workers.postgres.columnsTTL instead of once per page, or every time when it
+// is 0. The columns were already
+// validated when the job was created, so when the lookup fails the last columns read are used, or none,
+// which only means the users are sent to the service of the job
+func (w *Worker) getCachedPushTableColumns(tableName string) []string {
+	ttl := w.Config.GetDuration("workers.postgres.columnsTTL")
+	w.pushColumnsLock.Lock()
+	cached, ok := w.pushColumns[tableName]
+	w.pushColumnsLock.Unlock()
+	if ok && ttl > 0 && time.Since(cached.fetchedAt) < ttl {
+		return cached.columns
+	}
+
+	columns, err := w.GetPushTableColumns(tableName)
+	if err != nil {
+		w.Logger.Warn(
+			"Failed to get the push table columns.", zap.String("table", tableName), zap.Error(err),
+		)
+		return cached.columns
+	}
+
+	w.pushColumnsLock.Lock()
+	defer w.pushColumnsLock.Unlock()
+	if w.pushColumns == nil {
+		w.pushColumns = map[string]cachedPushColumns{}
+	}
+	w.pushColumns[tableName] = cachedPushColumns{columns: columns, fetchedAt: time.Now()}
+	return columns
+}
+
+// CanResumeInterruptedJobs returns whether the pages of the DirectWorker jobs are tracked as they
+// complete, without it the pages of an interrupted job that were sent would be sent and counted again
+func (w *Worker) CanResumeInterruptedJobs() bool {
+	return w.Config.GetBool("workers.direct.resume")
+}
+
+// ResumeDirectBatchesJob enqueues the pages of a DirectWorker job again after it was interrupted,
+// the pages that were already completed are skipped
+func (w *Worker) ResumeDirectBatchesJob(job *model.Job) error {
+	if !w.CanResumeInterruptedJobs() {
+		return fmt.Errorf("cannot resume interrupted job %s without workers.direct.resume", job.ID.String())
+	}
+	return w.CreateDirectBatchesJob(job)
+}
+
+// IsJobInterrupted returns whether a worker was shut down while sending the job and it wasn't
+// resumed yet, the interruption is only written to the job status in redis
+func (w *Worker) IsJobInterrupted(job *model.Job) (bool, error) {
+	if job.Status != "" || job.CompletedAt > 0 {
+		return false, nil
+	}
+	status, err := w.GetJobStatus(job.ID)
+	if err != nil {
+		return false, err
+	}
+	return status["status"] == interruptedJobStatus, nil
+}
+
 // ScheduleDirectBatchesJob schedules a new DirectWorker job
 func (w *Worker) ScheduleDirectBatchesJob(job *model.Job, at int64) error {
 	maxRetries := w.Config.GetInt("workers.direct.maxRetries")
@@ -299,10 +554,31 @@ func (w *Worker) createDirectBatchesJobWithOption(job *model.Job, options gowork
 	var rownsEstimative uint64
 	var i uint64
 
-	job.GetJobInfoAndApp(w.MarathonDB)
+	if err := job.GetJobInfoAndApp(w.MarathonDB); err != nil {
+		return err
+	}
 	tableName := GetPushDBTableName(job.App.Name, job.Service)
+	// a job of an app without tokens would otherwise fail with an unrelated error
+	exists, err := w.PushTableExists(tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("unknown app %s: there is no push table %s", job.App.Name, tableName)
+	}
+	if len(job.Filters) > 0 {
+		columns, err := w.GetPushTableColumns(tableName)
+		if err != nil {
+			return err
+		}
+		// filters on columns the table doesn't have would fail every page of the job
+		if err := ValidateFilterColumns(job.Filters, columns); err != nil {
+			job.TagError(w.MarathonDB, nameDirectWorker, err.Error())
+			return err
+		}
+	}
 	query := fmt.Sprintf("SELECT reltuples::BIGINT AS estimate FROM pg_class WHERE relname = '%s';", tableName)
-	_, err := w.PushDB.QueryOne(&rownsEstimative, query)
+	_, err = w.PushDB.QueryOne(&rownsEstimative, query)
 	if err != nil {
 		return err
 	}
@@ -318,27 +594,81 @@ func (w *Worker) createDirectBatchesJobWithOption(job *model.Job, options gowork
 	//testBatchSize = (200000 * maxSeqID) / rownsEstimative
 	testBatchSize = 100000
 
+	var tuner *BatchSizeTuner
+	if w.Config.GetBool("workers.postgres.autoTuneBatch") {
+		tuner = NewBatchSizeTuner(
+			testBatchSize,
+			w.Config.GetInt64("workers.postgres.targetBytesPerPage"),
+			uint64(w.Config.GetInt64("workers.postgres.minPageSize")),
+			uint64(w.Config.GetInt64("workers.postgres.maxPageSize")),
+		)
+		tuner.SampleEvery = w.Config.GetInt("workers.postgres.tuneSampleEvery")
+	}
+
+	// range pages span batchSize seq ids, keyset pages span batchSize tokens so sparse seq ids don't make empty pages
+	keyset := false
+	switch pagination := w.Config.GetString("workers.postgres.pagination"); pagination {
+	case "range":
+	case "keyset":
+		keyset = true
+	default:
+		w.Logger.Warn("Invalid postgres pagination, using range.", zap.String("pagination", pagination))
+	}
+
 	producer := w.Manager.Producer()
 
+	var batches uint64
 	for i = 0; i < maxSeqID+1; {
+		batchSize := testBatchSize
+		if tuner != nil {
+			batchSize = tuner.Size()
+		}
+		biggestSeqID := i + batchSize
+		if keyset {
+			lastSeqID, err := w.getKeysetPageEnd(tableName, i, batchSize, maxSeqID)
+			if err != nil {
+				return err
+			}
+			biggestSeqID = lastSeqID + 1
+		}
 		_, err = producer.EnqueueWithOptions("direct_worker", "Add",
 			DirectPartMsg{
 				SmallestSeqID: i,
-				BiggestSeqID:  i + testBatchSize,
+				BiggestSeqID:  biggestSeqID,
 				JobUUID:       job.ID,
 			}, options)
 		if err != nil {
 			return err
 		}
-		i += testBatchSize
+		if tuner != nil && tuner.ShouldObserve() {
+			rows, bytes, err := w.getPageSize(tableName, i, biggestSeqID)
+			if err != nil {
+				return err
+			}
+			tuner.Observe(rows, bytes)
+		}
+		i = biggestSeqID
+		batches++
 	}
 
-	_, err = w.MarathonDB.Model(job).Set("total_tokens = ?", rownsEstimative).Where("id = ?", job.ID).Update()
-	if err != nil {
-		return err
+	// total tokens is only set once, a rescheduled job keeps its snapshot so its status doesn't flap
+	if job.TotalTokens > 0 {
+		maxDrift := w.Config.GetFloat64("workers.direct.maxTotalTokensDrift")
+		if HasTotalTokensDrifted(job.TotalTokens, int(rownsEstimative), maxDrift) {
+			w.Logger.Warn(
+				"Total tokens drifted from the job snapshot.",
+				zap.String("jobID", job.ID.String()),
+				zap.Int("totalTokens", job.TotalTokens),
+				zap.Uint64("estimate", rownsEstimative),
+			)
+		}
+	} else {
+		_, err = w.MarathonDB.Model(job).Set("total_tokens = ?", rownsEstimative).Where("id = ?", job.ID).Update()
+		if err != nil {
+			return err
+		}
 	}
 
-	batches := i / testBatchSize
 	_, err = w.MarathonDB.Model(job).Set("total_batches = ?", batches).Where("id = ?", job.ID).Update()
 	if err != nil {
 		return err
@@ -347,8 +677,32 @@ func (w *Worker) createDirectBatchesJobWithOption(job *model.Job, options gowork
 	return nil
 }
 
+// getPageSize returns the number of rows and the bytes of the columns sent by the direct worker in a seq_id range
+func (w *Worker) getPageSize(tableName string, smallestSeqID, biggestSeqID uint64) (int, int64, error) {
+	var page struct {
+		Rows  int
+		Bytes int64
+	}
+	query := fmt.Sprintf(`SELECT count(*) AS rows, coalesce(sum(
+		pg_column_size(user_id) + pg_column_size(token) + pg_column_size(locale) + pg_column_size(tz)
+	), 0) AS bytes FROM %s WHERE seq_id >= ? AND seq_id < ?;`, tableName)
+	_, err := w.PushDB.QueryOne(&page, query, smallestSeqID, biggestSeqID)
+	return page.Rows, page.Bytes, err
+}
+
+// getKeysetPageEnd returns the seq_id of the last of the next limit rows starting at smallestSeqID,
+// walking the seq_id index instead of scanning an offset. It returns maxSeqID if there are no more rows
+func (w *Worker) getKeysetPageEnd(tableName string, smallestSeqID, limit, maxSeqID uint64) (uint64, error) {
+	var lastSeqID uint64
+	query := fmt.Sprintf(`SELECT coalesce(max(seq_id), ?) FROM (
+		SELECT seq_id FROM %s WHERE seq_id >= ? ORDER BY seq_id LIMIT ?
+	) AS page;`, tableName)
+	_, err := w.PushDB.QueryOne(&lastSeqID, query, maxSeqID, smallestSeqID, limit)
+	return lastSeqID, err
+}
+
 // CreateProcessBatchJob creates a new ProcessBatchWorker job
-func (w *Worker) CreateProcessBatchJob(jobID string, appName string, users *[]User) (string, error) {
+func (w *Worker) CreateProcessBatchJob(jobID string, appName string, users *[]model.UserToken) (string, error) {
 	compressedUsers, err := CompressUsers(users)
 	if err != nil {
 		return "", err
@@ -399,7 +753,7 @@ func (w *Worker) ScheduleCreateBatchesFromFiltersJob(jobID *[]string, at int64)
 }
 
 // ScheduleProcessBatchJob schedules a new ProcessBatchWorker job
-func (w *Worker) ScheduleProcessBatchJob(jobID string, appName string, users *[]User, at int64) (string, error) {
+func (w *Worker) ScheduleProcessBatchJob(jobID string, appName string, users *[]model.UserToken, at int64) (string, error) {
 	compressedUsers, err := CompressUsers(users)
 	if err != nil {
 		return "", err
@@ -430,36 +784,562 @@ func (w *Worker) ScheduleJobCompletedJob(jobID string, at int64) (string, error)
 		})
 }
 
+// IsDryRun returns whether the pushes are rendered and discarded instead of sent
+func (w *Worker) IsDryRun() bool {
+	return w.Config.GetBool("workers.dryRun.enabled")
+}
+
+// finishJob schedules the JobCompletedWorker of a job whose pages or batches all completed. In dry run
+// mode nothing was sent, so there is no email, control group or campaign result to report: the redis
+// state the JobCompletedWorker would delete is deleted right away and the job is tagged as finished
+func (w *Worker) finishJob(job *model.Job) error {
+	if w.IsDryRun() {
+		pipe := w.RedisClient.Pipeline()
+		defer pipe.Close()
+		pipe.Del(jobTokensKey(job.ID), fmt.Sprintf("%s-CONTROL", job.ID.String()))
+		if _, err := pipe.Exec(); err != nil {
+			return err
+		}
+		job.TagSuccess(w.MarathonDB, nameJobCompleted, "finished in dry run mode")
+		return nil
+	}
+	at := time.Now().Add(w.Config.GetDuration("workers.processBatch.intervalToSendCompletedJob")).UnixNano()
+	_, err := w.ScheduleJobCompletedJob(job.ID.String(), at)
+	return err
+}
+
+// StatsHandler returns the handler of the stats server of the worker, which serves its health
+// for probes, the status of the jobs and its log level
+func (w *Worker) StatsHandler() http.Handler {
+	mux := http.NewServeMux()
+	// the loggers derived from w.Logger share its level, so changing it changes every one of them
+	mux.Handle("/log/level", zap.NewHTTPHandler(w.Logger))
+	mux.HandleFunc("/stats", w.serveHealth)
+	mux.HandleFunc("/healthcheck", w.serveHealth)
+	mux.HandleFunc("/status/", w.serveJobStatus)
+	return mux
+}
+
+func (w *Worker) serveHealth(rw http.ResponseWriter, req *http.Request) {
+	_, marathonError := w.MarathonDB.Exec("SELECT 1")
+	// the tokens of the jobs are read from the replica, so it's the push database the workers need
+	_, pushError := w.PushReadDB.Exec("SELECT 1")
+	pong, redisError := w.RedisClient.Ping().Result()
+
+	status := struct {
+		WorkingText     string                             `json:"working_text,omitempty"`
+		MarathonHealthy bool                               `json:"marathon_db_healthy"`
+		PushHealthy     bool                               `json:"push_db_healthy"`
+		RedisHealthy    bool                               `json:"redis_healthy"`
+		Channels        map[string]extensions.ChannelDepth `json:"channels,omitempty"`
+	}{
+		MarathonHealthy: marathonError == nil,
+		PushHealthy:     pushError == nil,
+		RedisHealthy:    redisError == nil && pong == "PONG",
+	}
+	// the depths are sampled on every request, the producer buffers are the only channels of the pipeline
+	if producer, ok := w.Kafka.(interface {
+		ChannelDepths() map[string]extensions.ChannelDepth
+	}); ok {
+		status.Channels = producer.ChannelDepths()
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !status.MarathonHealthy || !status.PushHealthy || !status.RedisHealthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		status.WorkingText = w.Config.GetString("healthcheck.workingText")
+	}
+	json.NewEncoder(rw).Encode(status)
+}
+
+// serveJobStatus writes the status hash of the job in /status/:jobId as json
+func (w *Worker) serveJobStatus(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	jobID, err := uuid.FromString(strings.TrimPrefix(req.URL.Path, "/status/"))
+	if err != nil {
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(rw).Encode(map[string]string{"reason": err.Error()})
+		return
+	}
+	status, err := w.GetJobStatus(jobID)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(rw).Encode(map[string]string{"reason": err.Error()})
+		return
+	}
+	if len(status) == 0 {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(rw).Encode(status)
+}
+
 // Start starts the worker
 func (w *Worker) Start() {
-	jobsStatsPort := w.Config.GetInt("workers.statsPort")
+	w.statsServer = &http.Server{
+		Addr:    fmt.Sprint(":", w.Config.GetInt("workers.statsPort")),
+		Handler: w.StatsHandler(),
+	}
 	go func() {
-		http.HandleFunc("/stats", func(rw http.ResponseWriter, req *http.Request) {
-
-			_, marathonError := w.MarathonDB.Exec("SELECT 1")
-			_, pushError := w.MarathonDB.Exec("SELECT 1")
-			pong, redisError := w.RedisClient.Ping().Result()
-
-			status := struct {
-				MarathonHealthy bool `json:"marathon_db_healthy"`
-				PushHealthy     bool `json:"push_db_healthy"`
-				RedisHealthy    bool `json:"redis_healthy"`
-			}{
-				MarathonHealthy: marathonError == nil,
-				PushHealthy:     pushError == nil,
-				RedisHealthy:    redisError == nil && pong == "PONG",
+		if err := w.statsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	w.Manager.Run()
+	// the manager only returns after it is stopped and in flight messages are processed
+	w.Close()
+}
+
+// Stop makes the worker stop fetching new messages, Start returns once the messages in flight
+// are processed, the pending pushes are flushed and the connections are closed
+func (w *Worker) Stop() {
+	w.stopOnce.Do(func() {
+		atomic.StoreInt32(&w.stopping, 1)
+		w.Manager.Stop()
+	})
+}
+
+// ExitAfterGracePeriod waits for a signal and then for the worker to close. The manager stops itself
+// on SIGINT and SIGTERM, so Start returns once the messages in flight are processed. If the worker
+// isn't closed within workers.gracefulShutdownTimeout it is interrupted and exit is called with 1
+func (w *Worker) ExitAfterGracePeriod(signals <-chan os.Signal, exit func(int)) {
+	sig := <-signals
+	timeout := time.Duration(w.Config.GetInt("workers.gracefulShutdownTimeout")) * time.Second
+	w.Logger.Info(
+		"draining workers due to caught signal",
+		zap.String("signal", sig.String()),
+		zap.Int("timeout", int(timeout.Seconds())),
+	)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.closed:
+		return
+	case <-timer.C:
+	}
+	w.Logger.Error("workers didn't drain before the graceful shutdown timeout, exiting")
+	// the jobs with pages still in flight are the ones this process interrupts
+	w.Interrupt()
+	exit(1)
+}
+
+// Close drains the worker in order: it stops fetching new messages, waits for the ones in flight
+// to be processed and then shuts the worker down. Every page or batch taken by the worker is done
+// by then, and the ones it didn't take are still queued for the other workers, so a clean drain
+// reports no job as interrupted
+func (w *Worker) Close() {
+	w.closeOnce.Do(func() {
+		w.Stop()
+		w.inFlight.Wait()
+		w.shutdown()
+	})
+}
+
+// Interrupt shuts the worker down without waiting for the messages in flight, the jobs they belong
+// to are reported as interrupted. It is used when the worker doesn't drain in time
+func (w *Worker) Interrupt() {
+	atomic.StoreInt32(&w.stopping, 1)
+	w.shutdown()
+}
+
+// shutdown flushes the pending pushes and reports the interrupted jobs before it closes the database
+// and redis connections they are written with
+func (w *Worker) shutdown() {
+	w.shutdownOnce.Do(func() {
+		// the healthcheck stops before the connections it checks are closed
+		if w.statsServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := w.statsServer.Shutdown(ctx); err != nil {
+				w.Logger.Error("Failed to close the stats server.", zap.Error(err))
 			}
+		}
+		if w.statusCoalescer != nil {
+			w.statusCoalescer.Close()
+		}
+		w.ReportInterruptedJobs()
 
-			if !status.MarathonHealthy || !status.PushHealthy || !status.RedisHealthy {
-				rw.WriteHeader(http.StatusServiceUnavailable)
+		if err := w.MarathonDB.Close(); err != nil {
+			w.Logger.Error("Failed to close marathon database.", zap.Error(err))
+		}
+		if err := w.PushDB.Close(); err != nil {
+			w.Logger.Error("Failed to close push database.", zap.Error(err))
+		}
+		if w.PushReadDB != w.PushDB {
+			if err := w.PushReadDB.Close(); err != nil {
+				w.Logger.Error("Failed to close push replica database.", zap.Error(err))
 			}
-			json.NewEncoder(rw).Encode(status)
+		}
+		if err := w.RedisClient.Close(); err != nil {
+			w.Logger.Error("Failed to close redis.", zap.Error(err))
+		}
+		w.Logger.Info("Worker closed.")
+		close(w.closed)
+	})
+}
+
+// IsStopping returns whether the worker is draining and should not start processing new messages
+func (w *Worker) IsStopping() bool {
+	return atomic.LoadInt32(&w.stopping) == 1
+}
+
+// TrackJob records that a page or batch of a job is being processed by this worker, so the job can
+// be reported if the worker is interrupted before it finishes
+func (w *Worker) TrackJob(jobID uuid.UUID) {
+	w.jobsLock.Lock()
+	defer w.jobsLock.Unlock()
+	if w.jobsInRun == nil {
+		w.jobsInRun = map[uuid.UUID]int{}
+	}
+	w.jobsInRun[jobID]++
+}
+
+// UntrackJob records that a page or batch of a job tracked with TrackJob finished
+func (w *Worker) UntrackJob(jobID uuid.UUID) {
+	w.jobsLock.Lock()
+	defer w.jobsLock.Unlock()
+	if w.jobsInRun[jobID] <= 1 {
+		delete(w.jobsInRun, jobID)
+		return
+	}
+	w.jobsInRun[jobID]--
+}
+
+// ReportInterruptedJobs flushes the pending pushes and writes an interrupted status with the
+// partial totals to redis for every job that still has a page or batch in flight in this worker,
+// the jobs whose pages finished may still be running in other workers so they are left alone
+func (w *Worker) ReportInterruptedJobs() {
+	atomic.StoreInt32(&w.stopping, 1)
+	if closer, ok := w.Kafka.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
+
+	w.jobsLock.Lock()
+	defer w.jobsLock.Unlock()
+	for jobID := range w.jobsInRun {
+		job, err := w.GetJob(jobID)
+		if err != nil {
+			w.Logger.Error("Failed to get interrupted job.", zap.String("jobID", jobID.String()), zap.Error(err))
+			continue
+		}
+		if job.CompletedAt > 0 {
+			continue
+		}
+		err = w.SetJobStatus(jobID, map[string]string{
+			"status":           interruptedJobStatus,
+			"totalTokens":      fmt.Sprint(job.TotalTokens),
+			"completedTokens":  fmt.Sprint(job.CompletedTokens),
+			"totalBatches":     fmt.Sprint(job.TotalBatches),
+			"completedBatches": fmt.Sprint(job.CompletedBatches),
+			"interruptedAt":    fmt.Sprint(time.Now().UnixNano()),
 		})
-		if err := http.ListenAndServe(fmt.Sprint(":", jobsStatsPort), nil); err != nil {
-			panic(err)
+		if err != nil {
+			w.Logger.Error("Failed to write interrupted job status.", zap.String("jobID", jobID.String()), zap.Error(err))
+			continue
 		}
-	}()
-	w.Manager.Run()
+		w.Logger.Info("Wrote interrupted job status.", zap.String("jobID", jobID.String()))
+	}
+	w.jobsInRun = nil
+}
+
+// Counters of the job status hash that are incremented while the job runs
+const (
+	JobStatusProcessedTokens  = "processedTokens"
+	JobStatusProcessedPages   = "processedPages"
+	JobStatusProcessedBatches = "processedBatches"
+	JobStatusDuplicatedTokens = "duplicatedTokens"
+	JobStatusExpiredTokens    = "expiredTokens"
+)
+
+func jobStatusKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-status", jobID.String())
+}
+
+func (w *Worker) jobStatusTTL() time.Duration {
+	ttl := w.Config.GetDuration("workers.status.ttl")
+	if ttl <= 0 {
+		ttl = 30 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// IsUnsentRedisError returns whether a redis command failed before it was sent, so retrying it can't
+// apply it twice. go-redis redials the dead connections of its pool on the next command
+func IsUnsentRedisError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// retryRedis calls f with backoff, f must be idempotent unless it is only retried when the command
+// wasn't sent, since a command that timed out may still have been applied
+func (w *Worker) retryRedis(idempotent bool, f func() error) error {
+	backoff := extensions.NewBackoff(
+		w.Config.GetDuration("workers.status.retryBackoff"),
+		5*time.Second,
+		0.2,
+		w.Config.GetInt("workers.status.retryAttempts"),
+	)
+	var err error
+	backoff.Retry(func() error {
+		err = f()
+		if err != nil && !idempotent && !IsUnsentRedisError(err) {
+			// stops retrying, err is still returned
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+// writeJobStatus writes the job status hash and refreshes its expiration, retrying each step on
+// its own so a counter isn't incremented twice when only the expiration failed. The status is
+// best-effort telemetry, so a persistent failure is logged and returned but never stops the job
+func (w *Worker) writeJobStatus(jobID uuid.UUID, idempotent bool, write func(key string) error) error {
+	key := jobStatusKey(jobID)
+	err := w.retryRedis(idempotent, func() error {
+		return write(key)
+	})
+	if err == nil {
+		err = w.retryRedis(true, func() error {
+			return w.RedisClient.Expire(key, w.jobStatusTTL()).Err()
+		})
+	}
+	if err != nil {
+		w.Logger.Error("Failed to write job status.", zap.String("jobID", jobID.String()), zap.Error(err))
+	}
+	return err
+}
+
+// SetJobStatus writes the fields to the job status hash in redis, every write refreshes the
+// expiration so the status of a running job isn't reaped before it finishes
+func (w *Worker) SetJobStatus(jobID uuid.UUID, fields map[string]string) error {
+	return w.writeJobStatus(jobID, true, func(key string) error {
+		return w.RedisClient.HMSet(key, fields).Err()
+	})
+}
+
+// IncrJobStatus atomically increments a counter of the job status hash in redis, so it can be
+// updated by many workers at once. An increment of zero doesn't change the counter and isn't written.
+// If workers.status.maxWritesPerSecond is set the increments are accumulated and written periodically
+func (w *Worker) IncrJobStatus(jobID uuid.UUID, field string, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	w.statusOnce.Do(w.configureStatusCoalescer)
+	if w.statusCoalescer != nil {
+		w.statusCoalescer.Add(jobID, field, n)
+		return nil
+	}
+	return w.writeJobStatus(jobID, false, func(key string) error {
+		return w.RedisClient.HIncrBy(key, field, n).Err()
+	})
+}
+
+// FlushJobStatus writes the job status increments accumulated by the workers, it does nothing if
+// they are written right away
+func (w *Worker) FlushJobStatus() {
+	if w.statusCoalescer != nil {
+		w.statusCoalescer.Flush()
+	}
+}
+
+func (w *Worker) configureStatusCoalescer() {
+	maxWrites := w.Config.GetFloat64("workers.status.maxWritesPerSecond")
+	if maxWrites <= 0 {
+		return
+	}
+	w.statusCoalescer = newStatusCoalescer(maxWrites, w.Config.GetFloat64("workers.status.jitter"), w.incrJobStatusCounters)
+}
+
+// incrJobStatusCounters increments many counters of the job status hash in a single write
+func (w *Worker) incrJobStatusCounters(jobID uuid.UUID, counters map[string]int64) error {
+	return w.writeJobStatus(jobID, false, func(key string) error {
+		_, err := w.RedisClient.Pipelined(func(pipe *redis.Pipeline) error {
+			for field, n := range counters {
+				pipe.HIncrBy(key, field, n)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// GetJobStatus returns the fields of the job status hash in redis, it is empty if the job has no status
+func (w *Worker) GetJobStatus(jobID uuid.UUID) (map[string]string, error) {
+	return w.RedisClient.HGetAll(jobStatusKey(jobID)).Result()
+}
+
+func cancelledJobKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-cancelled", jobID.String())
+}
+
+// CancelJob signals the workers sending pages of the job to stop before the pages end,
+// the signal expires with the job status
+func (w *Worker) CancelJob(jobID uuid.UUID) error {
+	return w.RedisClient.Set(cancelledJobKey(jobID), time.Now().UnixNano(), w.jobStatusTTL()).Err()
+}
+
+// IsJobCancelled returns whether the job was signalled to stop
+func (w *Worker) IsJobCancelled(jobID uuid.UUID) (bool, error) {
+	return w.RedisClient.Exists(cancelledJobKey(jobID)).Result()
+}
+
+func jobTokensKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-tokens", jobID.String())
+}
+
+// DropTokensOfOtherPages drops the users whose token was already sent by another page of the job
+// and returns how many were dropped. The page that claims a token first is kept in a redis hash,
+// so a retried page still sends its own tokens. The hash is deleted when the job completes and
+// expires after workers.direct.tokensTTL otherwise
+func (w *Worker) DropTokensOfOtherPages(jobID uuid.UUID, page string, users []model.UserToken) ([]model.UserToken, int, error) {
+	if len(users) == 0 {
+		return users, 0, nil
+	}
+	key := jobTokensKey(jobID)
+	pipe := w.RedisClient.Pipeline()
+	defer pipe.Close()
+	owners := make([]*redis.StringCmd, len(users))
+	for i, user := range users {
+		pipe.HSetNX(key, user.Token, page)
+		owners[i] = pipe.HGet(key, user.Token)
+	}
+	pipe.Expire(key, w.Config.GetDuration("workers.direct.tokensTTL"))
+	if _, err := pipe.Exec(); err != nil {
+		return users, 0, err
+	}
+	unique := make([]model.UserToken, 0, len(users))
+	for i, user := range users {
+		if owners[i].Val() == page {
+			unique = append(unique, user)
+		}
+	}
+	return unique, len(users) - len(unique), nil
+}
+
+// DeleteJobTokens deletes the tokens claimed by the pages of the job
+func (w *Worker) DeleteJobTokens(jobID uuid.UUID) error {
+	return w.RedisClient.Del(jobTokensKey(jobID)).Err()
+}
+
+func missingTemplateKey(appID uuid.UUID, name string) string {
+	return fmt.Sprintf("%s-missingtemplate-%s", appID.String(), name)
+}
+
+// GetJobTemplates returns the templates of the job by name and locale. When the app has none of them
+// the miss is kept in redis for workers.templates.missingTTL, so the batches of the job don't query
+// the database again for templates that don't exist
+func (w *Worker) GetJobTemplates(job *model.Job) (map[string]map[string]model.Template, error) {
+	ttl := w.Config.GetDuration("workers.templates.missingTTL")
+	if ttl <= 0 {
+		return job.GetJobTemplatesByNameAndLocale(w.MarathonDB)
+	}
+	names := job.TemplateNames()
+	if w.areTemplatesMissing(job.App.ID, names) {
+		return nil, &model.TemplatesNotFoundError{TemplateName: job.TemplateName, AppID: job.App.ID}
+	}
+	templates, err := job.GetJobTemplatesByNameAndLocale(w.MarathonDB)
+	if _, ok := err.(*model.TemplatesNotFoundError); ok {
+		pipe := w.RedisClient.Pipeline()
+		defer pipe.Close()
+		for _, name := range names {
+			pipe.Set(missingTemplateKey(job.App.ID, name), time.Now().UnixNano(), ttl)
+		}
+		if _, redisErr := pipe.Exec(); redisErr != nil {
+			w.Logger.Warn("Failed to cache missing templates.", zap.Error(redisErr))
+		}
+	}
+	return templates, err
+}
+
+func (w *Worker) areTemplatesMissing(appID uuid.UUID, names []string) bool {
+	pipe := w.RedisClient.Pipeline()
+	defer pipe.Close()
+	missing := make([]*redis.BoolCmd, len(names))
+	for i, name := range names {
+		missing[i] = pipe.Exists(missingTemplateKey(appID, name))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return false
+	}
+	for _, cmd := range missing {
+		if !cmd.Val() {
+			return false
+		}
+	}
+	return true
+}
+
+// ClearMissingTemplate forgets a cached miss of the template, it is called when the template is created
+func (w *Worker) ClearMissingTemplate(appID uuid.UUID, name string) error {
+	return w.RedisClient.Del(missingTemplateKey(appID, name)).Err()
+}
+
+func dryRunSamplesKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-dryrunsamples", jobID.String())
+}
+
+// AddDryRunSample keeps the first workers.dryRun.sampleSize pushes rendered for the job by any
+// worker in redis, they expire with the job status
+func (w *Worker) AddDryRunSample(jobID string, sample *extensions.DryRunSample) {
+	id, err := uuid.FromString(jobID)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return
+	}
+	key := dryRunSamplesKey(id)
+	pipe := w.RedisClient.Pipeline()
+	defer pipe.Close()
+	pipe.RPush(key, string(b))
+	pipe.LTrim(key, 0, int64(w.Config.GetInt("workers.dryRun.sampleSize")-1))
+	pipe.Expire(key, w.jobStatusTTL())
+	if _, err := pipe.Exec(); err != nil {
+		w.Logger.Warn("Failed to keep dry run sample.", zap.String("jobId", jobID), zap.Error(err))
+	}
+}
+
+// GetDryRunSamples returns the pushes of the job rendered in dry run mode
+func (w *Worker) GetDryRunSamples(jobID uuid.UUID) ([]extensions.DryRunSample, error) {
+	values, err := w.RedisClient.LRange(dryRunSamplesKey(jobID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]extensions.DryRunSample, 0, len(values))
+	for _, value := range values {
+		var sample extensions.DryRunSample
+		if err := json.Unmarshal([]byte(value), &sample); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func pausedDirectPagesKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-pauseddirectpages", jobID.String())
+}
+
+func completedPagesKey(jobID uuid.UUID) string {
+	return fmt.Sprintf("%s-completedpages", jobID.String())
+}
+
+// MarkPageCompleted records that a page of the job was sent, the record expires with the job status
+func (w *Worker) MarkPageCompleted(jobID uuid.UUID, page string) error {
+	key := completedPagesKey(jobID)
+	if err := w.RedisClient.SAdd(key, page).Err(); err != nil {
+		return err
+	}
+	return w.RedisClient.Expire(key, w.jobStatusTTL()).Err()
+}
+
+// IsPageCompleted returns whether a page of the job was already sent
+func (w *Worker) IsPageCompleted(jobID uuid.UUID, page string) (bool, error) {
+	return w.RedisClient.SIsMember(completedPagesKey(jobID), page).Result()
 }
 
 // SendControlGroupToRedis send a sequency of users ids to redis
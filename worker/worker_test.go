@@ -0,0 +1,761 @@
+/*
+ * Copyright (c) 2016 TFG Co <backend@tfgco.com>
+ * Author: TFG Co <backend@tfgco.com>
+ *
+ * Permifsion is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package worker_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/marathon/extensions"
+	"github.com/topfreegames/marathon/model"
+	. "github.com/topfreegames/marathon/testing"
+	"github.com/topfreegames/marathon/worker"
+	"github.com/uber-go/zap"
+)
+
+var _ = Describe("Worker", func() {
+	logger := zap.New(
+		zap.NewJSONEncoder(zap.NoTime()), // drop timestamps in tests
+		zap.FatalLevel,
+	)
+
+	Describe("Report interrupted jobs", func() {
+		var w *worker.Worker
+		var app *model.App
+		var template *model.Template
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.Kafka = NewFakeKafkaProducer()
+			w.RedisClient.FlushAll()
+			app = CreateTestApp(w.MarathonDB)
+			template = CreateTestTemplate(w.MarathonDB, app.ID)
+		})
+
+		It("should write an interrupted status with the partial totals", func() {
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			_, err := w.MarathonDB.Model(job).Set(
+				"total_tokens = 100, completed_tokens = 40, total_batches = 10, completed_batches = 4",
+			).Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			w.TrackJob(job.ID)
+			w.ReportInterruptedJobs()
+
+			Expect(w.IsStopping()).To(BeTrue())
+			status, err := w.RedisClient.HGetAll(fmt.Sprintf("%s-status", job.ID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status["status"]).To(Equal("interrupted"))
+			Expect(status["totalTokens"]).To(Equal("100"))
+			Expect(status["completedTokens"]).To(Equal("40"))
+			Expect(status["totalBatches"]).To(Equal("10"))
+			Expect(status["completedBatches"]).To(Equal("4"))
+			Expect(status["interruptedAt"]).NotTo(BeEmpty())
+		})
+
+		It("should not write an interrupted status for jobs without pages in flight", func() {
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			otherJob := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+
+			w.TrackJob(job.ID)
+			w.TrackJob(job.ID)
+			w.UntrackJob(job.ID)
+			w.TrackJob(otherJob.ID)
+			w.UntrackJob(otherJob.ID)
+			w.ReportInterruptedJobs()
+
+			status, err := w.RedisClient.HGet(fmt.Sprintf("%s-status", job.ID.String()), "status").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal("interrupted"))
+			exists, err := w.RedisClient.Exists(fmt.Sprintf("%s-status", otherJob.ID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("should not write an interrupted status for completed jobs", func() {
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			_, err := w.MarathonDB.Model(job).Set("completed_at = 1").Where("id = ?", job.ID).Update()
+			Expect(err).NotTo(HaveOccurred())
+
+			w.TrackJob(job.ID)
+			w.ReportInterruptedJobs()
+
+			exists, err := w.RedisClient.Exists(fmt.Sprintf("%s-status", job.ID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Describe("Set job status", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+		})
+
+		It("should write the status with the configured ttl", func() {
+			w.Config.Set("workers.status.ttl", "1h")
+			jobID := uuid.NewV4()
+
+			err := w.SetJobStatus(jobID, map[string]string{"status": "running"})
+			Expect(err).NotTo(HaveOccurred())
+
+			key := fmt.Sprintf("%s-status", jobID.String())
+			status, err := w.RedisClient.HGet(key, "status").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal("running"))
+			ttl, err := w.RedisClient.TTL(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", time.Hour, time.Minute))
+		})
+
+		It("should refresh the ttl on every write", func() {
+			jobID := uuid.NewV4()
+			key := fmt.Sprintf("%s-status", jobID.String())
+
+			w.Config.Set("workers.status.ttl", "1m")
+			err := w.SetJobStatus(jobID, map[string]string{"status": "running"})
+			Expect(err).NotTo(HaveOccurred())
+
+			w.Config.Set("workers.status.ttl", "1h")
+			err = w.SetJobStatus(jobID, map[string]string{"status": "running"})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := w.RedisClient.TTL(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically(">", time.Minute))
+		})
+
+		It("should increment the counters and read them back", func() {
+			jobID := uuid.NewV4()
+
+			err := w.SetJobStatus(jobID, map[string]string{"status": "running"})
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				err = w.IncrJobStatus(jobID, worker.JobStatusProcessedTokens, 10)
+				Expect(err).NotTo(HaveOccurred())
+				err = w.IncrJobStatus(jobID, worker.JobStatusProcessedPages, 1)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			status, err := w.GetJobStatus(jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(map[string]string{
+				"status":                        "running",
+				worker.JobStatusProcessedTokens: "30",
+				worker.JobStatusProcessedPages:  "3",
+			}))
+			ttl, err := w.RedisClient.TTL(fmt.Sprintf("%s-status", jobID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically(">", 0))
+		})
+
+		It("should not lose increments from concurrent workers while the status is read", func() {
+			jobID := uuid.NewV4()
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_, err := w.GetJobStatus(jobID)
+						Expect(err).NotTo(HaveOccurred())
+					}
+				}
+			}()
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						Expect(w.IncrJobStatus(jobID, worker.JobStatusProcessedTokens, 5)).To(Succeed())
+						Expect(w.IncrJobStatus(jobID, worker.JobStatusProcessedPages, 1)).To(Succeed())
+					}
+				}()
+			}
+			wg.Wait()
+			close(done)
+
+			status, err := w.GetJobStatus(jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status[worker.JobStatusProcessedTokens]).To(Equal("1000"))
+			Expect(status[worker.JobStatusProcessedPages]).To(Equal("200"))
+		})
+
+		It("should accumulate the increments and write them at the max rate", func() {
+			w.Config.Set("workers.status.maxWritesPerSecond", 5)
+			w.Config.Set("workers.status.jitter", 0.1)
+			jobID := uuid.NewV4()
+
+			for i := 0; i < 10; i++ {
+				Expect(w.IncrJobStatus(jobID, worker.JobStatusProcessedTokens, 10)).To(Succeed())
+			}
+			Expect(w.IncrJobStatus(jobID, worker.JobStatusProcessedPages, 1)).To(Succeed())
+			status, err := w.GetJobStatus(jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(BeEmpty())
+
+			Eventually(func() map[string]string {
+				status, _ := w.GetJobStatus(jobID)
+				return status
+			}, time.Second).Should(Equal(map[string]string{
+				worker.JobStatusProcessedTokens: "100",
+				worker.JobStatusProcessedPages:  "1",
+			}))
+			ttl, err := w.RedisClient.TTL(fmt.Sprintf("%s-status", jobID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically(">", 0))
+		})
+
+		It("should write the accumulated increments when flushed", func() {
+			w.Config.Set("workers.status.maxWritesPerSecond", 0.1)
+			jobID := uuid.NewV4()
+
+			Expect(w.IncrJobStatus(jobID, worker.JobStatusProcessedTokens, 7)).To(Succeed())
+			w.FlushJobStatus()
+
+			status, err := w.GetJobStatus(jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status[worker.JobStatusProcessedTokens]).To(Equal("7"))
+		})
+
+		It("should not write the status for an empty increment", func() {
+			jobID := uuid.NewV4()
+
+			err := w.IncrJobStatus(jobID, worker.JobStatusProcessedTokens, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := w.RedisClient.Exists(fmt.Sprintf("%s-status", jobID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("should return an empty status if the job has none", func() {
+			status, err := w.GetJobStatus(uuid.NewV4())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(BeEmpty())
+		})
+
+		It("should only retry the commands that weren't sent unless they are idempotent", func() {
+			Expect(worker.IsUnsentRedisError(&net.OpError{Op: "dial", Err: errors.New("connection refused")})).To(BeTrue())
+			Expect(worker.IsUnsentRedisError(&net.OpError{Op: "read", Err: errors.New("i/o timeout")})).To(BeFalse())
+			Expect(worker.IsUnsentRedisError(errors.New("redis: client is closed"))).To(BeFalse())
+		})
+
+		It("should return an error instead of panicking if redis can't be reached", func() {
+			w.Config.Set("workers.status.retryAttempts", 2)
+			w.Config.Set("workers.status.retryBackoff", "1ms")
+			Expect(w.RedisClient.Close()).To(Succeed())
+
+			Expect(func() {
+				err := w.SetJobStatus(uuid.NewV4(), map[string]string{"status": "running"})
+				Expect(err).To(HaveOccurred())
+			}).NotTo(Panic())
+		})
+
+		It("should use the default ttl if it is not positive", func() {
+			w.Config.Set("workers.status.ttl", "0s")
+			jobID := uuid.NewV4()
+
+			err := w.SetJobStatus(jobID, map[string]string{"status": "running"})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := w.RedisClient.TTL(fmt.Sprintf("%s-status", jobID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("~", 30*24*time.Hour, time.Minute))
+		})
+	})
+
+	Describe("Drop tokens of other pages", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+		})
+
+		It("should drop the tokens claimed by another page of the job", func() {
+			jobID := uuid.NewV4()
+			first := []model.UserToken{{UserID: "a", Token: "token-a"}, {UserID: "b", Token: "token-b"}}
+			second := []model.UserToken{{UserID: "b", Token: "token-b"}, {UserID: "c", Token: "token-c"}}
+
+			unique, dropped, err := w.DropTokensOfOtherPages(jobID, "1-10", first)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(Equal(0))
+			Expect(unique).To(Equal(first))
+
+			unique, dropped, err = w.DropTokensOfOtherPages(jobID, "10-20", second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(Equal(1))
+			Expect(unique).To(Equal([]model.UserToken{{UserID: "c", Token: "token-c"}}))
+		})
+
+		It("should keep the tokens of a retried page", func() {
+			jobID := uuid.NewV4()
+			users := []model.UserToken{{UserID: "a", Token: "token-a"}}
+
+			_, _, err := w.DropTokensOfOtherPages(jobID, "1-10", users)
+			Expect(err).NotTo(HaveOccurred())
+			unique, dropped, err := w.DropTokensOfOtherPages(jobID, "1-10", users)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(Equal(0))
+			Expect(unique).To(Equal(users))
+		})
+
+		It("should expire the tokens after workers.direct.tokensTTL", func() {
+			jobID := uuid.NewV4()
+			_, _, err := w.DropTokensOfOtherPages(jobID, "1-10", []model.UserToken{{UserID: "a", Token: "token-a"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			ttl, err := w.RedisClient.TTL(fmt.Sprintf("%s-tokens", jobID.String())).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ttl).To(BeNumerically("<=", 24*time.Hour))
+			Expect(ttl).To(BeNumerically(">", 23*time.Hour))
+		})
+
+		It("should not share tokens between jobs", func() {
+			users := []model.UserToken{{UserID: "a", Token: "token-a"}}
+
+			_, _, err := w.DropTokensOfOtherPages(uuid.NewV4(), "1-10", users)
+			Expect(err).NotTo(HaveOccurred())
+			unique, dropped, err := w.DropTokensOfOtherPages(uuid.NewV4(), "10-20", users)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dropped).To(Equal(0))
+			Expect(unique).To(Equal(users))
+		})
+	})
+
+	Describe("Validate config", func() {
+		It("should accept the test config", func() {
+			w := worker.NewWorker(logger, GetConfPath())
+			Expect(worker.ValidateConfig(w.Config)).To(Succeed())
+		})
+
+		It("should list every missing or invalid key", func() {
+			config := viper.New()
+			config.Set("workers.redis.host", "localhost")
+			config.Set("workers.redis.port", "6379")
+			config.Set("db.host", "localhost")
+			config.Set("db.port", "not-a-port")
+			config.Set("db.user", "postgres")
+			config.Set("db.database", "marathon")
+			config.Set("push.db.host", "")
+			config.Set("push.db.port", 5432)
+			config.Set("push.db.user", "postgres")
+
+			err := worker.ValidateConfig(config)
+			Expect(err).To(MatchError("missing config: push.db.host, push.db.database; config must be an integer: db.port"))
+		})
+	})
+
+	Describe("Validate redis config", func() {
+		validConfig := func() *viper.Viper {
+			config := viper.New()
+			config.Set("db.host", "localhost")
+			config.Set("db.port", 5432)
+			config.Set("db.user", "postgres")
+			config.Set("db.database", "marathon")
+			config.Set("push.db.host", "localhost")
+			config.Set("push.db.port", 5432)
+			config.Set("push.db.user", "postgres")
+			config.Set("push.db.database", "push")
+			return config
+		}
+
+		It("should not require the redis host and port in sentinel mode", func() {
+			config := validConfig()
+			config.Set("workers.redis.mode", "sentinel")
+			config.Set("workers.redis.sentinel.master", "mymaster")
+			config.Set("workers.redis.sentinel.addrs", "localhost:26379")
+			Expect(worker.ValidateConfig(config)).To(Succeed())
+		})
+
+		It("should require a standalone queue redis in cluster mode", func() {
+			config := validConfig()
+			config.Set("workers.redis.mode", "cluster")
+			config.Set("workers.redis.cluster.addrs", "localhost:7000,localhost:7001")
+			err := worker.ValidateConfig(config)
+			Expect(err).To(MatchError("missing config: workers.redis.queue.host, workers.redis.queue.port"))
+
+			config.Set("workers.redis.queue.host", "localhost")
+			config.Set("workers.redis.queue.port", 6379)
+			Expect(worker.ValidateConfig(config)).To(Succeed())
+		})
+
+		It("should reject an unknown redis mode", func() {
+			config := validConfig()
+			config.Set("workers.redis.mode", "ring")
+			err := worker.ValidateConfig(config)
+			Expect(err).To(MatchError("unknown workers.redis.mode: ring"))
+		})
+	})
+
+	Describe("Push read database", func() {
+		It("should read the tokens from the push database if no replica is configured", func() {
+			w := worker.NewWorker(logger, GetConfPath())
+			Expect(w.PushReadDB).NotTo(BeNil())
+			Expect(w.PushReadDB).To(BeIdenticalTo(w.PushDB))
+		})
+	})
+
+	Describe("Completed pages", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+		})
+
+		It("should mark a page as completed with the status ttl", func() {
+			jobID := uuid.NewV4()
+			completed, err := w.IsPageCompleted(jobID, "1-10")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(completed).To(BeFalse())
+
+			Expect(w.MarkPageCompleted(jobID, "1-10")).To(Succeed())
+
+			completed, err = w.IsPageCompleted(jobID, "1-10")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(completed).To(BeTrue())
+			completed, err = w.IsPageCompleted(jobID, "10-20")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(completed).To(BeFalse())
+			ttl := w.RedisClient.TTL(fmt.Sprintf("%s-completedpages", jobID.String())).Val()
+			Expect(ttl).To(BeNumerically(">", 0))
+		})
+
+		It("should not share completed pages between jobs", func() {
+			Expect(w.MarkPageCompleted(uuid.NewV4(), "1-10")).To(Succeed())
+			completed, err := w.IsPageCompleted(uuid.NewV4(), "1-10")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(completed).To(BeFalse())
+		})
+	})
+
+	Describe("Missing templates", func() {
+		var w *worker.Worker
+		var app *model.App
+		var job *model.Job
+		var name string
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+			app = CreateTestApp(w.MarathonDB)
+			name = uuid.NewV4().String()
+			created := CreateTestJob(w.MarathonDB, app.ID, name)
+			var err error
+			job, err = w.GetJob(created.ID)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should not query the database again for a cached miss within the ttl", func() {
+			_, err := w.GetJobTemplates(job)
+			Expect(err).To(BeAssignableToTypeOf(&model.TemplatesNotFoundError{}))
+
+			// inserted behind the cache's back, so only a database hit would find it
+			CreateTestTemplate(w.MarathonDB, app.ID, map[string]interface{}{"name": name})
+			_, err = w.GetJobTemplates(job)
+			Expect(err).To(BeAssignableToTypeOf(&model.TemplatesNotFoundError{}))
+		})
+
+		It("should find the template once the miss is cleared", func() {
+			_, err := w.GetJobTemplates(job)
+			Expect(err).To(HaveOccurred())
+
+			CreateTestTemplate(w.MarathonDB, app.ID, map[string]interface{}{"name": name, "locale": "en"})
+			Expect(w.ClearMissingTemplate(app.ID, name)).To(Succeed())
+
+			templates, err := w.GetJobTemplates(job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templates[name]).To(HaveKey("en"))
+		})
+
+		It("should not cache misses when the ttl is zero", func() {
+			w.Config.Set("workers.templates.missingTTL", "0s")
+			_, err := w.GetJobTemplates(job)
+			Expect(err).To(HaveOccurred())
+
+			CreateTestTemplate(w.MarathonDB, app.ID, map[string]interface{}{"name": name, "locale": "en"})
+			templates, err := w.GetJobTemplates(job)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templates[name]).To(HaveKey("en"))
+		})
+	})
+
+	Describe("Dry run samples", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+		})
+
+		It("should keep the first samples of the job", func() {
+			w.Config.Set("workers.dryRun.sampleSize", 2)
+			jobID := uuid.NewV4()
+			for _, token := range []string{"token-1", "token-2", "token-3"} {
+				w.AddDryRunSample(jobID.String(), &extensions.DryRunSample{Token: token})
+			}
+
+			samples, err := w.GetDryRunSamples(jobID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(samples).To(HaveLen(2))
+			Expect(samples[0].Token).To(Equal("token-1"))
+			Expect(samples[1].Token).To(Equal("token-2"))
+		})
+
+		It("should return no samples for a job that didn't run in dry run mode", func() {
+			samples, err := w.GetDryRunSamples(uuid.NewV4())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(samples).To(BeEmpty())
+		})
+	})
+
+	Describe("Stats handler", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.RedisClient.FlushAll()
+		})
+
+		It("should report the connections as healthy", func() {
+			w.Kafka = NewFakeKafkaProducer()
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthcheck", nil))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var status map[string]interface{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+			Expect(status).To(Equal(map[string]interface{}{
+				"working_text":        "WORKING",
+				"marathon_db_healthy": true,
+				"push_db_healthy":     true,
+				"redis_healthy":       true,
+			}))
+		})
+
+		It("should report the depths of the producer channels", func() {
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var status struct {
+				Channels map[string]extensions.ChannelDepth `json:"channels"`
+			}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+			Expect(status.Channels).To(HaveKey("input"))
+			Expect(status.Channels).To(HaveKey("successes"))
+			Expect(status.Channels).To(HaveKey("errors"))
+			Expect(status.Channels["input"].Cap).To(Equal(256))
+		})
+
+		It("should return the configured working text", func() {
+			w.Kafka = NewFakeKafkaProducer()
+			w.Config.Set("healthcheck.workingText", "OK")
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthcheck", nil))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var status map[string]interface{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+			Expect(status["working_text"]).To(Equal("OK"))
+		})
+
+		It("should return 503 without the working text when a connection is down", func() {
+			w.PushReadDB.Close()
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthcheck", nil))
+
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			var status map[string]interface{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+			Expect(status["push_db_healthy"]).To(BeFalse())
+			Expect(status).NotTo(HaveKey("working_text"))
+		})
+
+		It("should return the status of a job", func() {
+			jobID := uuid.NewV4()
+			Expect(w.SetJobStatus(jobID, map[string]string{"status": "running"})).To(Succeed())
+
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/status/%s", jobID), nil))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			var status map[string]string
+			Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+			Expect(status["status"]).To(Equal("running"))
+		})
+
+		It("should return 404 for a job without status", func() {
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/status/%s", uuid.NewV4()), nil))
+			Expect(rec.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should return 422 for an invalid job id", func() {
+			rec := httptest.NewRecorder()
+			w.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status/not-a-uuid", nil))
+			Expect(rec.Code).To(Equal(http.StatusUnprocessableEntity))
+		})
+	})
+
+	Describe("Close", func() {
+		var w *worker.Worker
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.Kafka = NewFakeKafkaProducer()
+			w.RedisClient.FlushAll()
+		})
+
+		It("should report interrupted jobs before closing the connections", func() {
+			app := CreateTestApp(w.MarathonDB)
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			key := fmt.Sprintf("%s-status", job.ID.String())
+			w.TrackJob(job.ID)
+
+			reader := worker.NewWorker(logger, GetConfPath())
+			w.Close()
+
+			Expect(w.IsStopping()).To(BeTrue())
+			status, err := reader.RedisClient.HGet(key, "status").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal("interrupted"))
+			_, err = w.MarathonDB.Exec("SELECT 1")
+			Expect(err).To(HaveOccurred())
+			Expect(w.RedisClient.Ping().Err()).To(HaveOccurred())
+		})
+
+		It("should not report the jobs whose pages finished on a clean drain", func() {
+			app := CreateTestApp(w.MarathonDB)
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			key := fmt.Sprintf("%s-status", job.ID.String())
+			w.TrackJob(job.ID)
+			w.UntrackJob(job.ID)
+
+			reader := worker.NewWorker(logger, GetConfPath())
+			w.Close()
+
+			exists, err := reader.RedisClient.Exists(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+
+		It("should report the jobs in flight before closing the connections when interrupted", func() {
+			app := CreateTestApp(w.MarathonDB)
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			key := fmt.Sprintf("%s-status", job.ID.String())
+			w.TrackJob(job.ID)
+
+			reader := worker.NewWorker(logger, GetConfPath())
+			w.Interrupt()
+
+			Expect(w.IsStopping()).To(BeTrue())
+			status, err := reader.RedisClient.HGet(key, "status").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal("interrupted"))
+			Expect(w.RedisClient.Ping().Err()).To(HaveOccurred())
+			Expect(func() { w.Close() }).NotTo(Panic())
+		})
+
+		It("should be safe to call more than once", func() {
+			w.Close()
+			Expect(func() { w.Close() }).NotTo(Panic())
+		})
+
+		It("should mark the worker as stopping when it is stopped", func() {
+			Expect(w.IsStopping()).To(BeFalse())
+			w.Stop()
+			Expect(w.IsStopping()).To(BeTrue())
+		})
+	})
+
+	Describe("Exit after grace period", func() {
+		var w *worker.Worker
+		var signals chan os.Signal
+		var exited chan int
+
+		BeforeEach(func() {
+			w = worker.NewWorker(logger, GetConfPath())
+			w.Kafka = NewFakeKafkaProducer()
+			w.RedisClient.FlushAll()
+			w.Config.Set("workers.gracefulShutdownTimeout", 1)
+			signals = make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM)
+			exited = make(chan int, 1)
+		})
+
+		AfterEach(func() {
+			signal.Stop(signals)
+		})
+
+		It("should interrupt the worker and exit when it doesn't drain within the grace period", func() {
+			app := CreateTestApp(w.MarathonDB)
+			template := CreateTestTemplate(w.MarathonDB, app.ID)
+			job := CreateTestJob(w.MarathonDB, app.ID, template.Name)
+			w.TrackJob(job.ID)
+			reader := worker.NewWorker(logger, GetConfPath())
+
+			go w.ExitAfterGracePeriod(signals, func(code int) { exited <- code })
+			start := time.Now()
+			Expect(syscall.Kill(syscall.Getpid(), syscall.SIGTERM)).To(Succeed())
+
+			Eventually(exited, 2*time.Second).Should(Receive(Equal(1)))
+			Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+			status, err := reader.RedisClient.HGet(fmt.Sprintf("%s-status", job.ID.String()), "status").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal("interrupted"))
+		})
+
+		It("should not exit if the worker closes within the grace period", func() {
+			go w.ExitAfterGracePeriod(signals, func(code int) { exited <- code })
+			Expect(syscall.Kill(syscall.Getpid(), syscall.SIGTERM)).To(Succeed())
+			w.Close()
+
+			Consistently(exited, 1500*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+})